@@ -7,6 +7,7 @@ require (
 	github.com/Azure/azure-storage-blob-go v0.9.0
 	github.com/edsrzf/mmap-go v1.0.0
 	github.com/mattn/go-ieproxy v0.0.1 // indirect
-	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1 // indirect
+	github.com/zeebo/xxh3 v0.13.0
+	golang.org/x/crypto v0.0.0-20191206172530-e9b2fee46413
 	golang.org/x/text v0.3.3 // indirect
 )
@@ -1,48 +1,214 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"github.com/kpfaulkner/blobsyncgo/pkg/azureutils"
 	"github.com/kpfaulkner/blobsyncgo/pkg/blobsync"
+	"github.com/kpfaulkner/blobsyncgo/pkg/configutils"
+	"github.com/kpfaulkner/blobsyncgo/pkg/localutils"
+	"github.com/kpfaulkner/blobsyncgo/pkg/s3utils"
 	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"os/user"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-// read config from multiple locations.
-// first try local dir...
-// if fails, try ~/.blobsync/config.json
-func readConfig() signatures.Config {
-	var configFile *os.File
-	var err error
-	configFile, err = os.Open("config.json")
+// endpointFromConfig builds the blob endpoint, anything not specified in config stays as default.
+func endpointFromConfig(config configutils.Config) azureutils.Endpoint {
+	endpoint := azureutils.DefaultEndpoint()
+	if config.EndpointScheme != "" {
+		endpoint.Scheme = config.EndpointScheme
+	}
+	if config.EndpointSuffix != "" {
+		endpoint.Suffix = config.EndpointSuffix
+	}
+	endpoint.Host = config.EndpointHost
+	endpoint.PathStyle = config.EndpointPathStyle
+	return endpoint
+}
+
+// storageFlags are the command line settings for where blobs are stored, shared by every command.
+type storageFlags struct {
+	configPath        *string
+	profile           *string
+	localRoot         *string
+	s3Endpoint        *string
+	endpointScheme    *string
+	endpointHost      *string
+	endpointSuffix    *string
+	endpointPathStyle *bool
+	sas               *string
+	sigSAS            *string
+	connectionString  *string
+	managedIdentity   *bool
+}
+
+func addStorageFlags(fs *flag.FlagSet) storageFlags {
+	return storageFlags{
+		configPath:        fs.String("config", "", "path to config file (default: first of ./config.json, $XDG_CONFIG_HOME/blobsync/config.json, ~/.blobsync/config.json)"),
+		profile:           fs.String("profile", "", "named profile within the config file"),
+		localRoot:         fs.String("localroot", "", "sync against this local directory instead of Azure"),
+		s3Endpoint:        fs.String("s3endpoint", "", "sync against this S3 compatible endpoint instead of Azure"),
+		endpointScheme:    fs.String("scheme", "", "blob endpoint scheme (http or https)"),
+		endpointHost:      fs.String("host", "", "blob endpoint host[:port], eg. 127.0.0.1:10000 for Azurite"),
+		endpointSuffix:    fs.String("endpointsuffix", "", "blob endpoint suffix, eg. core.chinacloudapi.cn"),
+		endpointPathStyle: fs.Bool("pathstyle", false, "account name is part of the path (emulators)"),
+		sas:               fs.String("sas", "", "SAS URL or token to use instead of the account key"),
+		sigSAS:            fs.String("sigsas", "", "SAS URL for the .sig blob, when -sas is blob scoped"),
+		connectionString:  fs.String("connectionstring", "", "Azure storage connection string"),
+		managedIdentity:   fs.Bool("managedidentity", false, "authenticate with the managed identity of this machine"),
+	}
+}
+
+// loadConfig loads the config file, with any storage settings given on the command line winning.
+// Credentials on the command line replace all of those from the config file and environment.
+func (f storageFlags) loadConfig() (configutils.Config, error) {
+	config, err := configutils.LoadConfig(*f.configPath, *f.profile)
 	if err != nil {
-		// try and read home dir location.
-		usr, err := user.Current()
+		return config, err
+	}
+
+	if *f.sas != "" || *f.sigSAS != "" || *f.connectionString != "" || *f.managedIdentity {
+		config.ClearCredentials()
+	}
+
+	if *f.localRoot != "" {
+		config.LocalRoot = *f.localRoot
+	}
+	if *f.s3Endpoint != "" {
+		config.S3Endpoint = *f.s3Endpoint
+	}
+	if *f.endpointScheme != "" {
+		config.EndpointScheme = *f.endpointScheme
+	}
+	if *f.endpointHost != "" {
+		config.EndpointHost = *f.endpointHost
+	}
+	if *f.endpointSuffix != "" {
+		config.EndpointSuffix = *f.endpointSuffix
+	}
+	if *f.endpointPathStyle {
+		config.EndpointPathStyle = true
+	}
+	if *f.sas != "" {
+		if strings.HasPrefix(*f.sas, "http") {
+			config.SASURL = *f.sas
+		} else {
+			config.SASToken = *f.sas
+		}
+	}
+	if *f.sigSAS != "" {
+		config.SignatureSASURL = *f.sigSAS
+	}
+	if *f.connectionString != "" {
+		config.ConnectionString = *f.connectionString
+	}
+	if *f.managedIdentity {
+		config.UseManagedIdentity = true
+	}
+	return config, nil
+}
+
+// signatureOptionsFromConfig gets the options for new signatures, anything not specified stays as default.
+func signatureOptionsFromConfig(config configutils.Config) (signatures.SignatureOptions, error) {
+	opts := signatures.SignatureOptions{BlockSize: config.BlockSize, MinBlockSize: config.MinBlockSize, MaxBlockSize: config.MaxBlockSize}
+	if config.StrongHash != "" {
+		alg, err := signatures.ParseStrongAlgorithm(config.StrongHash)
 		if err != nil {
-			log.Fatal( err )
+			return opts, err
 		}
-		configPath := fmt.Sprintf("%s/.blobsync/config.json", usr.HomeDir)
-		configFile, err = os.Open(configPath)
+		opts.StrongAlgorithm = alg
+	}
+	if config.RollingHash != "" {
+		alg, err := signatures.ParseRollingAlgorithm(config.RollingHash)
 		if err != nil {
-			log.Fatal( err )
+			return opts, err
 		}
+		opts.RollingAlgorithm = alg
 	}
-	defer configFile.Close()
-
-	config := signatures.Config{}
-	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&config)
+	if config.Chunking != "" {
+		chunking, err := signatures.ParseChunking(config.Chunking)
+		if err != nil {
+			return opts, err
+		}
+		opts.Chunking = chunking
+	}
+	return opts, nil
+}
 
-	return config
+// searchOptionsFromConfig is the default search options, with whatever config sets.
+func searchOptionsFromConfig(config configutils.Config) blobsync.SearchOptions {
+	opts := blobsync.DefaultSearchOptions()
+	if config.MinMatchSize != 0 {
+		opts.MinMatchSize = config.MinMatchSize
+		if opts.MinMatchSize < 0 {
+			opts.MinMatchSize = 0
+		}
+	}
+	if config.MinRangeSize != 0 {
+		opts.MinRangeSize = config.MinRangeSize
+		if opts.MinRangeSize < 0 {
+			opts.MinRangeSize = 0
+		}
+	}
+	opts.MaxSmallBlockMatches = config.MaxSmallBlockMatches
+	if config.NoExactSizeMatches {
+		opts.ExactSizeMatches = false
+	}
+	return opts
 }
 
+// createBackend picks the storage backend (and credentials) based on what is set in config.
+func createBackend(config configutils.Config) (blobsync.Backend, error) {
+	if config.S3Endpoint != "" {
+		return s3utils.NewS3Handler(config.S3Endpoint, config.S3Region, config.S3AccessKey, config.S3SecretKey, config.S3PathStyle)
+	}
+
+	if config.LocalRoot != "" {
+		localHandler := localutils.NewLocalHandler(config.LocalRoot)
+		return &localHandler, nil
+	}
+
+	var blobHandler azureutils.BlobHandler
+	var err error
+	switch {
+	case config.ConnectionString != "":
+		blobHandler, err = azureutils.NewBlobHandlerFromConnectionString(config.ConnectionString)
+	case config.SASURL != "":
+		sasURLs := []string{config.SASURL}
+		if config.SignatureSASURL != "" {
+			sasURLs = append(sasURLs, config.SignatureSASURL)
+		}
+		blobHandler, err = azureutils.NewBlobHandlerFromSASURLs(sasURLs...)
+	case config.ClientSecret != "":
+		provider := azureutils.NewClientCredentialsProvider(config.AuthorityHost, config.TenantID, config.ClientID, config.ClientSecret)
+		blobHandler, err = azureutils.NewBlobHandlerWithToken(config.AccountName, provider, endpointFromConfig(config))
+	case config.UseManagedIdentity:
+		provider := azureutils.NewManagedIdentityProvider(config.IdentityEndpoint, config.ClientID)
+		blobHandler, err = azureutils.NewBlobHandlerWithToken(config.AccountName, provider, endpointFromConfig(config))
+	case config.SASToken != "":
+		blobHandler, err = azureutils.NewBlobHandlerWithSAS(config.AccountName, config.SASToken, endpointFromConfig(config))
+	default:
+		blobHandler, err = azureutils.NewBlobHandlerWithEndpoint(config.AccountName, config.AccountKey, endpointFromConfig(config))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &blobHandler, nil
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sig" {
+		os.Exit(sigCommand(os.Args[2:]))
+	}
+
 	fmt.Printf("so it begins....\n")
 
 	go func() {
@@ -51,25 +217,166 @@ func main() {
 
 	download := flag.Bool("download", false, "Download blob to local, merging with file indicated")
 	upload := flag.Bool("upload", false, "Upload file specified to blob/container")
+	compact := flag.Bool("compact", false, "Compact blob/container, merging the small blocks left by delta uploads")
 	filePath := flag.String("file", "", "path to file to upload")
 	blobName := flag.String("blob", "", "name of blob")
 	containerName := flag.String("container", "", "name of container")
 	verbose := flag.Bool("verbose", false, "verbose")
+	storageFlags := addStorageFlags(flag.CommandLine)
+	strongHash := flag.String("stronghash", "", "strong hash for new signatures: md5 (default), sha256, blake2b or xxh3")
+	rollingHash := flag.String("rollinghash", "", "rolling checksum for new signatures: sum (default), adler32, rabinkarp or buzhash")
+	chunking := flag.String("chunking", "", "block boundaries for new signatures: fixed (default) or cdc (content defined)")
+	blockSize := flag.Int("blocksize", 0, "block size for new signatures, the average for cdc (default picked per file, see -autominblocksize)")
+	autoMinBlockSize := flag.Int("autominblocksize", 0, "smallest block size picked per file (default 20000)")
+	autoMaxBlockSize := flag.Int("automaxblocksize", 0, "largest block size picked per file (default 100MiB)")
+	sigWorkers := flag.Int("sigworkers", 0, "goroutines hashing blocks for signatures (default one per CPU, 1 for sequential)")
+	searchWorkers := flag.Int("searchworkers", 0, "goroutines searching the local file for existing blocks (default one per CPU, 1 for sequential)")
+	minMatchSize := flag.Int("minmatchsize", 0, "search the local file only for blocks larger than this (default 100, negative for no minimum)")
+	minRangeSize := flag.Int("minrangesize", 0, "search the local file only in byte ranges larger than this (default 1000, negative for no minimum)")
+	maxSmallMatches := flag.Int("maxsmallmatches", 0, "most blocks smaller than the block size to reuse (default no limit)")
+	noExactSize := flag.Bool("noexactsize", false, "dont let blocks at or below -minmatchsize/-minrangesize match byte ranges exactly their size")
+	compactionThreshold := flag.Float64("compactionthreshold", 0, "compact on upload once a blob has this many times the blocks it needs (default 1.5, negative to disable)")
+	staleSig := flag.String("stalesig", "", "when a signature doesnt match its blob: full (transfer the whole blob, default) or regenerate (also fix the signature on download)")
+	minBlockSize := flag.Int("minblocksize", 0, "smallest cdc block (default blocksize/4)")
+	maxBlockSize := flag.Int("maxblocksize", 0, "largest cdc block (default blocksize*4)")
 
 	flag.Parse()
 
-	if *filePath == "" || *blobName == "" || *containerName == "" {
+	if *blobName == "" || *containerName == "" || (*filePath == "" && !(*compact)) {
 		fmt.Printf("Error....\n")
 		return
 	}
 
-	if !(*download) && !(*upload) {
-		fmt.Printf("Need to specify upload or downloads\n")
+	if !(*download) && !(*upload) && !(*compact) {
+		fmt.Printf("Need to specify upload, download or compact\n")
 		return
 	}
 
-	config := readConfig()
-	bs := blobsync.NewBlobSync(config.AccountName, config.AccountKey)
+	config, err := storageFlags.loadConfig()
+	if err != nil {
+		log.Fatalf("Unable to read config %s\n", err.Error())
+	}
+
+	// command line wins over the config file.
+	if *strongHash != "" {
+		config.StrongHash = *strongHash
+	}
+	if *rollingHash != "" {
+		config.RollingHash = *rollingHash
+	}
+	if *chunking != "" {
+		config.Chunking = *chunking
+	}
+	if *blockSize != 0 {
+		config.BlockSize = *blockSize
+	}
+	if *minBlockSize != 0 {
+		config.MinBlockSize = *minBlockSize
+	}
+	if *maxBlockSize != 0 {
+		config.MaxBlockSize = *maxBlockSize
+	}
+	if *autoMinBlockSize != 0 {
+		config.AutoMinBlockSize = *autoMinBlockSize
+	}
+	if *autoMaxBlockSize != 0 {
+		config.AutoMaxBlockSize = *autoMaxBlockSize
+	}
+	if *compactionThreshold != 0 {
+		config.CompactionThreshold = *compactionThreshold
+	}
+	if *sigWorkers != 0 {
+		config.SignatureWorkers = *sigWorkers
+	}
+	if *searchWorkers != 0 {
+		config.SearchWorkers = *searchWorkers
+	}
+	if *staleSig != "" {
+		config.StaleSignature = *staleSig
+	}
+	if *minMatchSize != 0 {
+		config.MinMatchSize = *minMatchSize
+	}
+	if *minRangeSize != 0 {
+		config.MinRangeSize = *minRangeSize
+	}
+	if *maxSmallMatches != 0 {
+		config.MaxSmallBlockMatches = *maxSmallMatches
+	}
+	if *noExactSize {
+		config.NoExactSizeMatches = true
+	}
+
+	backend, err := createBackend(config)
+	if err != nil {
+		log.Fatalf("Unable to create storage backend %s\n", err.Error())
+	}
+	if closer, ok := backend.(io.Closer); ok {
+		defer closer.Close()
+	}
+	bs := blobsync.NewBlobSyncWithBackend(backend)
+
+	sigOptions, err := signatureOptionsFromConfig(config)
+	if err != nil {
+		log.Fatalf("Invalid signature options %s\n", err.Error())
+	}
+	if err := bs.SetSignatureOptions(sigOptions); err != nil {
+		log.Fatalf("Invalid signature options %s\n", err.Error())
+	}
+	if config.AutoMinBlockSize != 0 || config.AutoMaxBlockSize != 0 {
+		minSize, maxSize := signatures.SignatureSize, blobsync.DefaultMaxBlockSize
+		if config.AutoMinBlockSize != 0 {
+			minSize = config.AutoMinBlockSize
+		}
+		if config.AutoMaxBlockSize != 0 {
+			maxSize = config.AutoMaxBlockSize
+		}
+		if err := bs.SetBlockSizeRange(minSize, maxSize); err != nil {
+			log.Fatalf("Invalid block size range %s\n", err.Error())
+		}
+	}
+	if config.CompactionThreshold != 0 {
+		threshold := config.CompactionThreshold
+		if threshold < 0 {
+			threshold = 0
+		}
+		if err := bs.SetCompactionThreshold(threshold); err != nil {
+			log.Fatalf("Invalid compaction threshold %s\n", err.Error())
+		}
+	}
+	if config.SignatureWorkers != 0 {
+		if err := bs.SetSignatureWorkers(config.SignatureWorkers); err != nil {
+			log.Fatalf("Invalid signature workers %s\n", err.Error())
+		}
+	}
+
+	if config.SearchWorkers != 0 {
+		if err := bs.SetSearchWorkers(config.SearchWorkers); err != nil {
+			log.Fatalf("Invalid search workers %s\n", err.Error())
+		}
+	}
+
+	if err := bs.SetSearchOptions(searchOptionsFromConfig(config)); err != nil {
+		log.Fatalf("Invalid search options %s\n", err.Error())
+	}
+
+	stalePolicy, err := blobsync.ParseStaleSignaturePolicy(config.StaleSignature)
+	if err != nil {
+		log.Fatalf("Invalid stale signature policy %s\n", err.Error())
+	}
+	if err := bs.SetStaleSignaturePolicy(stalePolicy); err != nil {
+		log.Fatalf("Invalid stale signature policy %s\n", err.Error())
+	}
+
+	// cancel the sync on ctrl-c/SIGTERM, so staged blocks are left uncommitted instead of half a blob.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
 
 	if *upload {
 		f, err := os.Open(*filePath)
@@ -77,12 +384,22 @@ func main() {
 			log.Fatalf("Unable to open file %s\n", err.Error())
 		}
 
-		bs.Upload(f, *containerName, *blobName, *verbose)
+		err = bs.UploadContext(ctx, f, *containerName, *blobName, *verbose)
+		if err != nil {
+			fmt.Printf("ERROR while uploading : %s\n", err.Error())
+		}
+	}
+
+	if *compact {
+		err := bs.CompactContext(ctx, *containerName, *blobName)
+		if err != nil {
+			fmt.Printf("ERROR while compacting : %s\n", err.Error())
+		}
 	}
 
 	if *download {
 
-		err := bs.Download(*filePath, *containerName, *blobName, *verbose)
+		err := bs.DownloadContext(ctx, *filePath, *containerName, *blobName, *verbose)
 		if err != nil {
 			fmt.Printf("ERROR while downloading : %s\n", err.Error())
 		}
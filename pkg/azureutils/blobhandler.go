@@ -3,294 +3,193 @@ package azureutils
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
-	"github.com/edsrzf/mmap-go"
 	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
-	"sort"
-	"strings"
-	"time"
+	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"io"
-	"log"
-	"net/url"
 	"os"
 )
 
-type UploadMessage struct {
-	Offset int64
-	BytesRead int
-	Data []byte
-}
-
 type BlobHandler struct {
 	accountName string
 	accountKey string
 	blobPipeline pipeline.Pipeline
+	endpoint Endpoint
+
+	// SAS token used instead of the account key (if set). blobSASTokens
+	// holds blob scoped tokens, keyed by container/blob.
+	sasToken string
+	blobSASTokens map[string]string
+
+	// createContainers is set if the credential is allowed to create containers. createdContainers
+	// holds the containers we have already tried to create, so it is only done on the first write.
+	createContainers bool
+	createdContainers *sync.Map
 
 	TotalBytesUploaded int64
 	TotalBytesDownloaded int64
 }
 
-func NewBlobHandler(accountName string, accountKey string ) BlobHandler {
+func NewBlobHandler(accountName string, accountKey string ) (BlobHandler, error) {
+	return NewBlobHandlerWithEndpoint(accountName, accountKey, DefaultEndpoint())
+}
+
+// NewBlobHandlerWithEndpoint creates a BlobHandler talking to a non-default blob service,
+// eg. Azurite or a sovereign cloud.
+func NewBlobHandlerWithEndpoint(accountName string, accountKey string, endpoint Endpoint) (BlobHandler, error) {
 	bh := BlobHandler{}
 	bh.accountName = accountName
 	bh.accountKey = accountKey
-	bh.blobPipeline = createBlobClientPipeline(accountName, accountKey)
+	bh.endpoint = endpoint
+	bh.blobSASTokens = make(map[string]string)
+	bh.createContainers = true
+	bh.createdContainers = &sync.Map{}
+
+	p, err := createBlobClientPipeline(accountName, accountKey)
+	if err != nil {
+		return BlobHandler{}, err
+	}
+	bh.blobPipeline = p
 	bh.TotalBytesUploaded = 0
 	bh.TotalBytesDownloaded = 0
-	return bh
+	return bh, nil
 }
 
-func createBlobClientPipeline(accountName string, accountKey string)  pipeline.Pipeline {
+func createBlobClientPipeline(accountName string, accountKey string)  (pipeline.Pipeline, error) {
 	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
-	
 	if err != nil {
-		log.Fatal("Invalid credentials with error: " + err.Error())
+		return nil, fmt.Errorf("invalid credentials with error: %s", err.Error())
 	}
 	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	return p
-}
-
-
-func (bh BlobHandler) CreateContainerURL( containerName string ) (*azblob.ContainerURL, error) {
-	URL, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", bh.accountName, containerName))
-	containerURL := azblob.NewContainerURL(*URL, bh.blobPipeline)
-	ctx := context.Background() // This example uses a never-expiring context
-	_, err := containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
-
-  if err != nil {
-  	//fmt.Printf("trying to create container that already exists (possibly) : %s\n", err.Error())
-  	//return nil, err
-  }
-
-  return &containerURL, nil
+	return p, nil
 }
 
-func checkIfDupe(uploadedBlockList []signatures.UploadedBlock, blockID string ) bool {
-  for _,ub := range uploadedBlockList {
-    if ub.BlockID == blockID {
-    	return true
-    }
-  }
-  return false
-}
 
+// wrapError classifies errors from the storage service as one of the signatures.Err* kinds.
+// Anything that isn't a response from the service (and isn't us cancelling) is a transport problem.
+func wrapError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
 
-func (bh BlobHandler) PutBlockList( uploadedBlockList []signatures.UploadedBlock, containerName string, blobName string ) error {
-	containerURL,_ := bh.CreateContainerURL(containerName)
-	blobURL := containerURL.NewBlockBlobURL(blobName)
+	stgErr, ok := err.(azblob.StorageError)
+	if !ok {
+		return signatures.NewError(signatures.ErrTransient, err)
+	}
 
-	blockIDs := []string{}
-	for _,b := range uploadedBlockList {
-		blockIDs = append(blockIDs, b.BlockID)
+	switch status := stgErr.Response().StatusCode; {
+	case status == http.StatusNotFound:
+		return signatures.NewError(signatures.ErrBlobNotFound, err)
+	case status == http.StatusPreconditionFailed:
+		return signatures.NewError(signatures.ErrPreconditionFailed, err)
+	case status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests:
+		return signatures.NewError(signatures.ErrTransient, err)
 	}
-	ctx := context.Background() // This example uses a never-expiring context
-	_, err := blobURL.CommitBlockList(ctx, blockIDs,azblob.BlobHTTPHeaders{}, nil, azblob.BlobAccessConditions{} )
 	return err
-
 }
 
-// WriteBytes, returns an UploadedBlock struct, giving a summary
-func (bh *BlobHandler) WriteBytesWithChannel( dataCh chan UploadMessage, uploadedBlockCh chan signatures.UploadedBlock, blobURL *azblob.BlockBlobURL) error {
-
-	for data := range dataCh {
-		if data.BytesRead == 0 {
-			fmt.Printf("no bytes!!!\n")
-		}
-		sig, err := signatures.GenerateBlockSig(data.Data, data.Offset, data.BytesRead, 0)
-		if err != nil {
-			log.Fatalf("Unable to generate block sig %s\n", err.Error())
-		}
-
-		blockID := base64.StdEncoding.EncodeToString(sig.MD5Signature[:])
-		newBlock := signatures.UploadedBlock{
-			BlockID:     blockID,
-			Offset:      data.Offset,
-			Sig:         *sig,
-			Size:        int64(data.BytesRead),
-			IsNew:       true,
-			IsDuplicate: false}
-
-		// not a dupe, upload it.
-		ctx := context.Background() // This example uses a never-expiring context
-		_, err = blobURL.StageBlock(ctx, blockID, bytes.NewReader(data.Data), azblob.LeaseAccessConditions{}, nil)
-		if err != nil {
-			log.Fatalf("Unable to stage block: %s\n", err.Error())
-		}
-		fmt.Printf("uploaded offset %d\n", data.Offset)
-		bh.TotalBytesUploaded += int64(data.BytesRead)
-		uploadedBlockCh <- newBlock
+func (bh BlobHandler) CreateContainerURL(ctx context.Context, containerName string ) (*azblob.ContainerURL, error) {
+	URL, err := bh.endpoint.ContainerURL(bh.accountName, containerName)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	URL.RawQuery = bh.sasToken
+	containerURL := azblob.NewContainerURL(*URL, bh.blobPipeline)
+	return &containerURL, nil
 }
 
+// ensureContainer creates the container the first time we write to it, if the credential is allowed to.
+// Once the service has answered (created, already exists or refused) we dont ask again, if it was refused
+// the write itself will say why.
+func (bh BlobHandler) ensureContainer(ctx context.Context, containerName string) error {
+	if !bh.createContainers || bh.createdContainers == nil {
+		return nil
+	}
+	if _, ok := bh.createdContainers.Load(containerName); ok {
+		return nil
+	}
 
-// WriteBytes, returns an UploadedBlock struct, giving a summary
-func (bh BlobHandler) WriteBytes( offset int64, bytesRead int, data []byte, blobURL *azblob.BlockBlobURL, uploadedBlockList []signatures.UploadedBlock) (*signatures.UploadedBlock, error ) {
+	containerURL, err := bh.CreateContainerURL(ctx, containerName)
+	if err != nil {
+		return err
+	}
+	_, err = containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
+	if _, ok := err.(azblob.StorageError); ok || err == nil {
+		bh.createdContainers.Store(containerName, true)
+		return nil
+	}
+	return wrapError(ctx, err)
+}
 
-	sig,err := signatures.GenerateBlockSig(data, offset, bytesRead, 0 )
+// createBlockBlobURL returns the URL for the blob, using the blob scoped SAS token if we have one.
+func (bh BlobHandler) createBlockBlobURL(ctx context.Context, containerName string, blobName string) (*azblob.BlockBlobURL, error) {
+	containerURL, err := bh.CreateContainerURL(ctx, containerName)
 	if err != nil {
 		return nil, err
 	}
+	blobURL := containerURL.NewBlockBlobURL(blobName)
 
-	blockID := base64.StdEncoding.EncodeToString(sig.MD5Signature[:])
-
-	isDupe := checkIfDupe(uploadedBlockList, blockID)
-
-	newBlock := signatures.UploadedBlock{
-		BlockID: blockID,
-		Offset: offset,
-		Sig : *sig,
-		Size : int64(bytesRead),
-		IsNew: true,
-		IsDuplicate : isDupe}
-
-	// not a dupe, upload it.
-	if !isDupe {
-		ctx := context.Background() // This example uses a never-expiring context
-		_, err = blobURL.StageBlock(ctx, blockID, bytes.NewReader(data), azblob.LeaseAccessConditions{}, nil )
-		if err != nil {
-			return nil, err
-		}
+	if sasToken, ok := bh.blobSASTokens[containerName+"/"+blobName]; ok {
+		URL := blobURL.URL()
+		URL.RawQuery = sasToken
+		blobURL = azblob.NewBlockBlobURL(URL, bh.blobPipeline)
 	}
-
-	return &newBlock, nil
+	return &blobURL, nil
 }
 
-func (bh BlobHandler) UploadBlob(localFile *os.File,
-																 containerName string, blobName string, verbose bool ) error  {
-
-	stats, _ := localFile.Stat()
-	remainingBytes := signatures.RemainingBytes{BeginOffset: 0, EndOffset: stats.Size() - 1}
-
-	uploadBlockList, err := bh.UploadRemainingBytesAsBlocks(remainingBytes, localFile, containerName, blobName, verbose)
+func (bh BlobHandler) PutBlockList(ctx context.Context, uploadedBlockList []signatures.UploadedBlock, containerName string, blobName string ) error {
+	if err := bh.ensureContainer(ctx, containerName); err != nil {
+		return err
+	}
+	blobURL, err := bh.createBlockBlobURL(ctx, containerName, blobName)
 	if err != nil {
 		return err
 	}
 
-	sort.Slice(uploadBlockList, func (i int, j int) bool {
-		return uploadBlockList[i].Offset < uploadBlockList[j].Offset
-	})
+	blockIDs := []string{}
+	for _,b := range uploadedBlockList {
+		blockIDs = append(blockIDs, b.BlockID)
+	}
+	_, err = blobURL.CommitBlockList(ctx, blockIDs,azblob.BlobHTTPHeaders{}, nil, azblob.BlobAccessConditions{} )
+	return wrapError(ctx, err)
 
-	err = bh.PutBlockList(uploadBlockList, containerName, blobName)
-	return err
 }
 
-func (bh BlobHandler) launchConcurrentUploader(dataCh chan UploadMessage, uploadedBlockCh chan signatures.UploadedBlock, blobURL *azblob.BlockBlobURL) {
-
-	maxUploaders := 100
-	for i:=0; i<maxUploaders;i++ {
-		go bh.WriteBytesWithChannel(dataCh, uploadedBlockCh, blobURL)
+// StageBlock uploads a single uncommitted block for the blob.
+func (bh *BlobHandler) StageBlock(ctx context.Context, containerName string, blobName string, blockID string, data []byte) error {
+	if err := bh.ensureContainer(ctx, containerName); err != nil {
+		return err
 	}
-}
-
-// UploadBlobAsBlocks. Using os.File instead of a reader since want to use the UploadFileToBlockBlob
-// instead of stream (which uses reader).
-// Upload remaining bytes as blocks. If need be, break remainingBytes into blocks that are default SignatureSize in length.
-// Only uploading sequentially for the moment
-/// Will optimise with a parallel version later.
-func (bh BlobHandler) UploadRemainingBytesAsBlocks( remainingBytes signatures.RemainingBytes, localFile *os.File,
-																										containerName string, blobName string, verbose bool ) ([]signatures.UploadedBlock, error ){
-
-  containerURL,_ := bh.CreateContainerURL(containerName)
-	blobURL := containerURL.NewBlockBlobURL(blobName)
-	uploadedBlockList := []signatures.UploadedBlock{}
-
-	mm,err  := mmap.Map(localFile, mmap.RDONLY, 0)
+	blobURL, err := bh.createBlockBlobURL(ctx, containerName, blobName)
 	if err != nil {
-		log.Fatalf("Unable to mmap the file: %s\n", err.Error())
+		return err
 	}
-	defer mm.Unmap()
-
-	// loop and write in blocks.
-	offset := remainingBytes.BeginOffset
-  total := 0
-  dataCh := make(chan UploadMessage,100)
 
-  // stupid large channel until I sort this shit out.
-	uploadedBlockCh := make(chan signatures.UploadedBlock,100000)
-
-	concurrentUpload := true
-	// check if blobname ends in sig. Only parallel upload for non-sigs TODO(kpfaulkner) search out the bug.
-	if strings.Contains(blobName, ".sig") {
-		concurrentUpload = false
+	_, err = blobURL.StageBlock(ctx, blockID, bytes.NewReader(data), azblob.LeaseAccessConditions{}, nil)
+	if err != nil {
+		return wrapError(ctx, err)
 	}
 
-	if concurrentUpload {
-		bh.launchConcurrentUploader(dataCh, uploadedBlockCh, &blobURL)
-	}
+	atomic.AddInt64(&bh.TotalBytesUploaded, int64(len(data)))
+	return nil
+}
 
-	// make out of loop
-	//bytesToRead := make([]byte, signatures.SignatureSize)
-
-	for offset <= remainingBytes.EndOffset {
-
-		var sizeToRead int64
-		if remainingBytes.EndOffset - offset +1 > int64(signatures.SignatureSize) {
-			sizeToRead = int64(signatures.SignatureSize)
-		} else {
-			sizeToRead = remainingBytes.EndOffset - offset +1
-			//bytesToRead = make([]byte, sizeToRead)
-		}
-
-		if sizeToRead > 0 {
-
-			//buffer, _ := PopulateBuffer(&mm,offset, sizeToRead, remainingBytes.EndOffset)
-			buffer := mm[offset:offset + sizeToRead]
-      bytesRead := len(buffer)
-			if bytesRead == 0 {
-				break // ??? good idea?
-			}
-
-			if concurrentUpload {
-				msg := UploadMessage{Data: buffer, Offset: offset, BytesRead: bytesRead}
-				dataCh <- msg
-			} else {
-				uploadedBlock, err := bh.WriteBytes(offset, bytesRead, buffer, &blobURL, uploadedBlockList)
-				if err != nil {
-					return nil, err
-				}
-				total += int(bytesRead)
-				if verbose {
-					fmt.Printf("Uploaded %d : total %d\n", bytesRead, total)
-				}
-				uploadedBlockList = append(uploadedBlockList, *uploadedBlock)
-			}
-
-			offset += sizeToRead
-		}
+func (bh BlobHandler) UploadBlobFromReader(ctx context.Context, reader io.Reader, containerName string, blobName string ) error {
+	if err := bh.ensureContainer(ctx, containerName); err != nil {
+		return err
 	}
-	close(dataCh)
-
-	if concurrentUpload {
-		done := false
-		for !done {
-
-			select {
-			  case uploadedBlock := <- uploadedBlockCh:
-				  uploadedBlockList = append(uploadedBlockList, uploadedBlock)
-				  case <- time.After(5 * time.Second):
-				  	done = true
-			}
-		}
+	blobURL, err := bh.createBlockBlobURL(ctx, containerName, blobName)
+	if err != nil {
+		return err
 	}
-
-  return uploadedBlockList, nil
-}
-
-func (bh BlobHandler) UploadBlobFromReader( reader io.Reader, containerName string, blobName string ) error {
-
-	containerURL,_ := bh.CreateContainerURL(containerName)
-	blobURL := containerURL.NewBlockBlobURL(blobName)
-	ctx := context.Background() // This example uses a never-expiring context
-
 	// dont use for big files... unsure about concurrency here.
-	_, err := azblob.UploadStreamToBlockBlob(ctx, reader, blobURL, azblob.UploadStreamToBlockBlobOptions{ BufferSize: 100000})
-	return err
+	_, err = azblob.UploadStreamToBlockBlob(ctx, reader, *blobURL, azblob.UploadStreamToBlockBlobOptions{ BufferSize: 100000})
+	return wrapError(ctx, err)
 }
 
 /*
@@ -306,56 +205,68 @@ func (bh BlobHandler) SetBlobAttribute(containerName string, blobName string ) e
 	return err
 }  */
 
+// GetBlobProperties returns the size and ETag of the blob.
+func (bh BlobHandler) GetBlobProperties(ctx context.Context, containerName string, blobName string) (*signatures.BlobProperties, error) {
+	blobURL, err := bh.createBlockBlobURL(ctx, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
 
-func (bh BlobHandler) BlobExist( containerName string, blobName string) bool {
-	containerURL,_ := bh.CreateContainerURL(containerName)
-	blobURL := containerURL.NewBlobURL(blobName)
-
-	ctx := context.Background() // This example uses a never-expiring context
-	_, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return nil, wrapError(ctx, err)
+	}
+	return &signatures.BlobProperties{Size: props.ContentLength(), ETag: string(props.ETag()), LastModified: props.LastModified()}, nil
+}
 
+// BlobExist is true only if the blob's properties come back. Anything else, not found, forbidden or
+// not getting an answer at all, is false since we cant use the blob.
+func (bh BlobHandler) BlobExist(ctx context.Context, containerName string, blobName string) bool {
+	blobURL, err := bh.createBlockBlobURL(ctx, containerName, blobName)
 	if err != nil {
-		azErr := err.(azblob.StorageError)
-		return azErr.Response().StatusCode != 404
+		return false
 	}
 
-  return true
+	_, err = blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	return err == nil
 }
 
 
-func (bh BlobHandler) DownloadBlob( file *os.File, containerName string, blobName string) error {
-	containerURL,_ := bh.CreateContainerURL(containerName)
-	blobURL := containerURL.NewBlobURL(blobName)
-	ctx := context.Background() // This example uses a never-expiring context
-	err := azblob.DownloadBlobToFile(ctx, blobURL, 0, azblob.CountToEnd, file, azblob.DownloadFromBlobOptions{})
-	return err
+func (bh BlobHandler) DownloadBlob(ctx context.Context, file *os.File, containerName string, blobName string) error {
+	blobURL, err := bh.createBlockBlobURL(ctx, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	err = azblob.DownloadBlobToFile(ctx, blobURL.BlobURL, 0, azblob.CountToEnd, file, azblob.DownloadFromBlobOptions{})
+	return wrapError(ctx, err)
 }
 
-func (bh BlobHandler) DownloadBlobToBuffer( buffer *bytes.Buffer, containerName string, blobName string) error {
-	return bh.DownloadBlobRange(buffer, containerName, blobName, 0, azblob.CountToEnd)
+func (bh BlobHandler) DownloadBlobToBuffer(ctx context.Context, buffer *bytes.Buffer, containerName string, blobName string) error {
+	return bh.DownloadBlobRange(ctx, buffer, containerName, blobName, 0, -1)
 }
 
 // DownloadBlobRange downloads a subsection of a blob.
-func (bh *BlobHandler) DownloadBlobRange(  buffer *bytes.Buffer, containerName string, blobName string, beginOffset int64, endOffset int64) error {
-	containerURL,_ := bh.CreateContainerURL(containerName)
-	blobURL := containerURL.NewBlobURL(blobName)
-
-	ctx := context.Background() // This example uses a never-expiring context
+// endOffset is inclusive, a negative endOffset reads to the end of the blob.
+func (bh *BlobHandler) DownloadBlobRange(ctx context.Context, buffer *bytes.Buffer, containerName string, blobName string, beginOffset int64, endOffset int64) error {
+	blobURL, err := bh.createBlockBlobURL(ctx, containerName, blobName)
+	if err != nil {
+		return err
+	}
 
 	count := int64(0)
 
 	// only recalculate count if NOT reading to end of file.
-	if endOffset != azblob.CountToEnd {
+	if endOffset >= 0 {
 		count = endOffset - beginOffset +1
 	}
 
 	downloadResponse, err := blobURL.Download(ctx, beginOffset, count, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return wrapError(ctx, err)
+	}
 	bodyStream := downloadResponse.Body(azblob.RetryReaderOptions{MaxRetryRequests: 20})
-	_, err = buffer.ReadFrom(bodyStream)
-
-	bh.TotalBytesDownloaded += count
-	fmt.Printf("downloaded %d, total of %d\n", count, bh.TotalBytesDownloaded)
-
-	return err
+	n, err := buffer.ReadFrom(bodyStream)
+	atomic.AddInt64(&bh.TotalBytesDownloaded, n)
+	return wrapError(ctx, err)
 }
 
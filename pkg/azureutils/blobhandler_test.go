@@ -0,0 +1,163 @@
+package azureutils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// fakeBlobService answers just enough of the blob API for the handler: creating containers (201 then
+// 409), staging and committing blocks, and getting properties with whatever status blobStatus holds.
+type fakeBlobService struct {
+	lock       sync.Mutex
+	requests   []string
+	containers map[string]bool
+	blobStatus int
+}
+
+func newFakeBlobService(t *testing.T) (*fakeBlobService, Endpoint, func()) {
+	fs := &fakeBlobService{containers: make(map[string]bool), blobStatus: http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(fs.serve))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, Endpoint{Scheme: "http", Host: u.Host, PathStyle: true}, server.Close
+}
+
+func (fs *fakeBlobService) serve(w http.ResponseWriter, r *http.Request) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	q := r.URL.Query()
+	op := r.Method + " " + q.Get("restype") + q.Get("comp")
+	fs.requests = append(fs.requests, op)
+	switch op {
+	case "PUT container":
+		if fs.containers[r.URL.Path] {
+			w.Header().Set("x-ms-error-code", "ContainerAlreadyExists")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		fs.containers[r.URL.Path] = true
+		w.WriteHeader(http.StatusCreated)
+	case "PUT block", "PUT blocklist":
+		w.WriteHeader(http.StatusCreated)
+	case "HEAD ":
+		w.WriteHeader(fs.blobStatus)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// count returns how many op requests were made.
+func (fs *fakeBlobService) count(op string) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n := 0
+	for _, req := range fs.requests {
+		if req == op {
+			n++
+		}
+	}
+	return n
+}
+
+func TestContainerCreatedOnceOnWrite(t *testing.T) {
+	fs, endpoint, cleanup := newFakeBlobService(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	bh, err := NewBlobHandlerWithEndpoint(devStoreAccountName, devStoreAccountKey, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads dont create anything.
+	if !bh.BlobExist(ctx, "cont", "blob") {
+		t.Error("blob doesnt exist")
+	}
+	if _, err := bh.GetBlobProperties(ctx, "cont", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.count("PUT container"); n != 0 {
+		t.Errorf("container created %d times by reads", n)
+	}
+
+	for _, blockID := range []string{"YQ==", "Yg==", "Yw=="} {
+		if err := bh.StageBlock(ctx, "cont", "blob", blockID, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bh.PutBlockList(ctx, nil, "cont", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.count("PUT container"); n != 1 {
+		t.Errorf("container created %d times, want once", n)
+	}
+
+	// a container that already exists is fine, and not asked about again.
+	other, err := NewBlobHandlerWithEndpoint(devStoreAccountName, devStoreAccountKey, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := other.StageBlock(ctx, "cont", "blob", "YQ==", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fs.count("PUT container"); n != 2 {
+		t.Errorf("container created %d times, want twice", n)
+	}
+}
+
+func TestContainerNotCreatedWithoutPermission(t *testing.T) {
+	fs, endpoint, cleanup := newFakeBlobService(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	tokens := []struct {
+		sasToken string
+		creates  bool
+	}{
+		{"sv=2020-08-04&sr=c&sp=rwl&sig=c", false},
+		{"sv=2020-08-04&sr=b&sp=rw&sig=b", false},
+		{"sv=2020-08-04&ss=b&srt=o&sp=rwl&sig=a", false},
+		{"sv=2020-08-04&ss=b&srt=sco&sp=rl&sig=a", false},
+		{"sv=2020-08-04&ss=b&srt=sco&sp=rwl&sig=a", true},
+	}
+	for _, tt := range tokens {
+		before := fs.count("PUT container")
+		bh, err := NewBlobHandlerWithSAS(devStoreAccountName, tt.sasToken, endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bh.StageBlock(ctx, "cont"+tt.sasToken, "blob", "YQ==", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if created := fs.count("PUT container") > before; created != tt.creates {
+			t.Errorf("SAS %s: created container %v, want %v", tt.sasToken, created, tt.creates)
+		}
+	}
+}
+
+func TestBlobExistOnlyFor200(t *testing.T) {
+	fs, endpoint, cleanup := newFakeBlobService(t)
+	defer cleanup()
+
+	bh, err := NewBlobHandlerWithEndpoint(devStoreAccountName, devStoreAccountKey, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusForbidden, http.StatusConflict} {
+		fs.lock.Lock()
+		fs.blobStatus = status
+		fs.lock.Unlock()
+		if got := bh.BlobExist(context.Background(), "cont", "blob"); got != (status == http.StatusOK) {
+			t.Errorf("status %d: BlobExist is %v", status, got)
+		}
+	}
+}
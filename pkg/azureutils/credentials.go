@@ -0,0 +1,231 @@
+package azureutils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+
+	// well known Azurite/storage emulator account, used for UseDevelopmentStorage=true
+	devStoreAccountName = "devstoreaccount1"
+	devStoreAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	devStoreBlobHost    = "127.0.0.1:10000"
+)
+
+// NewBlobHandlerWithSAS creates a BlobHandler authenticating with a SAS token instead of the account key.
+// The token should be container scoped (or account scoped) since both the blob and its .sig are accessed.
+func NewBlobHandlerWithSAS(accountName string, sasToken string, endpoint Endpoint) (BlobHandler, error) {
+	sasToken = strings.TrimPrefix(sasToken, "?")
+	if _, err := url.ParseQuery(sasToken); err != nil || sasToken == "" {
+		return BlobHandler{}, errors.New("invalid SAS token")
+	}
+
+	bh := newSASBlobHandler(accountName, endpoint)
+	bh.sasToken = sasToken
+	bh.createContainers = sasCanCreateContainers(sasToken)
+	return bh, nil
+}
+
+// newSASBlobHandler creates a BlobHandler for SAS tokens, with none set yet.
+func newSASBlobHandler(accountName string, endpoint Endpoint) BlobHandler {
+	bh := BlobHandler{}
+	bh.accountName = accountName
+	bh.endpoint = endpoint
+	bh.blobSASTokens = make(map[string]string)
+	bh.createdContainers = &sync.Map{}
+	bh.blobPipeline = azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{})
+	return bh
+}
+
+// NewBlobHandlerFromSASURLs creates a BlobHandler from one or more SAS URLs.
+// A container (sr=c) or account SAS URL covers everything. Blob scoped SAS URLs only grant access to
+// that specific blob, so without a container wide one pass one for the blob and one for its .sig, eg.
+// https://acc.blob.core.windows.net/cont/data.bin?sv=... and https://acc.blob.core.windows.net/cont/data.bin.sig?sv=...
+func NewBlobHandlerFromSASURLs(sasURLs ...string) (BlobHandler, error) {
+	if len(sasURLs) == 0 {
+		return BlobHandler{}, errors.New("no SAS URL provided")
+	}
+
+	var bh BlobHandler
+	for i, sasURL := range sasURLs {
+		accountName, endpoint, containerName, blobName, sasToken, err := parseSASURL(sasURL)
+		if err != nil {
+			return BlobHandler{}, err
+		}
+		containerWide, err := sasIsContainerWide(sasToken)
+		if err != nil {
+			return BlobHandler{}, err
+		}
+
+		if i == 0 {
+			bh = newSASBlobHandler(accountName, endpoint)
+		} else if accountName != bh.accountName {
+			return BlobHandler{}, fmt.Errorf("SAS URL %s is for a different account", sasURL)
+		}
+
+		// blob scoped tokens only apply to their own blob.
+		if containerWide {
+			bh.sasToken = sasToken
+			bh.createContainers = sasCanCreateContainers(sasToken)
+		} else if blobName != "" {
+			bh.blobSASTokens[containerName+"/"+blobName] = sasToken
+		} else {
+			return BlobHandler{}, fmt.Errorf("SAS URL %s is blob scoped but has no blob", sasURL)
+		}
+	}
+
+	// without a container wide token every blob needs its .sig as well.
+	if bh.sasToken == "" {
+		for blob := range bh.blobSASTokens {
+			if strings.HasSuffix(blob, ".sig") {
+				continue
+			}
+			if _, ok := bh.blobSASTokens[blob+".sig"]; !ok {
+				return BlobHandler{}, fmt.Errorf("blob scoped SAS URL for %s needs a SAS URL for %s.sig too (SignatureSASURL)", blob, blob)
+			}
+		}
+	}
+
+	return bh, nil
+}
+
+// sasIsContainerWide is true for container and account SAS tokens, which cover every blob in the
+// container. Blob (and directory) SAS tokens only cover what they were made for.
+func sasIsContainerWide(sasToken string) (bool, error) {
+	query, err := url.ParseQuery(sasToken)
+	if err != nil {
+		return false, errors.New("invalid SAS token")
+	}
+
+	// account SAS tokens have signed resource types instead of a signed resource.
+	if query.Get("srt") != "" {
+		return true, nil
+	}
+	return query.Get("sr") == "c", nil
+}
+
+// sasCanCreateContainers is true for account SAS tokens that cover containers and can create or write.
+// Container and blob SAS tokens can never create the container they are for.
+func sasCanCreateContainers(sasToken string) bool {
+	query, err := url.ParseQuery(sasToken)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(query.Get("srt"), "c") && strings.ContainsAny(query.Get("sp"), "cw")
+}
+
+// parseSASURL splits a SAS URL into the account, endpoint, container, blob and the token itself.
+// Both https://<account>.blob.<suffix>/<container>/<blob> and path style (emulator)
+// http://<host>/<account>/<container>/<blob> URLs are accepted.
+func parseSASURL(sasURL string) (accountName string, endpoint Endpoint, containerName string, blobName string, sasToken string, err error) {
+	u, err := url.Parse(sasURL)
+	if err != nil {
+		return "", Endpoint{}, "", "", "", err
+	}
+	if u.RawQuery == "" {
+		return "", Endpoint{}, "", "", "", errors.New("SAS URL has no token")
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	endpoint = Endpoint{Scheme: u.Scheme}
+	if hostParts := strings.SplitN(u.Hostname(), ".blob.", 2); len(hostParts) == 2 && u.Port() == "" {
+		accountName = hostParts[0]
+		endpoint.Suffix = hostParts[1]
+	} else {
+		endpoint.Host = u.Host
+		endpoint.PathStyle = true
+		accountAndPath := strings.SplitN(path, "/", 2)
+		accountName = accountAndPath[0]
+		path = ""
+		if len(accountAndPath) > 1 {
+			path = accountAndPath[1]
+		}
+	}
+
+	// blob names can contain slashes, only the first segment is the container.
+	pathParts := strings.SplitN(path, "/", 2)
+
+	if accountName == "" {
+		return "", Endpoint{}, "", "", "", fmt.Errorf("cannot determine account from SAS URL %s", u.Host)
+	}
+	if len(pathParts) > 0 {
+		containerName = pathParts[0]
+	}
+	if len(pathParts) > 1 {
+		blobName = pathParts[1]
+	}
+
+	return accountName, endpoint, containerName, blobName, u.RawQuery, nil
+}
+
+// NewBlobHandlerFromConnectionString creates a BlobHandler from a standard Azure storage connection string.
+// Supports account key and SharedAccessSignature based strings, EndpointSuffix, BlobEndpoint and
+// UseDevelopmentStorage=true (Azurite).
+func NewBlobHandlerFromConnectionString(connectionString string) (BlobHandler, error) {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(connectionString, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return BlobHandler{}, fmt.Errorf("invalid connection string setting %s", kv[0])
+		}
+		settings[strings.ToLower(kv[0])] = kv[1]
+	}
+
+	accountName := settings["accountname"]
+	accountKey := settings["accountkey"]
+	endpoint := DefaultEndpoint()
+
+	if strings.EqualFold(settings["usedevelopmentstorage"], "true") {
+		accountName = devStoreAccountName
+		accountKey = devStoreAccountKey
+		endpoint = Endpoint{Scheme: "http", Host: devStoreBlobHost, PathStyle: true}
+	}
+
+	if protocol, ok := settings["defaultendpointsprotocol"]; ok {
+		endpoint.Scheme = protocol
+	}
+	if suffix, ok := settings["endpointsuffix"]; ok {
+		endpoint.Suffix = suffix
+	}
+
+	if blobEndpoint, ok := settings["blobendpoint"]; ok {
+		u, err := url.Parse(blobEndpoint)
+		if err != nil {
+			return BlobHandler{}, err
+		}
+		endpoint = Endpoint{Scheme: u.Scheme, Host: u.Host}
+
+		// path style endpoints have the account name as the path.
+		if path := strings.Trim(u.Path, "/"); path != "" {
+			endpoint.PathStyle = true
+			if accountName == "" {
+				accountName = path
+			}
+		} else if accountName == "" {
+			accountName = strings.SplitN(u.Hostname(), ".", 2)[0]
+		}
+	}
+
+	if accountName == "" {
+		return BlobHandler{}, errors.New("connection string has no account name")
+	}
+
+	if sasToken, ok := settings["sharedaccesssignature"]; ok {
+		return NewBlobHandlerWithSAS(accountName, sasToken, endpoint)
+	}
+
+	if accountKey == "" {
+		return BlobHandler{}, errors.New("connection string has neither AccountKey nor SharedAccessSignature")
+	}
+	return NewBlobHandlerWithEndpoint(accountName, accountKey, endpoint)
+}
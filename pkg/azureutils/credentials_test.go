@@ -0,0 +1,55 @@
+package azureutils
+
+import "testing"
+
+func TestNewBlobHandlerFromSASURLsScopes(t *testing.T) {
+	const base = "https://acc.blob.core.windows.net/cont/"
+	const containerSAS = "sv=2020-08-04&sr=c&sp=rwl&sig=c"
+	const accountSAS = "sv=2020-08-04&ss=b&srt=sco&sp=rwl&sig=a"
+	const blobSAS = "sv=2020-08-04&sr=b&sp=rw&sig=b"
+
+	// a container SAS URL pointing at a blob still covers the whole container.
+	bh, err := NewBlobHandlerFromSASURLs(base + "data.bin?" + containerSAS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bh.sasToken != containerSAS {
+		t.Errorf("container token not used for the container: %q", bh.sasToken)
+	}
+
+	bh, err = NewBlobHandlerFromSASURLs(base + "?" + accountSAS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bh.sasToken != accountSAS {
+		t.Errorf("account token not used for the container: %q", bh.sasToken)
+	}
+
+	// blob scoped tokens never become the container token.
+	bh, err = NewBlobHandlerFromSASURLs(base+"data.bin?"+blobSAS, base+"data.bin.sig?"+blobSAS+"2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bh.sasToken != "" {
+		t.Errorf("blob token used for the container: %q", bh.sasToken)
+	}
+	if bh.blobSASTokens["cont/data.bin"] != blobSAS || bh.blobSASTokens["cont/data.bin.sig"] != blobSAS+"2" {
+		t.Errorf("wrong blob tokens %v", bh.blobSASTokens)
+	}
+
+	if _, err := NewBlobHandlerFromSASURLs(base + "data.bin?" + blobSAS); err == nil {
+		t.Error("blob scoped SAS URL without one for the .sig accepted")
+	}
+	if _, err := NewBlobHandlerFromSASURLs(base + "?" + blobSAS); err == nil {
+		t.Error("blob scoped SAS URL without a blob accepted")
+	}
+
+	// blob scoped tokens are fine alongside a container one.
+	bh, err = NewBlobHandlerFromSASURLs(base+"data.bin?"+blobSAS, base+"?"+containerSAS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bh.sasToken != containerSAS {
+		t.Errorf("container token not used for the container: %q", bh.sasToken)
+	}
+}
@@ -0,0 +1,68 @@
+package azureutils
+
+import (
+	"fmt"
+	"net/url"
+)
+
+const (
+	DefaultScheme         = "https"
+	DefaultEndpointSuffix = "core.windows.net"
+)
+
+// Endpoint describes where the blob service lives.
+// Public Azure is https://<account>.blob.core.windows.net, sovereign clouds just change the
+// Suffix (eg. core.chinacloudapi.cn) and emulators such as Azurite use an explicit Host
+// with the account name as the first path segment (PathStyle).
+type Endpoint struct {
+	Scheme string
+
+	// Host (and optional port) of the blob service. If empty, <account>.blob.<Suffix> is used.
+	Host string
+
+	// Suffix used to build the host when Host is empty.
+	Suffix string
+
+	// PathStyle puts the account in the path, eg. http://127.0.0.1:10000/devstoreaccount1/container
+	PathStyle bool
+}
+
+func DefaultEndpoint() Endpoint {
+	return Endpoint{Scheme: DefaultScheme, Suffix: DefaultEndpointSuffix}
+}
+
+// AccountURL returns the URL of the blob service for accountName.
+func (e Endpoint) AccountURL(accountName string) (*url.URL, error) {
+	scheme := e.Scheme
+	if scheme == "" {
+		scheme = DefaultScheme
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unsupported endpoint scheme %s", scheme)
+	}
+
+	host := e.Host
+	if host == "" {
+		suffix := e.Suffix
+		if suffix == "" {
+			suffix = DefaultEndpointSuffix
+		}
+		host = fmt.Sprintf("%s.blob.%s", accountName, suffix)
+	}
+
+	u := url.URL{Scheme: scheme, Host: host}
+	if e.PathStyle {
+		u.Path = "/" + accountName
+	}
+	return &u, nil
+}
+
+// ContainerURL returns the URL for containerName within accountName.
+func (e Endpoint) ContainerURL(accountName string, containerName string) (*url.URL, error) {
+	u, err := e.AccountURL(accountName)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = u.Path + "/" + containerName
+	return u, nil
+}
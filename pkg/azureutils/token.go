@@ -0,0 +1,234 @@
+package azureutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	DefaultAuthorityHost    = "https://login.microsoftonline.com"
+	DefaultIdentityEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// resource (and scope) tokens are requested for.
+	storageResource = "https://storage.azure.com/"
+
+	// refresh tokens this long before they expire.
+	tokenRefreshMargin = 5 * time.Minute
+
+	// if a refresh fails, try again after this long.
+	tokenRetryInterval = 30 * time.Second
+)
+
+// AccessToken is an OAuth bearer token and when it expires.
+type AccessToken struct {
+	Token     string
+	ExpiresOn time.Time
+}
+
+// TokenProvider fetches a new access token for Azure storage.
+type TokenProvider interface {
+	GetToken() (AccessToken, error)
+}
+
+// tokenResponse covers both the AAD token endpoint and the instance metadata service.
+// Depending on endpoint/version the numbers come back as either numbers or strings.
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	ExpiresOn        json.Number `json:"expires_on"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+func (tr tokenResponse) toAccessToken(now time.Time) (AccessToken, error) {
+	if tr.AccessToken == "" {
+		return AccessToken{}, errors.New("token response has no access token")
+	}
+
+	if expiresOn, err := tr.ExpiresOn.Int64(); err == nil && expiresOn > 0 {
+		return AccessToken{Token: tr.AccessToken, ExpiresOn: time.Unix(expiresOn, 0)}, nil
+	}
+	if expiresIn, err := tr.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		return AccessToken{Token: tr.AccessToken, ExpiresOn: now.Add(time.Duration(expiresIn) * time.Second)}, nil
+	}
+	return AccessToken{}, errors.New("token response has no expiry")
+}
+
+func doTokenRequest(httpClient *http.Client, req *http.Request) (AccessToken, error) {
+	now := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	tr := tokenResponse{}
+	err = json.Unmarshal(body, &tr)
+	if resp.StatusCode != http.StatusOK {
+		if err == nil && tr.Error != "" {
+			return AccessToken{}, fmt.Errorf("token request failed with status %d: %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+		}
+		return AccessToken{}, fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	return tr.toAccessToken(now)
+}
+
+// ClientCredentialsProvider gets tokens for a service principal using the OAuth2 client credentials flow.
+type ClientCredentialsProvider struct {
+	AuthorityHost string
+	TenantID      string
+	ClientID      string
+	ClientSecret  string
+
+	httpClient *http.Client
+}
+
+// NewClientCredentialsProvider creates a ClientCredentialsProvider. An empty authorityHost uses the public Azure one.
+func NewClientCredentialsProvider(authorityHost string, tenantID string, clientID string, clientSecret string) *ClientCredentialsProvider {
+	if authorityHost == "" {
+		authorityHost = DefaultAuthorityHost
+	}
+
+	cp := ClientCredentialsProvider{}
+	cp.AuthorityHost = strings.TrimSuffix(authorityHost, "/")
+	cp.TenantID = tenantID
+	cp.ClientID = clientID
+	cp.ClientSecret = clientSecret
+	cp.httpClient = &http.Client{Timeout: 30 * time.Second}
+	return &cp
+}
+
+func (cp *ClientCredentialsProvider) GetToken() (AccessToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", cp.ClientID)
+	form.Set("client_secret", cp.ClientSecret)
+	form.Set("scope", storageResource+".default")
+
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", cp.AuthorityHost, url.PathEscape(cp.TenantID))
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return AccessToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return doTokenRequest(cp.httpClient, req)
+}
+
+// ManagedIdentityProvider gets tokens from the instance metadata service (IMDS) of the VM/container
+// we are running on. ClientID selects a user assigned identity, empty means the system assigned one.
+type ManagedIdentityProvider struct {
+	Endpoint string
+	ClientID string
+
+	httpClient *http.Client
+}
+
+// NewManagedIdentityProvider creates a ManagedIdentityProvider. An empty endpoint uses the standard IMDS one.
+func NewManagedIdentityProvider(endpoint string, clientID string) *ManagedIdentityProvider {
+	if endpoint == "" {
+		endpoint = DefaultIdentityEndpoint
+	}
+
+	mp := ManagedIdentityProvider{}
+	mp.Endpoint = endpoint
+	mp.ClientID = clientID
+	mp.httpClient = &http.Client{Timeout: 30 * time.Second}
+	return &mp
+}
+
+func (mp *ManagedIdentityProvider) GetToken() (AccessToken, error) {
+	u, err := url.Parse(mp.Endpoint)
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	q := u.Query()
+	q.Set("api-version", "2018-02-01")
+	q.Set("resource", storageResource)
+	if mp.ClientID != "" {
+		q.Set("client_id", mp.ClientID)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	return doTokenRequest(mp.httpClient, req)
+}
+
+// tokenRefreshInterval returns how long to wait before refreshing a token expiring at expiresOn.
+// Normally tokenRefreshMargin before expiry, but for short lived tokens half way through their life.
+func tokenRefreshInterval(expiresOn time.Time, now time.Time) time.Duration {
+	lifetime := expiresOn.Sub(now)
+	if lifetime > 2*tokenRefreshMargin {
+		return lifetime - tokenRefreshMargin
+	}
+	if lifetime/2 < time.Second {
+		return time.Second
+	}
+	return lifetime / 2
+}
+
+// NewBlobHandlerWithToken creates a BlobHandler authenticating with OAuth tokens from provider
+// (eg. a service principal or managed identity) instead of the account key.
+// The token is refreshed in the background before it expires. Token credentials are only sent over https.
+func NewBlobHandlerWithToken(accountName string, provider TokenProvider, endpoint Endpoint) (BlobHandler, error) {
+
+	// get the first token up front so bad credentials are reported here.
+	token, err := provider.GetToken()
+	if err != nil {
+		return BlobHandler{}, err
+	}
+
+	bh := BlobHandler{}
+	bh.accountName = accountName
+	bh.endpoint = endpoint
+	bh.blobSASTokens = make(map[string]string)
+	bh.createContainers = true
+	bh.createdContainers = &sync.Map{}
+	bh.blobPipeline = azblob.NewPipeline(azblob.NewTokenCredential(token.Token, tokenRefresher(provider, token)), azblob.PipelineOptions{})
+	return bh, nil
+}
+
+// tokenRefresher returns the refresher for a TokenCredential starting with token. It sets a new token
+// from provider and returns how long until the next refresh, or tokenRetryInterval if that failed.
+func tokenRefresher(provider TokenProvider, token AccessToken) func(credential azblob.TokenCredential) time.Duration {
+
+	// the refresher is called immediately by NewTokenCredential, we already have a token for that.
+	firstCall := true
+	return func(credential azblob.TokenCredential) time.Duration {
+		if firstCall {
+			firstCall = false
+			return tokenRefreshInterval(token.ExpiresOn, time.Now())
+		}
+
+		newToken, err := provider.GetToken()
+		if err != nil {
+			return tokenRetryInterval
+		}
+		credential.SetToken(newToken.Token)
+		return tokenRefreshInterval(newToken.ExpiresOn, time.Now())
+	}
+}
@@ -0,0 +1,241 @@
+package azureutils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// tokenServer is a stand in for the AAD token endpoint and IMDS. check returns the status for a
+// request (after any test failures), and the body to send for a 200.
+func tokenServer(check func(r *http.Request) (int, string)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, body := check(r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func checkExpiresOn(t *testing.T, name string, got time.Time, want time.Time) {
+	if d := got.Sub(want); d < -2*time.Second || d > 2*time.Second {
+		t.Errorf("%s: expires on %v, want about %v", name, got, want)
+	}
+}
+
+func TestClientCredentialsProvider(t *testing.T) {
+	server := tokenServer(func(r *http.Request) (int, string) {
+		if r.Method != http.MethodPost || r.URL.Path != "/my-tenant/oauth2/v2.0/token" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+			t.Errorf("wrong content type %s", r.Header.Get("Content-Type"))
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		want := map[string]string{"grant_type": "client_credentials", "client_id": "my-client",
+			"scope": "https://storage.azure.com/.default"}
+		for k, v := range want {
+			if r.PostForm.Get(k) != v {
+				t.Errorf("%s is %q, want %q", k, r.PostForm.Get(k), v)
+			}
+		}
+		if r.PostForm.Get("client_secret") != "secret" {
+			return http.StatusUnauthorized, `{"error":"invalid_client","error_description":"bad secret"}`
+		}
+		return http.StatusOK, `{"token_type":"Bearer","expires_in":3599,"access_token":"aad-token"}`
+	})
+	defer server.Close()
+
+	// a trailing slash on the authority is fine.
+	cp := NewClientCredentialsProvider(server.URL+"/", "my-tenant", "my-client", "secret")
+	token, err := cp.GetToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "aad-token" {
+		t.Errorf("wrong token %s", token.Token)
+	}
+	checkExpiresOn(t, "client credentials", token.ExpiresOn, time.Now().Add(3599*time.Second))
+
+	cp = NewClientCredentialsProvider(server.URL, "my-tenant", "my-client", "wrong")
+	if _, err := cp.GetToken(); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("expected the error from the token endpoint, got %v", err)
+	}
+}
+
+func TestManagedIdentityProvider(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Truncate(time.Second)
+	server := tokenServer(func(r *http.Request) (int, string) {
+		if r.Method != http.MethodGet || r.URL.Path != "/metadata/identity/oauth2/token" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		q := r.URL.Query()
+		if q.Get("api-version") != "2018-02-01" || q.Get("resource") != "https://storage.azure.com/" {
+			t.Errorf("wrong query %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Metadata") != "true" {
+			return http.StatusBadRequest, `{"error":"invalid_request","error_description":"Required metadata header not specified"}`
+		}
+		if clientID := q.Get("client_id"); clientID != "" && clientID != "user-assigned" {
+			return http.StatusBadRequest, `{"error":"invalid_request","error_description":"Identity not found"}`
+		}
+
+		// IMDS sends its numbers as strings.
+		return http.StatusOK, `{"access_token":"imds-token-` + q.Get("client_id") + `","expires_in":"3599","expires_on":"` +
+			strconv.FormatInt(expiresOn.Unix(), 10) + `","token_type":"Bearer"}`
+	})
+	defer server.Close()
+
+	tests := []struct {
+		clientID string
+		token    string
+		fails    bool
+	}{
+		{"", "imds-token-", false},
+		{"user-assigned", "imds-token-user-assigned", false},
+		{"unknown", "", true},
+	}
+	for _, tt := range tests {
+		mp := NewManagedIdentityProvider(server.URL+"/metadata/identity/oauth2/token", tt.clientID)
+		token, err := mp.GetToken()
+		if tt.fails {
+			if err == nil || !strings.Contains(err.Error(), "Identity not found") {
+				t.Errorf("client id %q: expected the error from IMDS, got %v", tt.clientID, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("client id %q: %v", tt.clientID, err)
+		}
+		if token.Token != tt.token || !token.ExpiresOn.Equal(expiresOn) {
+			t.Errorf("client id %q: got %+v, want %s expiring on %v", tt.clientID, token, tt.token, expiresOn)
+		}
+	}
+
+	mp := NewManagedIdentityProvider("", "")
+	if mp.Endpoint != DefaultIdentityEndpoint {
+		t.Errorf("default endpoint is %s", mp.Endpoint)
+	}
+}
+
+func TestTokenResponseExpiry(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name      string
+		body      string
+		expiresOn time.Time
+		fails     bool
+	}{
+		{"expires_in number", `{"access_token":"t","expires_in":3600}`, now.Add(time.Hour), false},
+		{"expires_in string", `{"access_token":"t","expires_in":"3600"}`, now.Add(time.Hour), false},
+		{"expires_on number", `{"access_token":"t","expires_on":1700000000}`, time.Unix(1700000000, 0), false},
+		{"expires_on string", `{"access_token":"t","expires_on":"1700000000"}`, time.Unix(1700000000, 0), false},
+		{"expires_on wins", `{"access_token":"t","expires_in":"60","expires_on":"1700000000"}`, time.Unix(1700000000, 0), false},
+		{"zero expires_on", `{"access_token":"t","expires_in":60,"expires_on":0}`, now.Add(time.Minute), false},
+		{"no expiry", `{"access_token":"t"}`, time.Time{}, true},
+		{"no access token", `{"expires_in":3600}`, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		tr := tokenResponse{}
+		if err := json.Unmarshal([]byte(tt.body), &tr); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		token, err := tr.toAccessToken(now)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tt.name, token)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if token.Token != "t" || !token.ExpiresOn.Equal(tt.expiresOn) {
+			t.Errorf("%s: got %+v, want expiry %v", tt.name, token, tt.expiresOn)
+		}
+	}
+}
+
+func TestTokenRefreshInterval(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{time.Hour, time.Hour - tokenRefreshMargin},
+		{2*tokenRefreshMargin + time.Second, tokenRefreshMargin + time.Second},
+		// short lived tokens are refreshed half way through.
+		{2 * tokenRefreshMargin, tokenRefreshMargin},
+		{4 * time.Minute, 2 * time.Minute},
+		{3 * time.Second, 1500 * time.Millisecond},
+		// but not in a tight loop when about to expire, or already expired.
+		{time.Second, time.Second},
+		{0, time.Second},
+		{-time.Minute, time.Second},
+	}
+	for _, tt := range tests {
+		if got := tokenRefreshInterval(now.Add(tt.lifetime), now); got != tt.want {
+			t.Errorf("token lasting %v refreshed after %v, want %v", tt.lifetime, got, tt.want)
+		}
+	}
+}
+
+// testTokenProvider returns its tokens/errors in order.
+type testTokenProvider struct {
+	tokens []AccessToken
+	errs   []error
+	calls  int
+}
+
+func (tp *testTokenProvider) GetToken() (AccessToken, error) {
+	i := tp.calls
+	tp.calls++
+	return tp.tokens[i], tp.errs[i]
+}
+
+func TestTokenRefresher(t *testing.T) {
+	now := time.Now()
+	first := AccessToken{Token: "first", ExpiresOn: now.Add(time.Hour)}
+	provider := &testTokenProvider{
+		tokens: []AccessToken{{}, {Token: "second", ExpiresOn: now.Add(2 * time.Hour)}},
+		errs:   []error{errors.New("token endpoint down"), nil},
+	}
+	credential := azblob.NewTokenCredential(first.Token, nil)
+	refresher := tokenRefresher(provider, first)
+
+	// the first call is for the token we already have.
+	checkInterval(t, "first call", refresher(credential), time.Hour-tokenRefreshMargin)
+	if provider.calls != 0 || credential.Token() != "first" {
+		t.Errorf("first call fetched a token")
+	}
+
+	// a failed refresh keeps the old token and tries again soon.
+	if got := refresher(credential); got != tokenRetryInterval {
+		t.Errorf("failed refresh retried after %v, want %v", got, tokenRetryInterval)
+	}
+	if credential.Token() != "first" {
+		t.Errorf("failed refresh changed the token to %q", credential.Token())
+	}
+
+	checkInterval(t, "refresh", refresher(credential), 2*time.Hour-tokenRefreshMargin)
+	if credential.Token() != "second" {
+		t.Errorf("refresh didnt set the new token, have %q", credential.Token())
+	}
+}
+
+// checkInterval allows for the time taken between working out now and the refresher running.
+func checkInterval(t *testing.T, name string, got time.Duration, want time.Duration) {
+	if got > want || got < want-2*time.Second {
+		t.Errorf("%s: refresh after %v, want about %v", name, got, want)
+	}
+}
@@ -0,0 +1,34 @@
+package blobsync
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// Backend is the set of block blob primitives BlobSync needs from a storage service.
+// azureutils.BlobHandler is the original (and default) implementation, but anything
+// that can stage blocks, commit a block list and serve byte ranges will do.
+// Implementations should give up and return ctx.Err() once ctx is cancelled.
+type Backend interface {
+
+	// StageBlock uploads a single uncommitted block for the blob. data is only valid until StageBlock
+	// returns, callers reuse the buffer for the next block, so copy it if it is needed any longer.
+	StageBlock(ctx context.Context, containerName string, blobName string, blockID string, data []byte) error
+
+	// PutBlockList commits the blocks (in the order given) as the new content of the blob.
+	// Blocks can be newly staged or already part of the currently committed blob.
+	PutBlockList(ctx context.Context, uploadedBlockList []signatures.UploadedBlock, containerName string, blobName string) error
+
+	// DownloadBlobRange appends bytes beginOffset to endOffset (both inclusive) of the blob to buffer.
+	// A negative endOffset means read to the end of the blob.
+	DownloadBlobRange(ctx context.Context, buffer *bytes.Buffer, containerName string, blobName string, beginOffset int64, endOffset int64) error
+
+	// GetBlobProperties returns the size and ETag of the committed blob. The ETag must change
+	// whenever the blob does (or be empty if the service has no such thing).
+	GetBlobProperties(ctx context.Context, containerName string, blobName string) (*signatures.BlobProperties, error)
+
+	// BlobExist returns true if the blob exists.
+	BlobExist(ctx context.Context, containerName string, blobName string) bool
+}
@@ -2,16 +2,14 @@ package blobsync
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
-	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/kpfaulkner/blobsyncgo/pkg/azureutils"
 	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
 	"io"
-	"io/ioutil"
 	"os"
 	"sort"
 )
@@ -25,23 +23,114 @@ type BlobSync struct {
 	// container
 	blobContainer string
 
-	// blob pipeline....  now the mechanism for accessing blobs.
-	blobHandler azureutils.BlobHandler
+	// mechanism for accessing blobs. Azure unless told otherwise.
+	blobHandler Backend
 
 	// signatures...
 	signatureHandler signatures.SignatureHandler
+
+	// options for newly created signatures. Zero values mean the defaults, except a zero
+	// BlockSize which is picked per file between minBlockSize and maxBlockSize.
+	sigOptions signatures.SignatureOptions
+	minBlockSize int
+	maxBlockSize int
+
+	// fragmentation past which delta uploads compact the blob, 0 to never.
+	compactionThreshold float64
+
+	// goroutines hashing blocks when generating signatures.
+	sigWorkers int
+
+	// goroutines searching the local file for blocks of a signature.
+	searchWorkers int
+
+	// which matches the search of a local file looks for.
+	searchOptions SearchOptions
+
+	// what to do when a signature doesnt match its blob.
+	stalePolicy StaleSignaturePolicy
 }
 
-func NewBlobSync(accountName string, accountKey string) BlobSync {
-	bs := BlobSync{}
+const (
+	// MaxBlockCount is the most blocks a blob can be made of (Azure's limit on a block list).
+	MaxBlockCount = 50000
+
+	// DefaultMaxBlockSize is the largest block size picked automatically, Azure's limit for a block.
+	DefaultMaxBlockSize = 100 * 1024 * 1024
+
+	// new blobs aim for this many blocks at most, leaving room for delta uploads (which
+	// split blocks around changes) before the blob has to be uploaded in full again.
+	targetBlockCount = MaxBlockCount / 2
+)
+
+func NewBlobSync(accountName string, accountKey string) (BlobSync, error) {
+	blobHandler, err := azureutils.NewBlobHandler(accountName, accountKey)
+	if err != nil {
+		return BlobSync{}, err
+	}
+	bs := NewBlobSyncWithBackend(&blobHandler)
 	bs.blobAccountName = accountName
 	bs.blobKey = accountKey
-	bs.blobHandler = azureutils.NewBlobHandler(accountName, accountKey)
-  bs.signatureHandler = signatures.NewSignatureHandler()
+
+	return bs, nil
+}
+
+// NewBlobSyncWithBackend creates a BlobSync that stores blobs (and their signatures) in backend.
+func NewBlobSyncWithBackend(backend Backend) BlobSync {
+	bs := BlobSync{}
+	bs.blobHandler = backend
+	bs.signatureHandler = signatures.NewSignatureHandler()
+	bs.minBlockSize = signatures.SignatureSize
+	bs.maxBlockSize = DefaultMaxBlockSize
+	bs.compactionThreshold = DefaultCompactionThreshold
+	bs.sigWorkers = signatures.DefaultSignatureWorkers()
+	bs.searchWorkers = DefaultSearchWorkers()
+	bs.searchOptions = DefaultSearchOptions()
+	bs.stalePolicy = DefaultStaleSignaturePolicy
 
 	return bs
 }
 
+// SetSignatureOptions sets the block size and algorithms used for signatures of new uploads.
+// A blob already uploaded with different options is uploaded in full again, since its
+// existing blocks cant be reused.
+func (bs *BlobSync) SetSignatureOptions(opts signatures.SignatureOptions) error {
+	if err := opts.WithDefaults().Validate(); err != nil {
+		return err
+	}
+	bs.sigOptions = opts
+	return nil
+}
+
+// SetBlockSizeRange sets the range block sizes are picked from, when not set by SetSignatureOptions.
+// Files up to targetBlockCount * minBlockSize bytes use minBlockSize, larger ones scale up to maxBlockSize.
+func (bs *BlobSync) SetBlockSizeRange(minBlockSize int, maxBlockSize int) error {
+	if minBlockSize <= 0 || maxBlockSize < minBlockSize {
+		return fmt.Errorf("invalid block size range %d to %d", minBlockSize, maxBlockSize)
+	}
+	bs.minBlockSize = minBlockSize
+	bs.maxBlockSize = maxBlockSize
+	return nil
+}
+
+// SetSignatureWorkers sets how many goroutines hash blocks when generating a signature, 1 to do it sequentially.
+func (bs *BlobSync) SetSignatureWorkers(workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid number of signature workers %d", workers)
+	}
+	bs.sigWorkers = workers
+	return nil
+}
+
+// sigOptionsForSize gets the options for a new signature of size bytes, picking the block size if need be.
+func (bs BlobSync) sigOptionsForSize(size int64) signatures.SignatureOptions {
+	opts := bs.sigOptions
+	if opts.BlockSize == 0 {
+		opts.BlockSize = signatures.BlockSizeForFile(size, targetBlockCount, bs.minBlockSize, bs.maxBlockSize)
+	}
+	return opts.WithDefaults()
+}
+
 func (bs BlobSync) doesFileExist(localFilePath string ) bool {
 	info, err := os.Stat(localFilePath)
 	if os.IsNotExist(err) {
@@ -51,27 +140,40 @@ func (bs BlobSync) doesFileExist(localFilePath string ) bool {
 	return !info.IsDir()
 }
 
-func (bs BlobSync) Download(localFilePath string, containerName string, blobName string, verbose bool ) error {
+// Download updates localFilePath to match the blob, only downloading the parts not already local.
+// The new file is built in localFilePath+".new" and only replaces localFilePath once it checks out,
+// so a failed download leaves the local file as it was.
+func (bs BlobSync) Download(localFilePath string, containerName string, blobName string, verbose bool) error {
+	return bs.DownloadContext(context.Background(), localFilePath, containerName, blobName, verbose)
+}
+
+// DownloadContext is Download but gives up when ctx is cancelled.
+func (bs BlobSync) DownloadContext(ctx context.Context, localFilePath string, containerName string, blobName string, verbose bool ) error {
 
 	if bs.doesFileExist(localFilePath) {
 		// download sig for blob
-		blobSig, err := bs.DownloadSignatureForBlob(containerName, blobName)
+		blobSig, err := bs.DownloadSignatureForBlobContext(ctx, containerName, blobName)
 		if err != nil {
-			fmt.Printf("Unable to get sig for blob %s : %s\n", blobName, err)
 			return err
 		}
 
-		// search local file for blob sig details
-		localFile,_ := os.Open(localFilePath)
+		// a stale sig would have us build the wrong file.
+		props, err := bs.checkSignature(ctx, blobSig, containerName, blobName)
+		if errors.Is(err, ErrSignatureStale) {
+			return bs.downloadStale(ctx, err, localFilePath, containerName, blobName, props, verbose)
+		}
+		if err != nil {
+			return err
+		}
 
-		/*
-    localSig, err := bs.generateSig(localFile)
+		// search local file for blob sig details
+		localFile, err := os.Open(localFilePath)
 		if err != nil {
-			fmt.Printf("Cannot create signature %s\n", err.Error())
 			return err
-		} */
+		}
+		defer localFile.Close()
 
-		searchResults, err := SearchLocalFileForSignatureForDownload( localFile, *blobSig )
+		searchResults, err := SearchLocalFileWithStrategy(ctx, localFile, *blobSig, DownloadSearchStrategy(bs.searchOptions), bs.searchWorkers)
 		if err != nil {
 			return err
 		}
@@ -81,14 +183,26 @@ func (bs BlobSync) Download(localFilePath string, containerName string, blobName
 			return err
 		}
 
-		bs.RegenerateBlob(containerName, blobName, byteRangesToDownload, localFilePath, searchResults.SignaturesToReuse, blobSig)
-
+		err = bs.RegenerateBlobContext(ctx, containerName, blobName, byteRangesToDownload, localFilePath, searchResults.SignaturesToReuse, blobSig)
+		if err == nil {
+			// the blob can change without the ETag changing (eg. backends without real ETags), which is
+			// only spotted here if the changed part was downloaded.
+			err = verifyDownload(localFilePath+".new", blobName, props, blobSig)
+		}
+		if err != nil {
+			os.Remove(localFilePath+".new")
+			if errors.Is(err, ErrSignatureStale) {
+				return bs.downloadStale(ctx, err, localFilePath, containerName, blobName, props, verbose)
+			}
+			return err
+		}
 
-		// regenerate blob
+		localFile.Close()
+		return os.Rename(localFilePath+".new", localFilePath)
 
 	} else {
 		// download entire file.
-		err := bs.DownloadBlobToFile( localFilePath, containerName, blobName)
+		err := bs.DownloadBlobToFileContext(ctx, localFilePath, containerName, blobName)
     if err != nil {
     	return err
     }
@@ -98,19 +212,35 @@ func (bs BlobSync) Download(localFilePath string, containerName string, blobName
 }
 
 func (bs BlobSync) RegenerateBlob(containerName string, blobName string, byteRangesToDownload []signatures.RemainingBytes,
+	localFilePath string, reusableBlockSignatures []signatures.BlockSig, blobSig *signatures.SizeBasedCompleteSignature) error {
+	return bs.RegenerateBlobContext(context.Background(), containerName, blobName, byteRangesToDownload, localFilePath, reusableBlockSignatures, blobSig)
+}
+
+// RegenerateBlobContext is RegenerateBlob but gives up when ctx is cancelled.
+// The blob is written to localFilePath+".new", localFilePath is left alone.
+func (bs BlobSync) RegenerateBlobContext(ctx context.Context, containerName string, blobName string, byteRangesToDownload []signatures.RemainingBytes,
 										localFilePath string, reusableBlockSignatures []signatures.BlockSig, blobSig *signatures.SizeBasedCompleteSignature) error {
 
 	allBlobSigs := signatures.ExpandSizeBasedCompleteSignature(*blobSig)
 	reusableBlobLUT := generateBlockLUTFromBlockSigs(reusableBlockSignatures)
   offset := int64(0)
 
-  localFile,_ := os.Open(localFilePath)
-  newFile,_ := os.Create(localFilePath+".new")
+  localFile, err := os.Open(localFilePath)
+  if err != nil {
+  	return err
+  }
+  defer localFile.Close()
+
+  newFile, err := os.Create(localFilePath+".new")
+  if err != nil {
+  	return err
+  }
+  defer newFile.Close()
 
   for _,sig := range allBlobSigs {
 
-  	if sig.Size < 20000 {
-  		fmt.Printf("here")
+  	if err := ctx.Err(); err != nil {
+  		return err
 	  }
 
   	haveMatch := false
@@ -119,19 +249,16 @@ func (bs BlobSync) RegenerateBlob(containerName string, blobName string, byteRan
 		  matchingLocalSig, hasMatch := returnMatchingSig( localSig, sig)
 			if hasMatch {
 				buffer := make([]byte, matchingLocalSig.Size)
-				localFile.Seek( matchingLocalSig.Offset,0)
-				bytesRead, err := localFile.Read(buffer)
+				_, err := localFile.ReadAt(buffer, matchingLocalSig.Offset)
 				if err != nil {
 					return err
 				}
-				fmt.Printf("%d bytes read\n", bytesRead)
 				/*
 				if bytesRead != matchingLocalSig.Size {
 					return errors.New("Unable to read correct length of file.")
 				}
         */
-				newFile.Seek(sig.Offset,0)
-				bytesWritten, err := newFile.Write(buffer)
+				bytesWritten, err := newFile.WriteAt(buffer, sig.Offset)
 				if err != nil {
 					return err
 				}
@@ -147,23 +274,33 @@ func (bs BlobSync) RegenerateBlob(containerName string, blobName string, byteRan
 	  if !haveMatch{
 	  	byteRange,ok := getByteRangeForOffset( byteRangesToDownload, offset)
 	  	if ok {
-	  		blobBytes := bs.DownloadBytes(containerName, blobName, byteRange.BeginOffset, byteRange.EndOffset)
-	  		newFile.Seek(sig.Offset,0)
-	  		newFile.Write(blobBytes)
+	  		blobBytes, err := bs.DownloadBytesContext(ctx, containerName, blobName, byteRange.BeginOffset, byteRange.EndOffset)
+	  		if err != nil {
+	  			return err
+			  }
+	  		if _, err := newFile.WriteAt(blobBytes, sig.Offset); err != nil {
+	  			return err
+			  }
 	  		offset += byteRange.EndOffset - byteRange.BeginOffset + 1
 		  }
 	  }
   }
 
-  // rename .new to origina..... TODO(kpfaulkner)
   return nil
 }
 
-func (bs BlobSync) DownloadBytes(containerName string, blobName string, beginOffset int64, endOffset int64) []byte {
+func (bs BlobSync) DownloadBytes(containerName string, blobName string, beginOffset int64, endOffset int64) ([]byte, error) {
+	return bs.DownloadBytesContext(context.Background(), containerName, blobName, beginOffset, endOffset)
+}
+
+func (bs BlobSync) DownloadBytesContext(ctx context.Context, containerName string, blobName string, beginOffset int64, endOffset int64) ([]byte, error) {
 
 	buffer := bytes.Buffer{}
-  bs.blobHandler.DownloadBlobRange(&buffer, containerName, blobName, beginOffset, endOffset)
-	return buffer.Bytes()
+  err := bs.blobHandler.DownloadBlobRange(ctx, &buffer, containerName, blobName, beginOffset, endOffset)
+  if err != nil {
+  	return nil, err
+  }
+	return buffer.Bytes(), nil
 }
 
 func getByteRangeForOffset(byteRanges []signatures.RemainingBytes, offset int64) (*signatures.RemainingBytes, bool) {
@@ -175,13 +312,13 @@ func getByteRangeForOffset(byteRanges []signatures.RemainingBytes, offset int64)
 	return nil, false
 }
 
-// returnMatchingSig finds a matching sig based on MD5.
+// returnMatchingSig finds a matching sig based on the strong hash.
 // Returns pointer to the BlockSig and a bool indicating found or not.
 // Could technically just return nil to indicate not found, but will stick with
 // explicit bool for now.
 func returnMatchingSig(sigsToReuse []signatures.BlockSig, sig signatures.BlockSig) (*signatures.BlockSig, bool) {
 	for _,s := range sigsToReuse {
-		if s.MD5Signature == sig.MD5Signature {
+		if s.StrongSig == sig.StrongSig {
 			return &s, true
 		}
 	}
@@ -191,40 +328,13 @@ func returnMatchingSig(sigsToReuse []signatures.BlockSig, sig signatures.BlockSi
 
 func findMatchingSig( sigsToReuse []signatures.BlockSig, sig signatures.BlockSig) bool {
 	for _,s := range sigsToReuse {
-		if s.MD5Signature == sig.MD5Signature {
+		if s.StrongSig == sig.StrongSig {
 			return true
 		}
 	}
 	return false
 }
 
-func (bs BlobSync) GenerateByteRangesOfBlobToDownloadORIG(sigsToReuseList []signatures.BlockSig,
-																											blobSig *signatures.SizeBasedCompleteSignature,
-																											containerName string, blobName string) ([]signatures.RemainingBytes, error) {
-
-  remainingBytesList := []signatures.RemainingBytes{}
-  allBlobSigs := signatures.ExpandSizeBasedCompleteSignature(*blobSig)
-  sort.Slice(allBlobSigs, func (i int, j int) bool {
-  	return allBlobSigs[i].Offset < allBlobSigs[j].Offset
-  })
-
-  startOffsetToCopy := int64(0)
-  for _, sig := range allBlobSigs {
-  	haveMatchingSig := findMatchingSig(sigsToReuseList, sig)
-  	if !haveMatchingSig {
-  		remainingBytesList = append(remainingBytesList, signatures.RemainingBytes{BeginOffset: startOffsetToCopy, EndOffset: sig.Offset + int64(sig.Size) - 1})
-  		startOffsetToCopy = sig.Offset + int64(sig.Size)
-	  } else {
-
-	  	// why on earth do I have this here and not just 1 out side of the if statement? Will code as per original but will definitely
-	  	// need to revisit this.
-	  	startOffsetToCopy = sig.Offset + int64(sig.Size)
-	  }
-  }
-
-	return remainingBytesList, nil
-}
-
 func (bs BlobSync) GenerateByteRangesOfBlobToDownload(sigsToReuseList []signatures.BlockSig,
 	blobSig *signatures.SizeBasedCompleteSignature,
 	containerName string, blobName string) ([]signatures.RemainingBytes, error) {
@@ -258,16 +368,47 @@ func (bs BlobSync) GenerateByteRangesOfBlobToDownload(sigsToReuseList []signatur
 // Upload will upload the data from a reader.
 // It will return the signature of the file uploaded.
 // or an error if something went boom.
-func (bs BlobSync) Upload(localFile *os.File, containerName string, blobName string, verbose bool ) error {
+func (bs BlobSync) Upload(localFile *os.File, containerName string, blobName string, verbose bool) error {
+	return bs.UploadContext(context.Background(), localFile, containerName, blobName, verbose)
+}
 
-  if bs.blobHandler.BlobExist(containerName, blobName) && bs.blobHandler.BlobExist(containerName, blobName+".sig") {
-  	// doing the tricky stuff.
-  	return bs.uploadDeltaOnly(localFile, containerName, blobName, verbose)
-  } else {
-  	return bs.uploadBlobAndSigAsNew(localFile, containerName, blobName, verbose)
+// UploadContext is Upload but gives up when ctx is cancelled. Any blocks already staged are
+// left uncommitted, the existing blob is untouched.
+func (bs BlobSync) UploadContext(ctx context.Context, localFile *os.File, containerName string, blobName string, verbose bool ) error {
+	stats, err := localFile.Stat()
+	if err != nil {
+		return err
 	}
+	return bs.UploadReaderAtContext(ctx, localFile, stats.Size(), containerName, blobName, verbose)
+}
 
-	return nil
+// UploadReaderAt is Upload for the first size bytes of r, for data that isnt a local file (eg. held in memory
+// or served by another storage layer). Files are mmapped if possible, anything else is read with ReadAt.
+func (bs BlobSync) UploadReaderAt(r io.ReaderAt, size int64, containerName string, blobName string, verbose bool) error {
+	return bs.UploadReaderAtContext(context.Background(), r, size, containerName, blobName, verbose)
+}
+
+// UploadReaderAtContext is UploadReaderAt but gives up when ctx is cancelled, like UploadContext.
+func (bs BlobSync) UploadReaderAtContext(ctx context.Context, r io.ReaderAt, size int64, containerName string, blobName string, verbose bool) error {
+
+  data := openLocalData(r, size)
+  defer data.Close()
+
+  if bs.blobHandler.BlobExist(ctx, containerName, blobName) && bs.blobHandler.BlobExist(ctx, containerName, blobName+".sig") {
+  	// doing the tricky stuff.
+  	err := bs.uploadDeltaOnly(ctx, data, containerName, blobName, verbose)
+
+  	// unusable sig (or a delta isnt possible), nothing has been committed so just upload the lot.
+  	if !errors.Is(err, ErrSignatureNotFound) && !errors.Is(err, ErrSignatureCorrupt) && !errors.Is(err, ErrSignatureStale) &&
+  		!errors.Is(err, errSignatureOptionsChanged) && !errors.Is(err, errTooManyBlocks) && !errors.Is(err, errSignatureRegenerated) {
+  		return err
+	  }
+	  if verbose {
+	  	fmt.Printf("%s, uploading in full\n", err.Error())
+	  }
+  }
+
+  return bs.uploadBlobAndSigAsNew(ctx, data, containerName, blobName, verbose)
 }
 
 // uploadDeltaOnly hardest method of the entire project.
@@ -277,85 +418,93 @@ func (bs BlobSync) Upload(localFile *os.File, containerName string, blobName str
 // 4. upload blocks
 // 5. reconstruct blob from old and new blocks
 // 6. upload signature
-func (bs BlobSync) uploadDeltaOnly(localFile *os.File, containerName, blobName string, verbose bool) error {
+func (bs BlobSync) uploadDeltaOnly(ctx context.Context, data localData, containerName, blobName string, verbose bool) error {
 
-  sig, err := bs.DownloadSignatureForBlob(containerName, blobName)
+  sig, err := bs.DownloadSignatureForBlobContext(ctx, containerName, blobName)
   if err != nil {
-  	fmt.Printf("Unable to get sig for blob %s : %s\n", blobName, err)
   	return err
   }
 
-  searchResults, err := SearchLocalFileForSignature( localFile,*sig )
+  // reusing blocks of a stale sig would build the wrong blob, if they exist at all.
+  if _, err := bs.checkSignature(ctx, sig, containerName, blobName); err != nil {
+  	return err
+  }
+  if sig.Blob != nil && sig.Blob.Regenerated {
+  	return errSignatureRegenerated
+  }
+
+  // new blocks have to match the existing ones (block IDs must all be the same length).
+  opts := sig.SignatureOptions
+  if !bs.sigOptionsMatch(opts) {
+  	return errSignatureOptionsChanged
+  }
+
+  searchResults, err := searchLocalData(ctx, data, *sig, UploadSearchStrategy(bs.searchOptions), bs.searchWorkers)
   if err != nil {
   	return err
   }
 
-	allBlocks, err := bs.uploadDelta(localFile, searchResults, containerName, blobName )
+	allBlocks, err := bs.uploadDelta(ctx, data, searchResults, opts, containerName, blobName, verbose)
 	if err != nil {
 		return err
 	}
 
-	sig,_ = signatures.CreateSignatureFromNewAndReusedBlocks(allBlocks)
-	err = bs.uploadSig(sig, containerName, blobName)
+	sig, err = signatures.CreateSignatureFromNewAndReusedBlocks(allBlocks)
 	if err != nil {
-		fmt.Printf("Cannot upload sig:  %s\n", err.Error())
-		return  err
+		return err
 	}
-
-	return nil
-}
-
-func (bs BlobSync) uploadBytes(remainingBytes signatures.RemainingBytes, localFile *os.File, containerName, blobName string) ([]signatures.UploadedBlock, error ){
-
-	bs.blobHandler.CreateContainerURL(containerName)
-	_, err := bs.blobHandler.UploadRemainingBytesAsBlocks(remainingBytes, localFile, containerName, blobName, false)
+	sig.SignatureOptions = opts
+	hash, err := contentHash(data.r, data.size, opts.StrongAlgorithm)
 	if err != nil {
-		fmt.Printf("Unable to upload blob %s\n", err.Error())
-		return nil, err
+		return err
+	}
+	sig.Blob, err = bs.blobInfo(ctx, hash, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	err = bs.uploadSig(ctx, sig, containerName, blobName)
+	if err != nil {
+		return fmt.Errorf("cannot upload signature for blob %s: %w", blobName, err)
 	}
 
-
-	return nil, nil
+	return nil
 }
 
+// sigOptionsMatch checks the options requested (if any) are those of an existing signature.
+func (bs BlobSync) sigOptionsMatch(existing signatures.SignatureOptions) bool {
+	return (bs.sigOptions.BlockSize == 0 || bs.sigOptions.BlockSize == existing.BlockSize) &&
+		(bs.sigOptions.RollingAlgorithm == 0 || bs.sigOptions.RollingAlgorithm == existing.RollingAlgorithm) &&
+		(bs.sigOptions.StrongAlgorithm == 0 || bs.sigOptions.StrongAlgorithm == existing.StrongAlgorithm) &&
+		(bs.sigOptions.Chunking == 0 || bs.sigOptions.Chunking == existing.Chunking) &&
+		(bs.sigOptions.MinBlockSize == 0 || bs.sigOptions.MinBlockSize == existing.MinBlockSize) &&
+		(bs.sigOptions.MaxBlockSize == 0 || bs.sigOptions.MaxBlockSize == existing.MaxBlockSize)
+}
 
+func (bs BlobSync) uploadBlobAndSigAsNew(ctx context.Context, data localData, containerName, blobName string, verbose bool) error {
 
-func (bs BlobSync) uploadBlobAndSigAsNew(localFile *os.File, containerName, blobName string, verbose bool) error {
-
-  bs.blobHandler.UploadBlob(localFile, containerName, blobName, verbose)
-
-	sig, err := bs.generateSig(localFile)
+	opts := bs.sigOptionsForSize(data.size)
+	err := bs.uploadBlob(ctx, data, opts, containerName, blobName, verbose)
 	if err != nil {
-		fmt.Printf("Cannot generate sig:  %s\n", err.Error())
-		return err
+		return fmt.Errorf("cannot upload blob %s: %w", blobName, err)
 	}
 
-	err = bs.uploadSig(sig, containerName, blobName)
+	sig, hash, err := bs.generateSig(data.r, data.size, opts)
 	if err != nil {
-		fmt.Printf("Cannot upload sig:  %s\n", err.Error())
-		return  err
+		return fmt.Errorf("cannot generate signature: %w", err)
+	}
+	sig.Blob, err = bs.blobInfo(ctx, hash, containerName, blobName)
+	if err != nil {
+		return err
 	}
 
-	// set MD5 for blob.
-	_, err = bs.generateMD5String( localFile)
-  if err != nil {
-  	return err
-  }
-
-  /* Still need to sort this out.
-	err = bs.setMD5ForBlob( md5Sig, containerName, blobname)
+	err = bs.uploadSig(ctx, sig, containerName, blobName)
 	if err != nil {
-		fmt.Printf("Cannot set MD5 for blob  %s\n", err.Error())
-		return  err
+		return fmt.Errorf("cannot upload signature for blob %s: %w", blobName, err)
 	}
- */
 	return nil
 }
 
-func (bs BlobSync) generateMD5String(f *os.File) (string, error) {
-
-	// back to beginning.
-	f.Seek(0,0)
+func (bs BlobSync) generateMD5String(f io.Reader) (string, error) {
 
 	//Open a new hash interface to write to
 	hash := md5.New()
@@ -372,89 +521,142 @@ func (bs BlobSync) generateMD5String(f *os.File) (string, error) {
 	return returnMD5String, nil
 }
 
-func (bs BlobSync) setMD5ForBlob(md5 string, containerName, blobName string) error {
+// generateSig creates the signature of the first size bytes of r, along with their content hash.
+func (bs BlobSync) generateSig(r io.ReaderAt, size int64, opts signatures.SignatureOptions) (*signatures.SizeBasedCompleteSignature, signatures.StrongHash, error) {
 
-
-	return nil
+	sig, hash, err := signatures.CreateSignatureAndHashFromReaderAt(r, size, opts, bs.sigWorkers)
+	if err != nil {
+		return nil, signatures.StrongHash{}, err
+	}
+	return sig, hash, nil
 }
 
-/*
-func (bs BlobSync) uploadAsNewBlob(localFile *os.File, containerName, blobName string) error {
 
-	bs.blobHandler.CreateContainerURL(containerName)
-	err := bs.blobHandler.UploadRemainingBytesAsBlocks(localFile, containerName, blobName)
-	if err != nil {
-		fmt.Printf("Unable to upload blob %s\n", err.Error())
-		return err
-	}
+// uploadSig streams the signature straight into the .sig blob.
+func (bs BlobSync) uploadSig(ctx context.Context, sig *signatures.SizeBasedCompleteSignature, containerName string, blobName string) error {
 
-	return nil
-} */
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := sig.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
 
-func (bs BlobSync) generateSig(localFile *os.File) (*signatures.SizeBasedCompleteSignature, error) {
+	err := bs.uploadFromReader(ctx, pr, bs.sigOptions, containerName, blobName+".sig")
 
-	// rewind to begining of file.
-	localFile.Seek(0,0)
+	// unblock the writer if we gave up early.
+	pr.CloseWithError(err)
+	return err
+}
 
-	sig, err := signatures.CreateSignatureFromScratch(localFile)
-	if err != nil {
-		fmt.Printf("Cannot create signature %s\n", err.Error())
-		return nil, err
-	}
-	return sig,nil
+// blobFileDownloader is implemented by backends that can download a whole blob directly to a file.
+type blobFileDownloader interface {
+	DownloadBlob(ctx context.Context, file *os.File, containerName string, blobName string) error
 }
 
+// DownloadBlobToFile downloads blob and stores at localFilePath size.
+// Not attempting interfaces yet, dont want the risk of a 2G blob being stored into memory :)
+func (bs BlobSync) DownloadBlobToFile(localFilePath string, containerName string, blobName string) error {
+	return bs.DownloadBlobToFileContext(context.Background(), localFilePath, containerName, blobName)
+}
 
-func (bs BlobSync) uploadSig(sig *signatures.SizeBasedCompleteSignature, containerName string, blobName string) error {
+func (bs BlobSync) DownloadBlobToFileContext(ctx context.Context, localFilePath string, containerName string, blobName string ) error {
+	props, err := bs.blobHandler.GetBlobProperties(ctx, containerName, blobName)
+	if err != nil {
+		return fmt.Errorf("cannot download blob %s: %w", blobName, err)
+	}
+	return bs.downloadBlobToFile(ctx, localFilePath, containerName, blobName, props)
+}
 
-	sigBytes, _ := json.Marshal(sig)
+// downloadBlobToFile downloads the blob (with properties props) to localFilePath+".new", then replaces localFilePath
+// with it. The local file is only touched once the whole blob has arrived.
+func (bs BlobSync) downloadBlobToFile(ctx context.Context, localFilePath string, containerName string, blobName string, props *signatures.BlobProperties) error {
+	err := bs.downloadBlobToNewFile(ctx, localFilePath+".new", containerName, blobName)
+	if err == nil {
+		err = verifyDownload(localFilePath+".new", blobName, props, nil)
+	}
+	if err != nil {
+		os.Remove(localFilePath + ".new")
+		return err
+	}
+	return os.Rename(localFilePath+".new", localFilePath)
+}
 
-	// write to temp file? seems silly, but cant get streaming working.
-	_ = ioutil.WriteFile(`c:\temp\temp.sig`, sigBytes, 0644)
-	f,_ := os.Open(`c:\temp\temp.sig`)
-	bs.blobHandler.UploadBlob(f, containerName, blobName+".sig", false)
+func (bs BlobSync) downloadBlobToNewFile(ctx context.Context, newFilePath string, containerName string, blobName string) error {
+	f, err := os.Create(newFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	return nil
+	// stream straight to the file if the backend can, otherwise go via memory.
+	if downloader, ok := bs.blobHandler.(blobFileDownloader); ok {
+		err = downloader.DownloadBlob(ctx, f, containerName, blobName)
+	} else {
+		buffer := bytes.Buffer{}
+		err = bs.blobHandler.DownloadBlobRange(ctx, &buffer, containerName, blobName, 0, -1)
+		if err == nil {
+			_, err = buffer.WriteTo(f)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot download blob %s: %w", blobName, err)
+	}
+	return f.Close()
 }
 
-// DownloadBlobToFile downloads blob and stores at localFilePath size.
-// Not attempting interfaces yet, dont want the risk of a 2G blob being stored into memory :)
-func (bs BlobSync) DownloadBlobToFile( localFilePath string, containerName string, blobName string ) error {
-
-	f, err := os.Create(localFilePath)
+// verifyDownload checks the file at path is the blob with properties props, and has the content hash in sig
+// (if given one that has it). Returns an ErrSignatureStale error if not, ie. the blob changed along the way.
+func verifyDownload(path string, blobName string, props *signatures.BlobProperties, sig *signatures.SizeBasedCompleteSignature) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
+	stats, err := f.Stat()
 	if err != nil {
-		fmt.Printf("Cannot open %s file for writing: %s\n", localFilePath, err.Error())
 		return err
 	}
+	if stats.Size() != props.Size {
+		return signatures.Errorf(ErrSignatureStale, "downloaded %d bytes of blob %s but it is %d", stats.Size(), blobName, props.Size)
+	}
+	if sig == nil || sig.Blob == nil {
+		return nil
+	}
 
-	err = bs.blobHandler.DownloadBlob(f, containerName, blobName)
+	hash, err := contentHash(f, stats.Size(), sig.StrongAlgorithm)
 	if err != nil {
-		fmt.Printf("Cannot download blob:  %s\n", err.Error())
 		return err
 	}
-
+	if hash != sig.Blob.ContentHash {
+		return signatures.Errorf(ErrSignatureStale, "blob %s does not match the content hash of its signature", blobName)
+	}
 	return nil
 }
 
 // DownloadSignatureForBlob. Takes the blob name, appends the ".sig" to it
 // returns the signature
-func (bs BlobSync) DownloadSignatureForBlob( containerName string, blobName string ) (*signatures.SizeBasedCompleteSignature, error) {
+func (bs BlobSync) DownloadSignatureForBlob(containerName string, blobName string) (*signatures.SizeBasedCompleteSignature, error) {
+	return bs.DownloadSignatureForBlobContext(context.Background(), containerName, blobName)
+}
+
+func (bs BlobSync) DownloadSignatureForBlobContext(ctx context.Context, containerName string, blobName string ) (*signatures.SizeBasedCompleteSignature, error) {
 
 	buffer := bytes.Buffer{}
 
-	err := bs.blobHandler.DownloadBlobToBuffer(&buffer, containerName, blobName+".sig")
+	err := bs.blobHandler.DownloadBlobRange(ctx, &buffer, containerName, blobName+".sig", 0, -1)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, signatures.Errorf(ErrSignatureNotFound, "no signature for blob %s: %w", blobName, err)
+	}
 	if err != nil {
-		fmt.Printf("Cannot download signature for blob %s : %s\n", blobName, err.Error())
 		return nil, err
 	}
 
-	var sig signatures.SizeBasedCompleteSignature
-	err = json.Unmarshal(buffer.Bytes(), &sig)
+	// accepts both binary and legacy JSON sigs.
+	sig := signatures.SizeBasedCompleteSignature{}
+	_, err = sig.ReadFrom(&buffer)
 	if err != nil {
-		fmt.Printf("Cannot unmarshal signature : %s\n",  err.Error())
-		return nil, err
+		return nil, fmt.Errorf("cannot parse signature for blob %s: %w", blobName, err)
 	}
 
 	return &sig, nil
@@ -470,24 +672,30 @@ func DisplayUploadedBytes(uploadedBlocks []signatures.UploadedBlock) {
   fmt.Printf("total is %d\n", total)
 }
 
-func (bs BlobSync) uploadDelta(localFile *os.File, searchResults *signatures.SignatureSearchResults, containerName string, blobName string) ([]signatures.UploadedBlock, error) {
+func (bs BlobSync) uploadDelta(ctx context.Context, data localData, searchResults *signatures.SignatureSearchResults, opts signatures.SignatureOptions,
+	containerName string, blobName string, verbose bool) ([]signatures.UploadedBlock, error) {
+
+	// dont bother uploading anything if the result is definitely too many blocks.
+	if count := minimumBlockCount(searchResults, opts); count > MaxBlockCount {
+		return nil, fmt.Errorf("delta needs at least %d blocks: %w", count, errTooManyBlocks)
+	}
 
 	allUploadedBlocks := []signatures.UploadedBlock{}
 
 	for _,remainingBytes := range searchResults.ByteRangesToUpload {
-		uploadedBlockList, err := bs.blobHandler.UploadRemainingBytesAsBlocks(remainingBytes, localFile, containerName, blobName, false)
-		//uploadedBlockList, err := UploadBytes(remainingBytes, localFile, containerName, blobName)
+		uploadedBlockList, err := bs.uploadRemainingBytesAsBlocks(ctx, remainingBytes, data, opts, containerName, blobName, false)
 		if err != nil {
-			fmt.Printf("Cannot upload bytes: %s\n", err.Error())
+			return nil, err
 		}
 		allUploadedBlocks = append(allUploadedBlocks, uploadedBlockList...)
 	}
 
-	fmt.Printf("total bytes uploaded %d\n", bs.blobHandler.TotalBytesUploaded)
-	DisplayUploadedBytes(allUploadedBlocks)
+	if verbose {
+		DisplayUploadedBytes(allUploadedBlocks)
+	}
 
 	for _, sig := range searchResults.SignaturesToReuse {
-		blockID := base64.StdEncoding.EncodeToString(sig.MD5Signature[:])
+		blockID := opts.StrongAlgorithm.BlockID(sig.StrongSig)
 		allUploadedBlocks = append(allUploadedBlocks, signatures.UploadedBlock{BlockID: blockID, Offset: sig.Offset, Size: int64(sig.Size), Sig: sig,IsNew: false})
 	}
 
@@ -495,15 +703,34 @@ func (bs BlobSync) uploadDelta(localFile *os.File, searchResults *signatures.Sig
 		return allUploadedBlocks[i].Offset < allUploadedBlocks[j].Offset
 	})
 
-	err := bs.blobHandler.PutBlockList(allUploadedBlocks, containerName, blobName)
-
-	return allUploadedBlocks, err
-}
+	// too many small blocks from previous deltas, merge them while we have the data locally.
+	if bs.needsCompaction(allUploadedBlocks, opts) {
+		var err error
+		allUploadedBlocks, err = bs.compactBlocks(ctx, allUploadedBlocks, data.r, opts, compactionMaxGap, containerName, blobName)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	// content defined blocks can only be counted once chunked. The new blocks are left uncommitted.
+	if len(allUploadedBlocks) > MaxBlockCount {
+		return nil, fmt.Errorf("delta needs %d blocks: %w", len(allUploadedBlocks), errTooManyBlocks)
+	}
 
+	err := bs.blobHandler.PutBlockList(ctx, allUploadedBlocks, containerName, blobName)
 
-func UploadBytes(remainingBytes signatures.RemainingBytes, localFile *os.File, containingName string, blobName string) ([]signatures.UploadedBlock, error) {
+	return allUploadedBlocks, err
+}
 
-	return nil, nil
+// minimumBlockCount is the fewest blocks the blob can be made of after uploading searchResults.
+// Exact for fixed size blocks.
+func minimumBlockCount(searchResults *signatures.SignatureSearchResults, opts signatures.SignatureOptions) int {
+	maxBlockSize := int64(signatures.NewChunker(opts).MaxBlockSize())
+	count := len(searchResults.SignaturesToReuse)
+	for _, remainingBytes := range searchResults.ByteRangesToUpload {
+		size := remainingBytes.EndOffset - remainingBytes.BeginOffset + 1
+		count += int((size + maxBlockSize - 1) / maxBlockSize)
+	}
+	return count
 }
 
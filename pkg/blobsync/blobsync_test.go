@@ -0,0 +1,308 @@
+package blobsync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/memutils"
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+const testBlockSize = 1000
+
+func newTestBlobSync(t *testing.T) (BlobSync, *memutils.MemHandler) {
+	mh := memutils.NewMemHandler()
+	bs := NewBlobSyncWithBackend(mh)
+	if err := bs.SetSignatureOptions(signatures.SignatureOptions{BlockSize: testBlockSize}); err != nil {
+		t.Fatal(err)
+	}
+	return bs, mh
+}
+
+// changeData is data with 10 bytes changed in the middle of block blockNo.
+func changeData(data []byte, blockNo int) []byte {
+	changed := append([]byte{}, data...)
+	for i := blockNo*testBlockSize + 100; i < blockNo*testBlockSize+110; i++ {
+		changed[i] ^= 0xff
+	}
+	return changed
+}
+
+// stagedFor returns the StageBlock calls made for blobName.
+func stagedFor(mh *memutils.MemHandler, blobName string) []memutils.Call {
+	calls := []memutils.Call{}
+	for _, c := range mh.CallsFor(memutils.OpStageBlock) {
+		if c.BlobName == blobName {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// tempDir returns a new temp directory and a func to remove it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "blobsync_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestUploadFull(t *testing.T) {
+	bs, mh := newTestBlobSync(t)
+	data := testData(1, 50*testBlockSize+123)
+
+	if err := bs.UploadReaderAt(bytes.NewReader(data), int64(len(data)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	if blob, ok := mh.Blob("cont", "blob"); !ok || !bytes.Equal(blob, data) {
+		t.Fatal("uploaded blob differs from the local data")
+	}
+	if _, ok := mh.Blob("cont", "blob.sig"); !ok {
+		t.Fatal("no signature uploaded")
+	}
+
+	staged := int64(0)
+	for _, c := range stagedFor(mh, "blob") {
+		staged += c.Size
+	}
+	if staged != int64(len(data)) {
+		t.Errorf("staged %d bytes for a %d byte blob", staged, len(data))
+	}
+}
+
+func TestUploadDelta(t *testing.T) {
+	bs, mh := newTestBlobSync(t)
+	data := testData(1, 50*testBlockSize+123)
+	if err := bs.UploadReaderAt(bytes.NewReader(data), int64(len(data)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+
+	mh.ResetCalls()
+	changed := changeData(data, 20)
+	if err := bs.UploadReaderAt(bytes.NewReader(changed), int64(len(changed)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := mh.Blob("cont", "blob"); !bytes.Equal(blob, changed) {
+		t.Fatal("uploaded blob differs from the local data")
+	}
+
+	// only the changed block is uploaded, everything else is reused.
+	staged := stagedFor(mh, "blob")
+	if len(staged) != 1 || staged[0].Size != testBlockSize {
+		t.Errorf("expected just the changed block to be staged, got %+v", staged)
+	}
+	if len(mh.CallsFor(memutils.OpPutBlockList)) != 2 {
+		t.Errorf("expected the blob and its signature to be committed, got %+v", mh.CallsFor(memutils.OpPutBlockList))
+	}
+}
+
+func TestDownloadDelta(t *testing.T) {
+	bs, mh := newTestBlobSync(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	data := testData(1, 50*testBlockSize+123)
+	changed := changeData(data, 20)
+	if err := bs.UploadReaderAt(bytes.NewReader(changed), int64(len(changed)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	localPath := filepath.Join(dir, "local")
+	if err := ioutil.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mh.ResetCalls()
+	if err := bs.Download(localPath, "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, localPath, changed)
+
+	// only the changed block is downloaded from the blob.
+	if len(mh.CallsFor(memutils.OpDownloadBlob)) != 0 {
+		t.Error("blob downloaded in full")
+	}
+	ranges := []memutils.Call{}
+	for _, c := range mh.CallsFor(memutils.OpDownloadBlobRange) {
+		if c.BlobName == "blob" {
+			ranges = append(ranges, c)
+		}
+	}
+	if len(ranges) != 1 || ranges[0].BeginOffset != 20*testBlockSize || ranges[0].EndOffset != 21*testBlockSize-1 {
+		t.Errorf("expected just the changed block to be downloaded, got %+v", ranges)
+	}
+}
+
+// checkDownloaded checks the local file is want, and the .new file has gone.
+func checkDownloaded(t *testing.T, localPath string, want []byte) {
+	downloaded, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, want) {
+		t.Fatal("downloaded file differs from the blob")
+	}
+	if _, err := os.Stat(localPath + ".new"); !os.IsNotExist(err) {
+		t.Errorf(".new file left behind: %v", err)
+	}
+}
+
+func TestDownloadStaleSignature(t *testing.T) {
+	bs, mh := newTestBlobSync(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	data := testData(1, 50*testBlockSize+123)
+	if err := bs.UploadReaderAt(bytes.NewReader(data), int64(len(data)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	localPath := filepath.Join(dir, "local")
+	if err := ioutil.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwritten by something else, the signature no longer describes the blob.
+	overwritten := changeData(data, 20)
+	mh.PutBlob("cont", "blob", overwritten)
+
+	mh.ResetCalls()
+	if err := bs.Download(localPath, "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, localPath, overwritten)
+	if len(mh.CallsFor(memutils.OpDownloadBlob)) != 1 {
+		t.Errorf("expected the blob to be downloaded in full, got %+v", mh.Calls)
+	}
+
+	// a failed download leaves the local file alone.
+	injected := errors.New("injected")
+	mh.PutBlob("cont", "blob", data)
+	mh.OnCall = func(call memutils.Call) error {
+		if call.Op == memutils.OpDownloadBlob {
+			return injected
+		}
+		return nil
+	}
+	if err := bs.Download(localPath, "cont", "blob", false); !errors.Is(err, injected) {
+		t.Fatalf("expected the injected error, got %v", err)
+	}
+	checkDownloaded(t, localPath, overwritten)
+}
+
+func TestRegenerateBlob(t *testing.T) {
+	bs, mh := newTestBlobSync(t)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	data := testData(1, 10*testBlockSize)
+	mh.PutBlob("cont", "blob", data)
+	sig, err := signatures.CreateSignatureFromScratchWithOptions(bytes.NewReader(data), signatures.SignatureOptions{BlockSize: testBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the local copy has the blocks in the opposite order and block 3 missing.
+	local := []byte{}
+	reusable := []signatures.BlockSig{}
+	for _, b := range signatures.ExpandSizeBasedCompleteSignature(*sig) {
+		if b.BlockNo == 3 {
+			continue
+		}
+		b.Offset = int64(len(data) - (b.BlockNo+1)*testBlockSize)
+		reusable = append(reusable, b)
+	}
+	for blockNo := 9; blockNo >= 0; blockNo-- {
+		block := data[blockNo*testBlockSize : (blockNo+1)*testBlockSize]
+		if blockNo == 3 {
+			block = make([]byte, testBlockSize)
+		}
+		local = append(local, block...)
+	}
+	localPath := filepath.Join(dir, "local")
+	if err := ioutil.WriteFile(localPath, local, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	byteRanges, err := bs.GenerateByteRangesOfBlobToDownload(reusable, sig, "cont", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh.ResetCalls()
+	if err := bs.RegenerateBlob("cont", "blob", byteRanges, localPath, reusable, sig); err != nil {
+		t.Fatal(err)
+	}
+
+	regenerated, err := ioutil.ReadFile(localPath + ".new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(regenerated, data) {
+		t.Fatal("regenerated file differs from the blob")
+	}
+	ranges := mh.CallsFor(memutils.OpDownloadBlobRange)
+	if len(ranges) != 1 || ranges[0].BeginOffset != 3*testBlockSize || ranges[0].EndOffset != 4*testBlockSize-1 {
+		t.Errorf("expected just the missing block to be downloaded, got %+v", ranges)
+	}
+}
+
+func TestUploadError(t *testing.T) {
+	bs, mh := newTestBlobSync(t)
+	data := testData(1, 50*testBlockSize+123)
+	if err := bs.UploadReaderAt(bytes.NewReader(data), int64(len(data)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the changed blocks are staged but never committed.
+	injected := errors.New("injected")
+	mh.OnCall = func(call memutils.Call) error {
+		if call.Op == memutils.OpPutBlockList && call.BlobName == "blob" {
+			return injected
+		}
+		return nil
+	}
+	changed := changeData(data, 20)
+	err := bs.UploadReaderAt(bytes.NewReader(changed), int64(len(changed)), "cont", "blob", false)
+	if !errors.Is(err, injected) {
+		t.Fatalf("expected the injected error, got %v", err)
+	}
+	if blob, _ := mh.Blob("cont", "blob"); !bytes.Equal(blob, data) {
+		t.Error("failed upload changed the blob")
+	}
+
+	// nothing was committed, so the next upload is still a delta.
+	mh.OnCall = nil
+	mh.ResetCalls()
+	if err := bs.UploadReaderAt(bytes.NewReader(changed), int64(len(changed)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := mh.Blob("cont", "blob"); !bytes.Equal(blob, changed) {
+		t.Fatal("uploaded blob differs from the local data")
+	}
+	if staged := stagedFor(mh, "blob"); len(staged) != 1 {
+		t.Errorf("expected just the changed block to be staged, got %+v", staged)
+	}
+}
+
+func TestNewSignatureBlockCount(t *testing.T) {
+	bs := NewBlobSyncWithBackend(memutils.NewMemHandler())
+	min := int64(signatures.SignatureSize)
+
+	for _, size := range []int64{
+		targetBlockCount*min - 1, targetBlockCount * min, targetBlockCount*min + 1,
+		MaxBlockCount*min - 1, MaxBlockCount * min, MaxBlockCount*min + 1,
+		MaxBlockCount * DefaultMaxBlockSize / 2,
+	} {
+		opts := bs.sigOptionsForSize(size)
+		blocks := (size + int64(opts.BlockSize) - 1) / int64(opts.BlockSize)
+		if blocks > targetBlockCount {
+			t.Errorf("%d byte file: %d blocks of %d, more than %d", size, blocks, opts.BlockSize, targetBlockCount)
+		}
+		if size <= targetBlockCount*min && opts.BlockSize != int(min) {
+			t.Errorf("%d byte file: block size %d, want the minimum %d", size, opts.BlockSize, min)
+		}
+	}
+}
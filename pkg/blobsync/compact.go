@@ -0,0 +1,215 @@
+package blobsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+const (
+	// DefaultCompactionThreshold is the fragmentation at which delta uploads compact the blob.
+	DefaultCompactionThreshold = 1.5
+
+	// compactionMaxGap is how many full size blocks between two small ones delta uploads will
+	// re-stage to merge them, limiting how much compaction adds to an upload.
+	compactionMaxGap = 4
+)
+
+// SetCompactionThreshold sets the fragmentation (blocks compared to the fewest possible) past which
+// a delta upload also compacts the blob. 0 disables compaction on upload.
+func (bs *BlobSync) SetCompactionThreshold(threshold float64) error {
+	if threshold != 0 && threshold < 1 {
+		return fmt.Errorf("invalid compaction threshold %f, must be 0 (disabled) or at least 1", threshold)
+	}
+	bs.compactionThreshold = threshold
+	return nil
+}
+
+// fragmentation is how many blocks there are compared to the fewest possible, 1 is ideal.
+func fragmentation(blocks []signatures.UploadedBlock, blockSize int) float64 {
+	total := int64(0)
+	for _, block := range blocks {
+		total += block.Size
+	}
+	ideal := (total + int64(blockSize) - 1) / int64(blockSize)
+	if ideal == 0 {
+		return 1
+	}
+	return float64(len(blocks)) / float64(ideal)
+}
+
+// needsCompaction checks if blocks are fragmented enough to compact. Content defined blocks
+// are never compacted, their sizes are meant to vary (and deltas dont fragment them).
+func (bs BlobSync) needsCompaction(blocks []signatures.UploadedBlock, opts signatures.SignatureOptions) bool {
+	return bs.compactionThreshold != 0 && opts.Chunking != signatures.ChunkingCDC &&
+		fragmentation(blocks, opts.BlockSize) > bs.compactionThreshold
+}
+
+// compactBlocks re-stages runs of undersized blocks as opts.BlockSize blocks, reading the data from source.
+// A run goes from one small block to another, including up to maxGap full size blocks between
+// them (any number if maxGap is negative), and is only re-staged if that means fewer blocks.
+// blocks must be in offset order. Nothing is committed.
+func (bs BlobSync) compactBlocks(ctx context.Context, blocks []signatures.UploadedBlock, source io.ReaderAt,
+	opts signatures.SignatureOptions, maxGap int, containerName string, blobName string) ([]signatures.UploadedBlock, error) {
+
+	isSmall := func(block signatures.UploadedBlock) bool {
+		return block.Size < int64(opts.BlockSize)
+	}
+
+	compacted := []signatures.UploadedBlock{}
+	buffer := make([]byte, opts.BlockSize)
+	for i := 0; i < len(blocks); {
+		if !isSmall(blocks[i]) {
+			compacted = append(compacted, blocks[i])
+			i++
+			continue
+		}
+
+		// extend the run [i, j) to the next small block for as long as there is one close enough.
+		j := i + 1
+		for {
+			k := j
+			for k < len(blocks) && !isSmall(blocks[k]) && (maxGap < 0 || k-j < maxGap) {
+				k++
+			}
+			if k == len(blocks) || !isSmall(blocks[k]) {
+				break
+			}
+			j = k + 1
+		}
+
+		runSize := int64(0)
+		for _, block := range blocks[i:j] {
+			runSize += block.Size
+		}
+
+		// nothing to gain.
+		if (runSize+int64(opts.BlockSize)-1)/int64(opts.BlockSize) >= int64(j-i) {
+			compacted = append(compacted, blocks[i:j]...)
+			i = j
+			continue
+		}
+
+		offset := blocks[i].Offset
+		end := offset + runSize
+		for offset < end {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			size := end - offset
+			if size > int64(opts.BlockSize) {
+				size = int64(opts.BlockSize)
+			}
+			if _, err := source.ReadAt(buffer[:size], offset); err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			uploadedBlock, err := bs.writeBytes(ctx, offset, int(size), buffer[:size], opts, containerName, blobName, compacted)
+			if err != nil {
+				return nil, err
+			}
+			compacted = append(compacted, *uploadedBlock)
+			offset += size
+		}
+		i = j
+	}
+	return compacted, nil
+}
+
+// blobReaderAt reads a blob through the backend, for compacting without the local file.
+type blobReaderAt struct {
+	ctx           context.Context
+	blobHandler   Backend
+	containerName string
+	blobName      string
+}
+
+func (r blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buffer := bytes.Buffer{}
+	err := r.blobHandler.DownloadBlobRange(r.ctx, &buffer, r.containerName, r.blobName, off, off+int64(len(p))-1)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, buffer.Bytes())
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Compact rewrites the blob with the undersized blocks left by delta uploads merged into full size
+// blocks, regardless of the compaction threshold. Only the runs of blocks between small ones are
+// downloaded and uploaded again, and the signature is updated to match.
+func (bs BlobSync) Compact(containerName string, blobName string) error {
+	return bs.CompactContext(context.Background(), containerName, blobName)
+}
+
+// CompactContext is Compact but gives up when ctx is cancelled, leaving the blob untouched.
+func (bs BlobSync) CompactContext(ctx context.Context, containerName string, blobName string) error {
+
+	sig, err := bs.DownloadSignatureForBlobContext(ctx, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	opts := sig.SignatureOptions
+	if opts.Chunking == signatures.ChunkingCDC {
+		return nil
+	}
+
+	// the blocks of the sig have to be the blobs blocks.
+	if _, err := bs.checkSignature(ctx, sig, containerName, blobName); err != nil {
+		return fmt.Errorf("cannot compact blob %s: %w", blobName, err)
+	}
+	if sig.Blob != nil && sig.Blob.Regenerated {
+		return fmt.Errorf("cannot compact blob %s, upload it again first: %w", blobName, errSignatureRegenerated)
+	}
+
+	blocks := []signatures.UploadedBlock{}
+	for _, blockSig := range signatures.ExpandSizeBasedCompleteSignature(*sig) {
+		blockID := opts.StrongAlgorithm.BlockID(blockSig.StrongSig)
+		blocks = append(blocks, signatures.UploadedBlock{BlockID: blockID, Offset: blockSig.Offset, Size: int64(blockSig.Size), Sig: blockSig, IsNew: false})
+	}
+
+	source := blobReaderAt{ctx: ctx, blobHandler: bs.blobHandler, containerName: containerName, blobName: blobName}
+	compacted, err := bs.compactBlocks(ctx, blocks, source, opts, -1, containerName, blobName)
+	if err != nil {
+		return fmt.Errorf("cannot compact blob %s: %w", blobName, err)
+	}
+	if len(compacted) == len(blocks) {
+		return nil
+	}
+
+	err = bs.blobHandler.PutBlockList(ctx, compacted, containerName, blobName)
+	if err != nil {
+		return fmt.Errorf("cannot compact blob %s: %w", blobName, err)
+	}
+
+	newSig, err := signatures.CreateSignatureFromNewAndReusedBlocks(compacted)
+	if err != nil {
+		return err
+	}
+	newSig.SignatureOptions = opts
+
+	// same content, but a new ETag.
+	if sig.Blob != nil {
+		props, err := bs.blobHandler.GetBlobProperties(ctx, containerName, blobName)
+		if err != nil {
+			return err
+		}
+		blobInfo := *sig.Blob
+		blobInfo.ETag = props.ETag
+		newSig.Blob = &blobInfo
+	}
+	err = bs.uploadSig(ctx, newSig, containerName, blobName)
+	if err != nil {
+		return fmt.Errorf("cannot upload signature for blob %s: %w", blobName, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package blobsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/memutils"
+)
+
+// committedBlocks returns how many blocks the blob is made of.
+func committedBlocks(t *testing.T, mh *memutils.MemHandler, blobName string) int {
+	committed, _, err := mh.GetBlockList(context.Background(), "cont", blobName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(committed)
+}
+
+// insertData is data with a few bytes inserted in the middle of block blockNo.
+func insertData(data []byte, blockNo int) []byte {
+	offset := blockNo*testBlockSize + 500
+	inserted := append([]byte{}, data[:offset]...)
+	inserted = append(inserted, testData(int64(blockNo), 10)...)
+	return append(inserted, data[offset:]...)
+}
+
+func TestCompact(t *testing.T) {
+	bs, mh := newTestBlobSync(t)
+	if err := bs.SetCompactionThreshold(0); err != nil {
+		t.Fatal(err)
+	}
+
+	data := testData(1, 50*testBlockSize)
+	if err := bs.UploadReaderAt(bytes.NewReader(data), int64(len(data)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// each insert splits a block in two.
+	for _, blockNo := range []int{40, 30, 20, 10, 5} {
+		data = insertData(data, blockNo)
+		if err := bs.UploadReaderAt(bytes.NewReader(data), int64(len(data)), "cont", "blob", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fragmented := committedBlocks(t, mh, "blob")
+	ideal := (len(data) + testBlockSize - 1) / testBlockSize
+	if fragmented < ideal+3 {
+		t.Fatalf("blob has %d blocks after the inserts, the ideal is %d, the test isnt testing much", fragmented, ideal)
+	}
+
+	if err := bs.Compact("cont", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := mh.Blob("cont", "blob"); !bytes.Equal(blob, data) {
+		t.Fatal("compaction changed the blob")
+	}
+	if compacted := committedBlocks(t, mh, "blob"); compacted != ideal {
+		t.Errorf("compacted from %d blocks to %d, want %d", fragmented, compacted, ideal)
+	}
+
+	// the signature describes the compacted blocks, so a change is still a one block delta.
+	mh.ResetCalls()
+	changed := changeData(data, 25)
+	if err := bs.UploadReaderAt(bytes.NewReader(changed), int64(len(changed)), "cont", "blob", false); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := mh.Blob("cont", "blob"); !bytes.Equal(blob, changed) {
+		t.Fatal("uploaded blob differs from the local data")
+	}
+	if staged := stagedFor(mh, "blob"); len(staged) != 1 || staged[0].Size != testBlockSize {
+		t.Errorf("expected just the changed block to be staged, got %+v", staged)
+	}
+
+	// and compacting an already compact blob does nothing.
+	mh.ResetCalls()
+	if err := bs.Compact("cont", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mh.CallsFor(memutils.OpPutBlockList)) != 0 {
+		t.Errorf("compact blob committed again: %+v", mh.CallsFor(memutils.OpPutBlockList))
+	}
+}
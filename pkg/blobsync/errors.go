@@ -0,0 +1,26 @@
+package blobsync
+
+import (
+	"errors"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// Errors returned by BlobSync (and the backends). Check with errors.Is, eg.
+// errors.Is(err, blobsync.ErrSignatureNotFound) means the blob has no usable .sig and a full upload is needed.
+var (
+	ErrSignatureNotFound  = signatures.ErrSignatureNotFound
+	ErrSignatureCorrupt   = signatures.ErrSignatureCorrupt
+	ErrSignatureStale     = signatures.ErrSignatureStale
+	ErrBlobNotFound       = signatures.ErrBlobNotFound
+	ErrPreconditionFailed = signatures.ErrPreconditionFailed
+	ErrTransient          = signatures.ErrTransient
+)
+
+// errSignatureOptionsChanged means the existing signature was made with other options than
+// those asked for, so the blob gets uploaded in full instead of as a delta.
+var errSignatureOptionsChanged = errors.New("signature options changed")
+
+// errTooManyBlocks means a delta upload would leave the blob with more than MaxBlockCount blocks,
+// so it gets uploaded in full instead (with a block size to suit).
+var errTooManyBlocks = errors.New("too many blocks")
@@ -0,0 +1,77 @@
+package blobsync
+
+import (
+	"io"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// how much localWindow reads at a time, when not mmapped.
+const localReadAhead = 8 * 1024 * 1024
+
+// localData is the local copy being synced, the first size bytes of r. Read straight from memory if it
+// could be mmapped, otherwise with ReadAt a piece at a time.
+type localData struct {
+	r    io.ReaderAt
+	size int64
+
+	mapped []byte
+	unmap  func() error
+}
+
+func openLocalData(r io.ReaderAt, size int64) localData {
+	d := localData{r: r, size: size}
+	d.mapped, d.unmap, _ = signatures.MapReaderAt(r, size)
+	return d
+}
+
+func (d localData) isMapped() bool {
+	return d.unmap != nil
+}
+
+func (d localData) Close() error {
+	if d.unmap != nil {
+		return d.unmap()
+	}
+	return nil
+}
+
+// slice is bytes begin to end (exclusive). Straight from the mapping, or read into a new buffer.
+func (d localData) slice(begin int64, end int64) ([]byte, error) {
+	if d.isMapped() {
+		return d.mapped[begin:end], nil
+	}
+	buf := make([]byte, end-begin)
+	if err := signatures.ReadFullAt(d.r, buf, begin); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// localWindow goes through localData in order a view at a time, reading ahead so lots of small views arent lots
+// of small reads. Buffers are never reused, so views stay valid after the window moves on.
+type localWindow struct {
+	data  localData
+	buf   []byte
+	start int64
+}
+
+// view is bytes begin to end (exclusive).
+func (w *localWindow) view(begin int64, end int64) ([]byte, error) {
+	if begin < w.start || end > w.start+int64(len(w.buf)) {
+		readEnd := begin + localReadAhead
+		if readEnd < end {
+			readEnd = end
+		}
+		if readEnd > w.data.size {
+			readEnd = w.data.size
+		}
+		buf, err := w.data.slice(begin, readEnd)
+		if err != nil {
+			return nil, err
+		}
+		w.buf = buf
+		w.start = begin
+	}
+	return w.buf[begin-w.start : end-w.start], nil
+}
@@ -0,0 +1,376 @@
+package blobsync
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+const (
+	// searchChunkSize is how many offsets of a byte range a worker searches at a time.
+	searchChunkSize = 8 * 1024 * 1024
+
+	// how many offsets are searched between checks for cancellation.
+	searchCancelCheckInterval = 64 * 1024
+)
+
+// DefaultSearchWorkers is the number of goroutines searching a local file unless told otherwise.
+func DefaultSearchWorkers() int {
+	return runtime.NumCPU()
+}
+
+// SetSearchWorkers sets how many goroutines search the local file for blocks, 1 to do it sequentially.
+func (bs *BlobSync) SetSearchWorkers(workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid number of search workers %d", workers)
+	}
+	bs.searchWorkers = workers
+	return nil
+}
+
+// parallelFor calls fn for 0 to n-1 on up to workers goroutines. Returns the error of the lowest i that failed.
+func parallelFor(workers int, n int, fn func(i int) error) error {
+	errs := make([]error, n)
+	next := int64(-1)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollingScanner looks for blocks of one size in the local data, by rolling checksum then strong hash.
+type rollingScanner struct {
+	data        localData
+	sigLUT      map[signatures.RollingSignature][]signatures.BlockSig
+	sigFilter   signatures.RollingFilter
+	rollingHash signatures.RollingHash
+	opts        signatures.SignatureOptions
+	windowSize  int64
+}
+
+func newRollingScanner(data localData, sig signatures.CompleteSignature, opts signatures.SignatureOptions, sigSize int64) rollingScanner {
+	return rollingScanner{
+		data:        data,
+		sigLUT:      generateBlockLUTFromBlockSigs(sig.SignatureList),
+		sigFilter:   signatures.NewRollingFilter(sig.SignatureList),
+		rollingHash: signatures.NewRollingHash(opts.RollingAlgorithm, sigSize),
+		opts:        opts,
+		windowSize:  sigSize,
+	}
+}
+
+// match checks block (at offset, with rolling checksum rollingSig) against the signature. Only called once
+// sigFilter says it might match, the filter is checked in the scan loops so most offsets dont even make a call.
+func (s rollingScanner) match(block []byte, offset int64, rollingSig signatures.RollingSignature) (signatures.BlockSig, bool) {
+	candidates, ok := s.sigLUT[rollingSig]
+	if !ok {
+		return signatures.BlockSig{}, false
+	}
+	strongSig := signatures.CreateStrongSignature(block, s.opts.StrongAlgorithm)
+	blockSig, found := getMatchingStrongSig(candidates, strongSig)
+
+	// a copy of the sig, with the LOCAL offset.
+	blockSig.Offset = offset
+	return blockSig, found
+}
+
+// windows is the bytes of every window starting from start up to (not including) stop.
+func (s rollingScanner) windows(start int64, stop int64) ([]byte, error) {
+	return s.data.slice(start, stop+s.windowSize-1)
+}
+
+// searchMatch is a block found by scan, from is where the scan that found it started (just after the
+// previous match). No offset from from to the match (exclusive) matches anything.
+type searchMatch struct {
+	from int64
+	sig  signatures.BlockSig
+}
+
+// scan searches offsets from start up to (not including) stop for exclusive matches, skipping over each block found.
+// Returns the matches and the offset the search carries on from (at or after stop).
+// Every offset searched must have a whole window after it.
+func (s rollingScanner) scan(ctx context.Context, start int64, stop int64) ([]searchMatch, int64, error) {
+	matches := []searchMatch{}
+	if start >= stop {
+		return matches, start, nil
+	}
+	buf, err := s.windows(start, stop)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// i is relative to start.
+	from := start
+	n := stop - start
+	i := int64(0)
+	fresh := true
+	var rollingSig signatures.RollingSignature
+	for count := 0; i < n; count++ {
+		if count%searchCancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		if fresh {
+			rollingSig = s.rollingHash.Sum(buf[i : i+s.windowSize])
+			fresh = false
+		} else {
+			rollingSig = s.rollingHash.Roll(buf[i-1], buf[i+s.windowSize-1], rollingSig)
+		}
+
+		if !s.sigFilter.MayContain(rollingSig) {
+			i++
+			continue
+		}
+		if blockSig, ok := s.match(buf[i:i+s.windowSize], start+i, rollingSig); ok {
+			matches = append(matches, searchMatch{from: from, sig: blockSig})
+			i += s.windowSize
+			from = start + i
+			fresh = true
+		} else {
+			i++
+		}
+	}
+	return matches, start + i, nil
+}
+
+// searchChunk is part of a byte range, searched on its own from start as if nothing before it matched.
+type searchChunk struct {
+	// which byte range (or for all matches, which block size) the chunk is part of.
+	index int
+	start int64
+	stop  int64
+
+	matches []searchMatch
+
+	// where the search carries on after the chunk, and where the scan with no matches up to it started.
+	next     int64
+	tailFrom int64
+}
+
+// splitSearch splits offsets start to stop (exclusive) into chunks of chunkSize, or at least minChunkSize.
+func splitSearch(index int, start int64, stop int64, chunkSize int64, minChunkSize int64) []searchChunk {
+	if chunkSize < minChunkSize {
+		chunkSize = minChunkSize
+	}
+	chunks := []searchChunk{}
+	for ; start < stop; start += chunkSize {
+		end := start + chunkSize
+		if end > stop {
+			end = stop
+		}
+		chunks = append(chunks, searchChunk{index: index, start: start, stop: end})
+	}
+	return chunks
+}
+
+// scanChunk searches chunk on its own, for mergeChunks to join up with the chunks before it.
+func (s rollingScanner) scanChunk(ctx context.Context, chunk *searchChunk) error {
+	matches, next, err := s.scan(ctx, chunk.start, chunk.stop)
+	if err != nil {
+		return err
+	}
+	chunk.matches = matches
+	chunk.next = next
+	chunk.tailFrom = chunk.start
+	if len(matches) > 0 {
+		last := matches[len(matches)-1].sig
+		chunk.tailFrom = last.Offset + s.windowSize
+	}
+	return nil
+}
+
+// mergeChunks joins the separately searched chunks of a byte range into what a single search from the start of
+// the range finds. Where the search from the start lands on an offset a chunk also searched, the rest of the chunk
+// is the same, otherwise (it lands within a block the chunk skipped) it searches on until it does.
+func (s rollingScanner) mergeChunks(ctx context.Context, chunks []searchChunk) ([]signatures.BlockSig, error) {
+	matches := []signatures.BlockSig{}
+	if len(chunks) == 0 {
+		return matches, nil
+	}
+
+	offset := chunks[0].start
+	for _, chunk := range chunks {
+		for offset < chunk.stop {
+			i := sort.Search(len(chunk.matches), func(i int) bool {
+				return chunk.matches[i].sig.Offset >= offset
+			})
+
+			// in step with the chunk.
+			if i < len(chunk.matches) && chunk.matches[i].from <= offset {
+				for _, m := range chunk.matches[i:] {
+					matches = append(matches, m.sig)
+				}
+				offset = chunk.next
+				break
+			}
+			if i == len(chunk.matches) && chunk.tailFrom <= offset {
+				offset = chunk.next
+				break
+			}
+
+			// within a block the chunk skipped, search up to where the chunk started searching again.
+			syncOffset := chunk.tailFrom
+			if i < len(chunk.matches) {
+				syncOffset = chunk.matches[i].from
+			}
+			if syncOffset > chunk.stop {
+				syncOffset = chunk.stop
+			}
+			found, next, err := s.scan(ctx, offset, syncOffset)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range found {
+				matches = append(matches, m.sig)
+			}
+			offset = next
+		}
+	}
+	return matches, nil
+}
+
+// searchRanges finds exclusive matches in the byte ranges worth searching as per opts, up to maxMatches of them
+// (negative for no limit), with the ranges split into chunks that are searched in parallel.
+// Returns what is left of the ranges and the blocks found.
+func (s rollingScanner) searchRanges(ctx context.Context, remainingByteList []signatures.RemainingBytes, opts SearchOptions,
+	maxMatches int, chunkSize int64, workers int) ([]signatures.RemainingBytes, []signatures.BlockSig, error) {
+	chunks := []searchChunk{}
+	searched := make([]bool, len(remainingByteList))
+	for i, byteRange := range remainingByteList {
+		byteRangeSize := byteRange.EndOffset - byteRange.BeginOffset + 1
+
+		if opts.searches(byteRangeSize, s.windowSize) {
+			searched[i] = true
+			chunks = append(chunks, splitSearch(i, byteRange.BeginOffset, byteRange.EndOffset-s.windowSize+2, chunkSize, 4*s.windowSize)...)
+		}
+	}
+
+	err := parallelFor(workers, len(chunks), func(i int) error {
+		return s.scanChunk(ctx, &chunks[i])
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newRemainingBytes := []signatures.RemainingBytes{}
+	signaturesToReuse := []signatures.BlockSig{}
+	nextChunk := 0
+	for i, byteRange := range remainingByteList {
+		if !searched[i] {
+			newRemainingBytes = append(newRemainingBytes, byteRange)
+			continue
+		}
+
+		// chunks are in range order.
+		end := nextChunk
+		for end < len(chunks) && chunks[end].index == i {
+			end++
+		}
+		matches, err := s.mergeChunks(ctx, chunks[nextChunk:end])
+		nextChunk = end
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// past the limit the rest of the range is left as is.
+		if maxMatches >= 0 && len(signaturesToReuse)+len(matches) > maxMatches {
+			matches = matches[:maxMatches-len(signaturesToReuse)]
+		}
+
+		oldEndOffset := byteRange.BeginOffset
+		for _, blockSig := range matches {
+			if oldEndOffset != blockSig.Offset {
+				newRemainingBytes = append(newRemainingBytes, signatures.RemainingBytes{BeginOffset: oldEndOffset, EndOffset: blockSig.Offset - 1})
+			}
+			oldEndOffset = blockSig.Offset + s.windowSize
+		}
+		if oldEndOffset <= byteRange.EndOffset {
+			newRemainingBytes = append(newRemainingBytes, signatures.RemainingBytes{BeginOffset: oldEndOffset, EndOffset: byteRange.EndOffset})
+		}
+		signaturesToReuse = append(signaturesToReuse, matches...)
+	}
+	return newRemainingBytes, signaturesToReuse, nil
+}
+
+// searchAllMatches finds every distinct block of each size worth searching the file for, as per strategy.
+// Every size searches the whole file, so all of them are searched at once.
+func searchAllMatches(ctx context.Context, data localData, sig signatures.SizeBasedCompleteSignature, strategy SearchStrategy,
+	fileLength int64, chunkSize int64, workers int) ([]signatures.BlockSig, error) {
+
+	scanners := []rollingScanner{}
+	chunks := []searchChunk{}
+	for _, sigSize := range getSignatureSizesDescending(sig) {
+		size := int64(sigSize)
+		if !strategy.searchesFile(fileLength, size) {
+			continue
+		}
+		scanners = append(scanners, newRollingScanner(data, sig.Signatures[sigSize], sig.SignatureOptions, size))
+		chunks = append(chunks, splitSearch(len(scanners)-1, 0, fileLength-size+1, chunkSize, 4*size)...)
+	}
+
+	err := parallelFor(workers, len(chunks), func(i int) error {
+		return scanners[chunks[i].index].scanChunk(ctx, &chunks[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// chunks are in size then offset order. Any local copy of a block will do, so only the first is kept.
+	// Otherwise repetitive data (eg. the zeroed parts of a disk image) finds the same block over and over.
+	seen := make(map[signatures.StrongHash]bool)
+	signaturesToReuse := []signatures.BlockSig{}
+	smallMatches := 0
+	for start := 0; start < len(chunks); {
+		end := start
+		for end < len(chunks) && chunks[end].index == chunks[start].index {
+			end++
+		}
+		scanner := scanners[chunks[start].index]
+		matches, err := scanner.mergeChunks(ctx, chunks[start:end])
+		start = end
+		if err != nil {
+			return nil, err
+		}
+
+		distinct := []signatures.BlockSig{}
+		for _, blockSig := range matches {
+			if !seen[blockSig.StrongSig] {
+				seen[blockSig.StrongSig] = true
+				distinct = append(distinct, blockSig)
+			}
+		}
+		if scanner.windowSize < int64(sig.BlockSize) {
+			if limit := strategy.smallBlockLimit(smallMatches); limit >= 0 && len(distinct) > limit {
+				distinct = distinct[:limit]
+			}
+			smallMatches += len(distinct)
+		}
+		signaturesToReuse = append(signaturesToReuse, distinct...)
+	}
+	return signaturesToReuse, nil
+}
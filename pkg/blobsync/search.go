@@ -1,11 +1,9 @@
 package blobsync
 
 import (
-	"fmt"
-	"github.com/edsrzf/mmap-go"
-	"github.com/kpfaulkner/blobsyncgo/pkg/azureutils"
+	"context"
+	"io"
 	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
-	"log"
 	"os"
 	"sort"
 )
@@ -21,76 +19,160 @@ func getSignatureSizesDescending(  sig signatures.SizeBasedCompleteSignature) []
 	return l
 }
 
+// SearchStrategy is how the search matches the blocks of a signature against a local file.
+type SearchStrategy struct {
+	// AllMatches finds every distinct block anywhere in the file, every block size searches the whole file
+	// and only the first local copy of each block is kept. Fine for downloads, where any copy will do.
+	// Otherwise each size only searches what the larger sizes left, so no matches overlap. Uploads need
+	// that, the new blob is made of the matches and the ranges between.
+	// Either way the search skips past each block it finds.
+	AllMatches bool
+
+	SearchOptions
+}
+
+// UploadSearchStrategy is the strategy for uploads, exclusive matches.
+func UploadSearchStrategy(opts SearchOptions) SearchStrategy {
+	return SearchStrategy{SearchOptions: opts}
+}
+
+// DownloadSearchStrategy is the strategy for downloads, all distinct matches.
+func DownloadSearchStrategy(opts SearchOptions) SearchStrategy {
+	return SearchStrategy{AllMatches: true, SearchOptions: opts}
+}
+
 // hardest part...
 // Search local file for all the data that is already in azure blob storage.
 // Then determine which parts need to be uploaded.
-func SearchLocalFileForSignature( localFile *os.File, sig signatures.SizeBasedCompleteSignature) (*signatures.SignatureSearchResults, error) {
+func SearchLocalFileForSignature(localFile *os.File, sig signatures.SizeBasedCompleteSignature) (*signatures.SignatureSearchResults, error) {
+	return SearchLocalFileForSignatureContext(context.Background(), localFile, sig)
+}
 
-	searchResults := signatures.NewSignatureSearchResults()
-  stats, err := localFile.Stat()
-  if err != nil {
-  	return nil, err
-  }
-
-  fileLength := stats.Size()
-
-  // signatures we can use.
-  signaturesToReuse := []signatures.BlockSig{}
-  signatureSizesArray := getSignatureSizesDescending(sig)
-
-  remainingByteList := []signatures.RemainingBytes{}
-  remainingByteList = append(remainingByteList, signatures.RemainingBytes{ BeginOffset: 0, EndOffset: fileLength - 1})
-
-  for _,sigSize := range signatureSizesArray {
-
-  	// get all sigs of a particular size.
-  	sigs := sig.Signatures[sigSize]
-  	newRemainingByteList, newSignaturesToReuse, err := searchLocalFileForSignaturesOfGivenSize( sigs, localFile, remainingByteList, int64(sigSize), fileLength)
-  	if err != nil {
-  		return nil, err
-	  }
-	  signaturesToReuse = append(signaturesToReuse, newSignaturesToReuse...)
-  	remainingByteList = newRemainingByteList
-  }
-
-  searchResults.ByteRangesToUpload = remainingByteList
-  searchResults.SignaturesToReuse = signaturesToReuse
-	return &searchResults, nil
+// SearchLocalFileForSignatureContext is SearchLocalFileForSignature but stops when ctx is cancelled.
+func SearchLocalFileForSignatureContext(ctx context.Context, localFile *os.File, sig signatures.SizeBasedCompleteSignature) (*signatures.SignatureSearchResults, error) {
+	return SearchLocalFileWithStrategy(ctx, localFile, sig, UploadSearchStrategy(DefaultSearchOptions()), 1)
+}
+
+// SearchLocalFileForSignatureParallel is SearchLocalFileForSignatureContext with the search split across
+// workers goroutines. The results are identical.
+func SearchLocalFileForSignatureParallel(ctx context.Context, localFile *os.File, sig signatures.SizeBasedCompleteSignature, workers int) (*signatures.SignatureSearchResults, error) {
+	return SearchLocalFileWithStrategy(ctx, localFile, sig, UploadSearchStrategy(DefaultSearchOptions()), workers)
 }
 
 // hardest part...
 // Search local file for all the data that is already in azure blob storage.
 // Then determine which parts are already local and do NOT need to be downloaded again.
-func SearchLocalFileForSignatureForDownload( localFile *os.File, sig signatures.SizeBasedCompleteSignature) (*signatures.SignatureSearchResults, error) {
+func SearchLocalFileForSignatureForDownload(localFile *os.File, sig signatures.SizeBasedCompleteSignature) (*signatures.SignatureSearchResults, error) {
+	return SearchLocalFileForSignatureForDownloadContext(context.Background(), localFile, sig)
+}
+
+// SearchLocalFileForSignatureForDownloadContext is SearchLocalFileForSignatureForDownload but stops when ctx is cancelled.
+func SearchLocalFileForSignatureForDownloadContext(ctx context.Context, localFile *os.File, sig signatures.SizeBasedCompleteSignature) (*signatures.SignatureSearchResults, error) {
+	return SearchLocalFileWithStrategy(ctx, localFile, sig, DownloadSearchStrategy(DefaultSearchOptions()), 1)
+}
+
+// SearchLocalFileForSignatureForDownloadParallel is SearchLocalFileForSignatureForDownloadContext with the
+// search split across workers goroutines. The results are identical.
+func SearchLocalFileForSignatureForDownloadParallel(ctx context.Context, localFile *os.File, sig signatures.SizeBasedCompleteSignature, workers int) (*signatures.SignatureSearchResults, error) {
+	return SearchLocalFileWithStrategy(ctx, localFile, sig, DownloadSearchStrategy(DefaultSearchOptions()), workers)
+}
+
+// SearchLocalFileWithStrategy searches localFile for the blocks of sig, see SearchReaderAt.
+func SearchLocalFileWithStrategy(ctx context.Context, localFile *os.File, sig signatures.SizeBasedCompleteSignature,
+	strategy SearchStrategy, workers int) (*signatures.SignatureSearchResults, error) {
 
-	searchResults := signatures.NewSignatureSearchResults()
 	stats, err := localFile.Stat()
 	if err != nil {
 		return nil, err
 	}
+	return SearchReaderAt(ctx, localFile, stats.Size(), sig, strategy, workers)
+}
 
-	fileLength := stats.Size()
+// SearchReaderAt searches the first size bytes of r for the blocks of sig, on up to workers goroutines (the
+// results are the same however many). SignaturesToReuse are the blocks found, with their offsets in r, and
+// ByteRangesToUpload the parts of r none of them cover. Files are mmapped if possible, anything else
+// (eg. data in memory, or a file that cant be mmapped) is read a piece at a time.
+func SearchReaderAt(ctx context.Context, r io.ReaderAt, size int64, sig signatures.SizeBasedCompleteSignature,
+	strategy SearchStrategy, workers int) (*signatures.SignatureSearchResults, error) {
 
-	// signatures we can use.
-	signaturesToReuse := []signatures.BlockSig{}
-	signatureSizesArray := getSignatureSizesDescending(sig)
+	data := openLocalData(r, size)
+	defer data.Close()
+	return searchLocalData(ctx, data, sig, strategy, workers)
+}
 
-	remainingByteList := []signatures.RemainingBytes{}
-	remainingByteList = append(remainingByteList, signatures.RemainingBytes{ BeginOffset: 0, EndOffset: fileLength - 1})
+func searchLocalData(ctx context.Context, data localData, sig signatures.SizeBasedCompleteSignature,
+	strategy SearchStrategy, workers int) (*signatures.SignatureSearchResults, error) {
+
+	// a single worker searches each byte range in one go, more split them up to share the work.
+	// Unless it isnt mmapped, then chunks are what is read into memory at a time.
+	chunkSize := int64(searchChunkSize)
+	if workers <= 1 {
+		workers = 1
+		if data.isMapped() {
+			chunkSize = data.size
+		}
+	}
+	return searchLocalDataInChunks(ctx, data, sig, strategy, chunkSize, workers)
+}
+
+// searchLocalDataInChunks is searchLocalData with the byte ranges split into chunks of chunkSize.
+func searchLocalDataInChunks(ctx context.Context, data localData, sig signatures.SizeBasedCompleteSignature,
+	strategy SearchStrategy, chunkSize int64, workers int) (*signatures.SignatureSearchResults, error) {
+
+	searchResults := signatures.NewSignatureSearchResults()
+	fileLength := data.size
+	searchResults.FileSize = fileLength
 
-	for _,sigSize := range signatureSizesArray {
+	// empty file, nothing to reuse or upload.
+	if fileLength == 0 {
+		return &searchResults, nil
+	}
+
+	// content defined blocks, just chunk the file the same way and look each one up. Chunks dont overlap
+	// so all matches are exclusive anyway.
+	if sig.Chunking == signatures.ChunkingCDC {
+		remainingByteList, signaturesToReuse, err := searchLocalFileByChunks(ctx, sig, data)
+		if err != nil {
+			return nil, err
+		}
+		searchResults.ByteRangesToUpload = remainingByteList
+		searchResults.SignaturesToReuse = signaturesToReuse
+		return &searchResults, nil
+	}
 
-		// get all sigs of a particular size.
-		sigs := sig.Signatures[sigSize]
+	if strategy.AllMatches {
+		signaturesToReuse, err := searchAllMatches(ctx, data, sig, strategy, fileLength, chunkSize, workers)
+		if err != nil {
+			return nil, err
+		}
+		searchResults.ByteRangesToUpload = uncoveredByteRanges(fileLength, signaturesToReuse)
+		searchResults.SignaturesToReuse = signaturesToReuse
+		return &searchResults, nil
+	}
 
-		// if sigsize <= 100 then just copy the bytes...  maybe even do for 1000?
-		if sigSize > 100 {
-			newSignaturesToReuse, err := searchLocalFileForSignaturesOfGivenSizeForDownload(sigs, localFile, int64(sigSize))
-			if err != nil {
-				return nil, err
+	// each size searches what the larger ones left, so sizes are done one after the other.
+	signaturesToReuse := []signatures.BlockSig{}
+	remainingByteList := []signatures.RemainingBytes{{BeginOffset: 0, EndOffset: fileLength - 1}}
+	smallMatches := 0
+	for _, sigSize := range getSignatureSizesDescending(sig) {
+		limit := -1
+		if sigSize < sig.BlockSize {
+			limit = strategy.smallBlockLimit(smallMatches)
+			if limit == 0 {
+				break
 			}
-			signaturesToReuse = append(signaturesToReuse, newSignaturesToReuse...)
 		}
+
+		scanner := newRollingScanner(data, sig.Signatures[sigSize], sig.SignatureOptions, int64(sigSize))
+		newRemainingByteList, newSignaturesToReuse, err := scanner.searchRanges(ctx, remainingByteList, strategy.SearchOptions, limit, chunkSize, workers)
+		if err != nil {
+			return nil, err
+		}
+		if sigSize < sig.BlockSize {
+			smallMatches += len(newSignaturesToReuse)
+		}
+		signaturesToReuse = append(signaturesToReuse, newSignaturesToReuse...)
+		remainingByteList = newRemainingByteList
 	}
 
 	searchResults.ByteRangesToUpload = remainingByteList
@@ -98,6 +180,80 @@ func SearchLocalFileForSignatureForDownload( localFile *os.File, sig signatures.
 	return &searchResults, nil
 }
 
+// uncoveredByteRanges is the parts of a file of fileLength that none of blockSigs cover.
+func uncoveredByteRanges(fileLength int64, blockSigs []signatures.BlockSig) []signatures.RemainingBytes {
+	sorted := append([]signatures.BlockSig{}, blockSigs...)
+	sort.Slice(sorted, func(i int, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	remainingByteList := []signatures.RemainingBytes{}
+	offset := int64(0)
+	for _, blockSig := range sorted {
+		if blockSig.Offset > offset {
+			remainingByteList = append(remainingByteList, signatures.RemainingBytes{BeginOffset: offset, EndOffset: blockSig.Offset - 1})
+		}
+		if end := blockSig.Offset + int64(blockSig.Size); end > offset {
+			offset = end
+		}
+	}
+	if offset < fileLength {
+		remainingByteList = append(remainingByteList, signatures.RemainingBytes{BeginOffset: offset, EndOffset: fileLength - 1})
+	}
+	return remainingByteList
+}
+
+// searchLocalFileByChunks splits the local file into content defined blocks, as per the signature,
+// and reuses any block the signature already has. No rolling search needed, since unchanged data
+// gets the same block boundaries wherever it has moved to.
+func searchLocalFileByChunks(ctx context.Context, sig signatures.SizeBasedCompleteSignature,
+	data localData) ([]signatures.RemainingBytes, []signatures.BlockSig, error) {
+
+	blockLUT := make(map[signatures.StrongHash]signatures.BlockSig)
+	for _, sigs := range sig.Signatures {
+		for _, bs := range sigs.SignatureList {
+			blockLUT[bs.StrongSig] = bs
+		}
+	}
+
+	chunker := signatures.NewChunker(sig.SignatureOptions)
+	maxBlockSize := int64(chunker.MaxBlockSize())
+	window := localWindow{data: data}
+	remainingByteList := []signatures.RemainingBytes{}
+	signaturesToReuse := []signatures.BlockSig{}
+	offset := int64(0)
+	for offset < data.size {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		// the chunker never looks past the largest block.
+		end := offset + maxBlockSize
+		if end > data.size {
+			end = data.size
+		}
+		block, err := window.view(offset, end)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		size := int64(chunker.NextBlockSize(block))
+		strongSig := signatures.CreateStrongSignature(block[:size], sig.StrongAlgorithm)
+		if bs, ok := blockLUT[strongSig]; ok && int64(bs.Size) == size {
+			// copy of the sig, with the LOCAL offset.
+			bs.Offset = offset
+			signaturesToReuse = append(signaturesToReuse, bs)
+		} else if l := len(remainingByteList); l > 0 && remainingByteList[l-1].EndOffset == offset-1 {
+			remainingByteList[l-1].EndOffset = offset + size - 1
+		} else {
+			remainingByteList = append(remainingByteList, signatures.RemainingBytes{BeginOffset: offset, EndOffset: offset + size - 1})
+		}
+		offset += size
+	}
+
+	return remainingByteList, signaturesToReuse, nil
+}
+
 func generateBlockLUTFromBlockSigs( bs []signatures.BlockSig) map[signatures.RollingSignature][]signatures.BlockSig {
 	blockLUT := make(map[signatures.RollingSignature][]signatures.BlockSig)
 
@@ -112,7 +268,7 @@ func generateBlockLUTFromBlockSigs( bs []signatures.BlockSig) map[signatures.Rol
 			// if they do NOT match (ie its a new block with same rolling sig but not the same MD5) then
 			// add to array which is the map value.
 			for _, bs := range bsl {
-				if bs.MD5Signature != element.MD5Signature {
+				if bs.StrongSig != element.StrongSig {
 					addToList = true
 					break
 				}
@@ -138,230 +294,9 @@ func generateBlockLUTFromBlockSigs( bs []signatures.BlockSig) map[signatures.Rol
 	return blockLUT
 }
 
-// searchLocalFileForSignaturesOfGivenSize goes through the remaining byte ranges (initially will be 0 -> end of file),
-// and figure out which parts of the file match the signatures (ie can be reused)
-func searchLocalFileForSignaturesOfGivenSize(sig signatures.CompleteSignature, localFile *os.File, remainingByteList []signatures.RemainingBytes,
-																						 sigSize int64, fileLength int64 ) ([]signatures.RemainingBytes, []signatures.BlockSig, error) {
-
-	windowSize := sigSize
-	newRemainingBytes := []signatures.RemainingBytes{}
-	sigLUT := generateBlockLUTFromBlockSigs(sig.SignatureList)
-	//buffer := make([]byte, windowSize)
-	offset := int64(0)
-	signaturesToReuse := []signatures.BlockSig{}
-  lastDisplayOffset := int64(0)
-
-  mm,err  := mmap.Map(localFile, mmap.RDONLY, 0)
-  if err != nil {
-  	log.Fatalf("Unable to mmap the file: %s\n", err.Error())
-  }
-  defer mm.Unmap()
-
-	// go through remaining byte ranges.
-	for _, byteRange := range remainingByteList {
-		fmt.Printf("Searching %d to %d, for sig size %d\n", byteRange.BeginOffset, byteRange.EndOffset, sigSize)
-    byteRangeSize := byteRange.EndOffset - byteRange.BeginOffset + 1
-
-		// if byte range is large... and signature size is small (what values???) then dont check.
-		// We could end up with LOADS of tiny sig matching where ideally we'd use a larger new sig block.
-		// The exception is when the sig size exactly matches the byterange size... then we allow it to check if the sig will match
-		// in practice this allows small (1-2 byte sigs) to match the byte ranges.
-    if byteRangeSize > 1000 && sigSize > 100 || byteRangeSize == sigSize {
-
-	    // if byteRange is smaller than the key we're using, then there cannot be a match so add
-	    // it to the newRemainingBytes list
-    	if byteRange.EndOffset - byteRange.BeginOffset +1 >= windowSize {
-    		offset = byteRange.BeginOffset
-		    generateFreshSig := true
-    		var currentSig signatures.RollingSignature
-    		oldEndOffset := byteRange.BeginOffset
-
-    		for {
-    			if offset > lastDisplayOffset {
-				    fmt.Printf("offset is %d\n", offset)
-				    lastDisplayOffset = offset + 100000
-			    }
-
-    			// generate fresh sig... not really rolling
-    			if generateFreshSig {
-    				buffer, err := azureutils.PopulateBuffer(&mm, offset, int64(windowSize), byteRange.EndOffset)
-    				if err != nil {
-							fmt.Printf("Cannot read file: %s\n", err.Error())
-							return nil, nil, err
-				    }
-				    bytesRead := len(buffer)
-				    currentSig = signatures.CreateRollingSignature(buffer, int(bytesRead))
-			    } else {
-
-			    	// roll existing sig.
-			    	/*
-			    	localFile.Seek(offset-1, 0)
-			    	b := make([]byte,1)
-			    	_,_ = localFile.ReadAt(b,offset-1)
-			    	previousByte := b[0] */
-			    	previousByte := mm[offset-1]
-
-			    	/*
-				    _,_ = localFile.ReadAt(b, offset + windowSize - 1)
-				    nextByte := b[0] */
-			    	nextByte := mm[offset + windowSize -1]
-				    currentSig = signatures.RollSignature(windowSize, previousByte, nextByte, currentSig)
-
-/*
-				    // just for testing idea.
-				    buffer, err := azureutils.PopulateBuffer(&mm, offset, int64(windowSize), byteRange.EndOffset)
-				    if err != nil {
-					    fmt.Printf("Cannot read file: %s\n", err.Error())
-					    return nil, nil, err
-				    }
-
-				    bytesRead := len(buffer)
-				    tempCompareSig := signatures.CreateRollingSignature(buffer, bytesRead)
-            if currentSig != tempCompareSig {
-            	fmt.Printf("rolling vs new sig differ!!!\n")
-            } */
-
-			    }
-
-			    _, ok := sigLUT[currentSig]
-			    if ok {
-			    	/*
-			      localFile.Seek(offset,0)
-			      bytesRead, err := localFile.ReadAt(buffer, offset)
-			      if err != nil {
-			      	fmt.Printf("Unable to read file:  %s\n", err.Error())
-			      	return nil, nil, err
-			      } */
-			    	//buffer = mm[offset:offset + int64(signatures.SignatureSize)]
-						//bytesRead := signatures.SignatureSize
-				    buffer, _ := azureutils.PopulateBuffer(&mm, offset, int64(windowSize), byteRange.EndOffset)
-				    bytesRead := len(buffer)
-				    md5Sig := signatures.CreateMD5Signature(buffer, int(bytesRead))
-			      sigForCurrentRollingSig := sigLUT[currentSig]
-			      sigMatchingRollingSigAndMD5, sigFound := getMatchingMD5Sig(sigForCurrentRollingSig, md5Sig)
-
-			      if sigFound {
-			      	if oldEndOffset != offset {
-			      		newRemainingBytes = append(newRemainingBytes, signatures.RemainingBytes{BeginOffset: oldEndOffset, EndOffset: offset-1})
-				      }
-
-				      sigMatchingRollingSigAndMD5.Offset = offset
-				      signaturesToReuse = append(signaturesToReuse, sigMatchingRollingSigAndMD5)
-				      offset += windowSize
-				      generateFreshSig = true
-				      oldEndOffset = offset
-			      } else {
-			      	offset++
-			      	generateFreshSig = false
-			      }
-			    } else {
-				    // no match. Just increment offset and generate rolling sig.
-				    offset++
-				    generateFreshSig = false
-			    }
-
-			    // lack of do-while.
-			    if offset + windowSize > byteRange.EndOffset + 1 {
-			    	break
-			    }
-		    }
-		    if offset <= byteRange.EndOffset {
-		    	newRemainingBytes = append(newRemainingBytes, signatures.RemainingBytes{BeginOffset: oldEndOffset, EndOffset: byteRange.EndOffset})
-		    }
-	    } else {
-	    	newRemainingBytes = append(newRemainingBytes, byteRange)
-	    }
-    } else {
-	    newRemainingBytes = append(newRemainingBytes, byteRange)
-    }
-	}
-	return newRemainingBytes, signaturesToReuse, nil
-}
-
-// searchLocalFileForSignaturesOfGivenSizeForDownload goes through ENTIRE file looking for matches to
-// existing blob signatures. This may be excessive, but could provide useful for minimising how much we're downloading.
-func searchLocalFileForSignaturesOfGivenSizeForDownload(sig signatures.CompleteSignature, localFile *os.File,
-	sigSize int64) ([]signatures.BlockSig, error) {
-
-	windowSize := sigSize
-	blobSigLUT := generateBlockLUTFromBlockSigs(sig.SignatureList)
-	//buffer := make([]byte, windowSize)
-
-	signaturesToReuse := []signatures.BlockSig{}
-	lastDisplayOffset := int64(0)
-	stats,_ := localFile.Stat()
-	fileLength := stats.Size()
-	var currentSig signatures.RollingSignature
-
-	mm,err  := mmap.Map(localFile, mmap.RDONLY, 0)
-	if err != nil {
-		log.Fatalf("Unable to mmap the file: %s\n", err.Error())
-	}
-	defer mm.Unmap()
-
-	offset := int64(0)
-	generateFreshSig := true
-	for offset + sigSize < fileLength {
-
-		if offset > lastDisplayOffset {
-			fmt.Printf("offset is %d\n", offset)
-			lastDisplayOffset = offset + 100000
-		}
-
-		// generate fresh sig... not really rolling
-		if generateFreshSig {
-			buffer, err := azureutils.PopulateBuffer(&mm, offset, int64(windowSize), fileLength-1)
-			if err != nil {
-				fmt.Printf("Cannot read file: %s\n", err.Error())
-				return nil, err
-			}
-			bytesRead := len(buffer)
-			currentSig = signatures.CreateRollingSignature(buffer, int(bytesRead))
-			generateFreshSig = false
-		} else {
-			previousByte := mm[offset-1]
-			nextByte := mm[offset + windowSize -1]
-			currentSig = signatures.RollSignature(windowSize, previousByte, nextByte, currentSig)
-
-			/*
-			// just for testing idea.
-			buffer, err := azureutils.PopulateBuffer(&mm, offset, int64(windowSize), fileLength -1)
-			if err != nil {
-				fmt.Printf("Cannot read file: %s\n", err.Error())
-				return nil, err
-			}
-
-			bytesRead := len(buffer)
-			tempCompareSig := signatures.CreateRollingSignature(buffer, bytesRead)
-			if currentSig != tempCompareSig {
-				fmt.Printf("rolling vs new sig differ!!!\n")
-			} */
-		}
-
-		_, ok := blobSigLUT[currentSig]
-		if ok {
-			buffer, _ := azureutils.PopulateBuffer(&mm, offset, int64(windowSize), fileLength-1)
-			bytesRead := len(buffer)
-			md5Sig := signatures.CreateMD5Signature(buffer, int(bytesRead))
-			sigForCurrentRollingSig := blobSigLUT[currentSig]
-			sigMatchingRollingSigAndMD5, sigFound := getMatchingMD5Sig(sigForCurrentRollingSig, md5Sig)
-
-			if sigFound {
-
-				// this is a copy of the sig.
-				// Want LOCAL offset.
-				sigMatchingRollingSigAndMD5.Offset = offset
-				signaturesToReuse = append(signaturesToReuse, sigMatchingRollingSigAndMD5)
-			}
-		}
-    offset++
-	}
-	return signaturesToReuse, nil
-}
-
-func getMatchingMD5Sig(matchingSigs []signatures.BlockSig, md5Sig [16]byte) (signatures.BlockSig,bool) {
+func getMatchingStrongSig(matchingSigs []signatures.BlockSig, strongSig signatures.StrongHash) (signatures.BlockSig,bool) {
 	for _,s := range matchingSigs {
-		if s.MD5Signature == md5Sig {
+		if s.StrongSig == strongSig {
 			return s,true
 		}
 	}
@@ -0,0 +1,254 @@
+package blobsync
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// testData is random, with a bit of it repeated so there are duplicate blocks.
+func testData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	copy(data[size/2:], data[:size/8])
+	return data
+}
+
+// editData is data with bytes inserted, removed and moved around, so blocks turn up at odd offsets.
+func editData(data []byte) []byte {
+	edited := append([]byte{}, data[:10000]...)
+	edited = append(edited, testData(2, 13)...)
+	edited = append(edited, data[10000:50000]...)
+	edited = append(edited, data[50500:]...)
+	edited = append(edited, data[20000:30000]...)
+	return append(edited, testData(3, 1234)...)
+}
+
+// testSignature is the signature of data with opts. Fixed size signatures also get the blocks of a
+// smaller signature, the way earlier delta uploads leave blocks of other sizes.
+func testSignature(t *testing.T, data []byte, opts signatures.SignatureOptions) signatures.SizeBasedCompleteSignature {
+	sig, err := signatures.CreateSignatureFromScratchWithOptions(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Chunking != signatures.ChunkingCDC {
+		smallOpts := opts
+		smallOpts.BlockSize = 300
+		small, err := signatures.CreateSignatureFromScratchWithOptions(bytes.NewReader(data[70000:80000]), smallOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig.Signatures[300] = small.Signatures[300]
+	}
+	return *sig
+}
+
+// testLocalData returns data mmapped from a file and in memory (not mapped), and a func to clean up.
+func testLocalData(t testing.TB, data []byte) (map[string]localData, func()) {
+	dir, err := ioutil.TempDir("", "search_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	mapped := openLocalData(f, int64(len(data)))
+	unmapped := openLocalData(bytes.NewReader(data), int64(len(data)))
+	cleanup := func() {
+		mapped.Close()
+		f.Close()
+		os.RemoveAll(dir)
+	}
+	if !mapped.isMapped() || unmapped.isMapped() {
+		cleanup()
+		t.Fatal("file not mapped or bytes.Reader mapped")
+	}
+	return map[string]localData{"mapped": mapped, "unmapped": unmapped}, cleanup
+}
+
+func TestSearchSameForAnyWorkersAndChunks(t *testing.T) {
+	old := testData(1, 200000)
+	local := editData(old)
+	datas, cleanup := testLocalData(t, local)
+	defer cleanup()
+
+	optsList := []struct {
+		name string
+		opts signatures.SignatureOptions
+	}{
+		{"fixed 777", signatures.SignatureOptions{BlockSize: 777}},
+		{"fixed 1000", signatures.SignatureOptions{BlockSize: 1000}},
+		{"cdc", signatures.SignatureOptions{BlockSize: 4096, Chunking: signatures.ChunkingCDC}},
+	}
+	limited := DefaultSearchOptions()
+	limited.MaxSmallBlockMatches = 5
+	strategies := []struct {
+		name     string
+		strategy SearchStrategy
+	}{
+		{"upload", UploadSearchStrategy(DefaultSearchOptions())},
+		{"download", DownloadSearchStrategy(DefaultSearchOptions())},
+		{"upload limited", UploadSearchStrategy(limited)},
+		{"download limited", DownloadSearchStrategy(limited)},
+	}
+
+	ctx := context.Background()
+	for _, o := range optsList {
+		sig := testSignature(t, old, o.opts)
+		for _, s := range strategies {
+			// a single search of the whole lot.
+			want, err := searchLocalDataInChunks(ctx, datas["mapped"], sig, s.strategy, int64(len(local)), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(want.SignaturesToReuse) == 0 || len(want.ByteRangesToUpload) == 0 {
+				t.Fatalf("%s %s: found %d blocks and %d ranges to upload, the test data isnt testing much",
+					o.name, s.name, len(want.SignaturesToReuse), len(want.ByteRangesToUpload))
+			}
+
+			for name, data := range datas {
+				// chunks smaller than the minimum (4 blocks) and ones not a multiple of the block size.
+				for _, chunkSize := range []int64{1, 5000, 77777} {
+					for _, workers := range []int{1, 2, 8} {
+						got, err := searchLocalDataInChunks(ctx, data, sig, s.strategy, chunkSize, workers)
+						if err != nil {
+							t.Fatalf("%s %s %s chunks of %d, %d workers: %v", o.name, s.name, name, chunkSize, workers, err)
+						}
+						if !reflect.DeepEqual(got, want) {
+							t.Errorf("%s %s %s chunks of %d, %d workers: results differ from a single search", o.name, s.name, name, chunkSize, workers)
+						}
+					}
+				}
+
+				got, err := searchLocalData(ctx, data, sig, s.strategy, 4)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s %s %s: results differ from a single search", o.name, s.name, name)
+				}
+			}
+		}
+	}
+}
+
+// benchmark data, the blob and a local copy with every other block changed, so half of it gets rolled through.
+var (
+	benchOnce  sync.Once
+	benchLocal []byte
+	benchSig   signatures.SizeBasedCompleteSignature
+)
+
+func benchData(b *testing.B) ([]byte, signatures.SizeBasedCompleteSignature) {
+	benchOnce.Do(func() {
+		opts := signatures.SignatureOptions{}.WithDefaults()
+		blob := testData(1, 16*1024*1024)
+		benchLocal = append([]byte{}, blob...)
+		for offset := 0; offset < len(benchLocal); offset += 2 * opts.BlockSize {
+			benchLocal[offset] ^= 0xff
+		}
+		sig, err := signatures.CreateSignatureFromScratchWithOptions(bytes.NewReader(blob), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchSig = *sig
+	})
+	return benchLocal, benchSig
+}
+
+// benchmarkRoll rolls a window over all of the local data, checking each offset with lookup. This is the
+// inner loop of the search.
+func benchmarkRoll(b *testing.B, lookup func(sigLUT map[signatures.RollingSignature][]signatures.BlockSig,
+	filter signatures.RollingFilter, sig signatures.RollingSignature) bool) {
+	local, sig := benchData(b)
+	blocks := signatures.ExpandSizeBasedCompleteSignature(sig)
+	sigLUT := generateBlockLUTFromBlockSigs(blocks)
+	filter := signatures.NewRollingFilter(blocks)
+	windowSize := int64(sig.BlockSize)
+	rollingHash := signatures.NewRollingHash(sig.RollingAlgorithm, windowSize)
+
+	b.SetBytes(int64(len(local)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	found := 0
+	for i := 0; i < b.N; i++ {
+		rollingSig := rollingHash.Sum(local[:windowSize])
+		for offset := int64(1); offset+windowSize <= int64(len(local)); offset++ {
+			rollingSig = rollingHash.Roll(local[offset-1], local[offset+windowSize-1], rollingSig)
+			if lookup(sigLUT, filter, rollingSig) {
+				found++
+			}
+		}
+	}
+	if found == 0 {
+		b.Fatal("nothing found")
+	}
+}
+
+func BenchmarkRollMapLookup(b *testing.B) {
+	benchmarkRoll(b, func(sigLUT map[signatures.RollingSignature][]signatures.BlockSig, filter signatures.RollingFilter, sig signatures.RollingSignature) bool {
+		_, ok := sigLUT[sig]
+		return ok
+	})
+}
+
+func BenchmarkRollFilterMapLookup(b *testing.B) {
+	benchmarkRoll(b, func(sigLUT map[signatures.RollingSignature][]signatures.BlockSig, filter signatures.RollingFilter, sig signatures.RollingSignature) bool {
+		if !filter.MayContain(sig) {
+			return false
+		}
+		_, ok := sigLUT[sig]
+		return ok
+	})
+}
+
+func benchmarkSearch(b *testing.B, dataName string, strategy SearchStrategy, workers int) {
+	local, sig := benchData(b)
+	datas, cleanup := testLocalData(b, local)
+	defer cleanup()
+
+	b.SetBytes(int64(len(local)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := searchLocalData(context.Background(), datas[dataName], sig, strategy, workers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearchUpload(b *testing.B) {
+	benchmarkSearch(b, "mapped", UploadSearchStrategy(DefaultSearchOptions()), 1)
+}
+
+func BenchmarkSearchUploadParallel(b *testing.B) {
+	benchmarkSearch(b, "mapped", UploadSearchStrategy(DefaultSearchOptions()), DefaultSearchWorkers())
+}
+
+func BenchmarkSearchUploadInMemory(b *testing.B) {
+	benchmarkSearch(b, "unmapped", UploadSearchStrategy(DefaultSearchOptions()), 1)
+}
+
+func BenchmarkSearchDownload(b *testing.B) {
+	benchmarkSearch(b, "mapped", DownloadSearchStrategy(DefaultSearchOptions()), 1)
+}
+
+func BenchmarkSearchDownloadParallel(b *testing.B) {
+	benchmarkSearch(b, "mapped", DownloadSearchStrategy(DefaultSearchOptions()), DefaultSearchWorkers())
+}
@@ -0,0 +1,81 @@
+package blobsync
+
+import "fmt"
+
+// SearchOptions decide which matches the rolling search bothers with, trading how much of the file is
+// reused against how fragmented the blob ends up. Reusing a tiny block saves a few bytes but costs a
+// whole block in the block list, where ideally we'd use a larger new block instead.
+type SearchOptions struct {
+	// Only blocks larger than MinMatchSize are searched for, and (for uploads) only in byte ranges larger
+	// than MinRangeSize. Downloads search the whole file for every block size, whatever its size.
+	MinMatchSize int
+	MinRangeSize int
+
+	// MaxSmallBlockMatches is the most blocks smaller than the signature block size (ie. left by
+	// earlier delta uploads) reused, 0 for no limit. Past that the data goes in new blocks.
+	MaxSmallBlockMatches int
+
+	// ExactSizeMatches lets a block match a byte range exactly its size, even at or below the minimums.
+	// In practice this allows small (1-2 byte) blocks to match the byte ranges they were made from. Uploads only.
+	ExactSizeMatches bool
+}
+
+// DefaultSearchOptions are the options used unless told otherwise.
+func DefaultSearchOptions() SearchOptions {
+	return SearchOptions{
+		MinMatchSize:     100,
+		MinRangeSize:     1000,
+		ExactSizeMatches: true,
+	}
+}
+
+// Validate checks none of the sizes or limits are negative.
+func (o SearchOptions) Validate() error {
+	if o.MinMatchSize < 0 {
+		return fmt.Errorf("invalid minimum match size %d", o.MinMatchSize)
+	}
+	if o.MinRangeSize < 0 {
+		return fmt.Errorf("invalid minimum range size %d", o.MinRangeSize)
+	}
+	if o.MaxSmallBlockMatches < 0 {
+		return fmt.Errorf("invalid maximum small block matches %d", o.MaxSmallBlockMatches)
+	}
+	return nil
+}
+
+// SetSearchOptions sets which matches the search of a local file looks for.
+func (bs *BlobSync) SetSearchOptions(opts SearchOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	bs.searchOptions = opts
+	return nil
+}
+
+// searches is true if a byte range of rangeSize is worth searching for blocks of sigSize.
+func (o SearchOptions) searches(rangeSize int64, sigSize int64) bool {
+	if rangeSize < sigSize {
+		return false
+	}
+	if o.ExactSizeMatches && rangeSize == sigSize {
+		return true
+	}
+	return rangeSize > int64(o.MinRangeSize) && sigSize > int64(o.MinMatchSize)
+}
+
+// searchesFile is true if a file of fileLength is worth searching for blocks of sigSize, for downloads.
+func (o SearchOptions) searchesFile(fileLength int64, sigSize int64) bool {
+	return fileLength >= sigSize && sigSize > int64(o.MinMatchSize)
+}
+
+// smallBlockLimit is how many more blocks smaller than the signature block size can be reused, having
+// reused count already. Negative for no limit.
+func (o SearchOptions) smallBlockLimit(count int) int {
+	if o.MaxSmallBlockMatches == 0 {
+		return -1
+	}
+	if count >= o.MaxSmallBlockMatches {
+		return 0
+	}
+	return o.MaxSmallBlockMatches - count
+}
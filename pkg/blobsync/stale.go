@@ -0,0 +1,137 @@
+package blobsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// StaleSignaturePolicy is what to do when a signature turns out not to describe its blob
+// (eg. the blob was overwritten by another tool).
+type StaleSignaturePolicy uint8
+
+const (
+	// StaleSignatureFullTransfer uploads or downloads the whole blob instead of a delta.
+	StaleSignatureFullTransfer StaleSignaturePolicy = 1
+
+	// StaleSignatureRegenerate is StaleSignatureFullTransfer, but a download also replaces the signature
+	// with one made from the downloaded blob, so other downloads can be deltas again. An upload always
+	// writes a new signature anyway.
+	StaleSignatureRegenerate StaleSignaturePolicy = 2
+
+	DefaultStaleSignaturePolicy = StaleSignatureFullTransfer
+)
+
+var staleSignaturePolicyNames = map[StaleSignaturePolicy]string{
+	StaleSignatureFullTransfer: "full",
+	StaleSignatureRegenerate:   "regenerate",
+}
+
+func (p StaleSignaturePolicy) String() string {
+	if name, ok := staleSignaturePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", p)
+}
+
+// ParseStaleSignaturePolicy converts a name (full or regenerate) to a StaleSignaturePolicy.
+// An empty name is the default.
+func ParseStaleSignaturePolicy(name string) (StaleSignaturePolicy, error) {
+	if name == "" {
+		return DefaultStaleSignaturePolicy, nil
+	}
+	for p, pName := range staleSignaturePolicyNames {
+		if strings.EqualFold(name, pName) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown stale signature policy %s", name)
+}
+
+// SetStaleSignaturePolicy sets what happens when a signature is found to be stale.
+func (bs *BlobSync) SetStaleSignaturePolicy(policy StaleSignaturePolicy) error {
+	if _, ok := staleSignaturePolicyNames[policy]; !ok {
+		return fmt.Errorf("invalid stale signature policy %d", policy)
+	}
+	bs.stalePolicy = policy
+	return nil
+}
+
+// errSignatureRegenerated means the signature was made from the blob content, so none of the blobs
+// blocks can be reused and the blob gets uploaded in full instead.
+var errSignatureRegenerated = errors.New("signature regenerated from blob content")
+
+// checkSignature makes sure sig still describes the blob, returning an ErrSignatureStale error
+// (along with the blob properties) if not.
+func (bs BlobSync) checkSignature(ctx context.Context, sig *signatures.SizeBasedCompleteSignature, containerName string, blobName string) (*signatures.BlobProperties, error) {
+	props, err := bs.blobHandler.GetBlobProperties(ctx, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := sig.CheckBlob(*props); err != nil {
+		return props, fmt.Errorf("blob %s: %w", blobName, err)
+	}
+	return props, nil
+}
+
+// contentHash hashes the first size bytes of r.
+func contentHash(r io.ReaderAt, size int64, alg signatures.StrongAlgorithm) (signatures.StrongHash, error) {
+	return alg.HashReader(io.NewSectionReader(r, 0, size))
+}
+
+// blobInfo describes the blob just committed, with content hash hash, for its new signature.
+func (bs BlobSync) blobInfo(ctx context.Context, hash signatures.StrongHash, containerName string, blobName string) (*signatures.BlobInfo, error) {
+	props, err := bs.blobHandler.GetBlobProperties(ctx, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	return &signatures.BlobInfo{Length: props.Size, ETag: props.ETag, ContentHash: hash}, nil
+}
+
+// downloadStale downloads the whole blob since its signature is no use, regenerating the signature
+// if the policy says to. props are the blob properties from before the download.
+func (bs BlobSync) downloadStale(ctx context.Context, staleErr error, localFilePath string, containerName string,
+	blobName string, props *signatures.BlobProperties, verbose bool) error {
+
+	if verbose {
+		fmt.Printf("%s, downloading in full\n", staleErr.Error())
+	}
+
+	err := bs.downloadBlobToFile(ctx, localFilePath, containerName, blobName, props)
+	if err != nil {
+		return err
+	}
+	if bs.stalePolicy != StaleSignatureRegenerate {
+		return nil
+	}
+
+	localFile, err := os.Open(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	stats, err := localFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	opts := bs.sigOptionsForSize(stats.Size())
+	sig, hash, err := bs.generateSig(localFile, stats.Size(), opts)
+	if err != nil {
+		return fmt.Errorf("cannot generate signature: %w", err)
+	}
+
+	// the ETag from before downloading, if the blob changed since the new sig is stale straight away.
+	sig.Blob = &signatures.BlobInfo{Length: props.Size, ETag: props.ETag, ContentHash: hash, Regenerated: true}
+	err = bs.uploadSig(ctx, sig, containerName, blobName)
+	if err != nil {
+		return fmt.Errorf("cannot upload signature for blob %s: %w", blobName, err)
+	}
+	return nil
+}
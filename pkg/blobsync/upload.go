@@ -0,0 +1,270 @@
+package blobsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// maxUploaders is the number of goroutines staging blocks concurrently.
+const maxUploaders = 100
+
+type UploadMessage struct {
+	Offset    int64
+	BytesRead int
+	Data      []byte
+}
+
+func checkIfDupe(uploadedBlockList []signatures.UploadedBlock, blockID string) bool {
+	for _, ub := range uploadedBlockList {
+		if ub.BlockID == blockID {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBytesWithChannel stages every message read from dataCh and reports the
+// resulting UploadedBlock on uploadedBlockCh. Stops early if ctx is cancelled.
+func (bs BlobSync) writeBytesWithChannel(ctx context.Context, dataCh chan UploadMessage, uploadedBlockCh chan signatures.UploadedBlock,
+	opts signatures.SignatureOptions, containerName string, blobName string) error {
+
+	for data := range dataCh {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		sig, err := signatures.GenerateBlockSigWithOptions(data.Data, data.Offset, data.BytesRead, 0, opts)
+		if err != nil {
+			return err
+		}
+
+		blockID := opts.StrongAlgorithm.BlockID(sig.StrongSig)
+		newBlock := signatures.UploadedBlock{
+			BlockID:     blockID,
+			Offset:      data.Offset,
+			Sig:         *sig,
+			Size:        int64(data.BytesRead),
+			IsNew:       true,
+			IsDuplicate: false}
+
+		err = bs.blobHandler.StageBlock(ctx, containerName, blobName, blockID, data.Data)
+		if err != nil {
+			return err
+		}
+		uploadedBlockCh <- newBlock
+	}
+
+	return nil
+}
+
+// writeBytes, returns an UploadedBlock struct, giving a summary
+func (bs BlobSync) writeBytes(ctx context.Context, offset int64, bytesRead int, data []byte, opts signatures.SignatureOptions,
+	containerName string, blobName string, uploadedBlockList []signatures.UploadedBlock) (*signatures.UploadedBlock, error) {
+
+	sig, err := signatures.GenerateBlockSigWithOptions(data, offset, bytesRead, 0, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	blockID := opts.StrongAlgorithm.BlockID(sig.StrongSig)
+
+	isDupe := checkIfDupe(uploadedBlockList, blockID)
+
+	newBlock := signatures.UploadedBlock{
+		BlockID:     blockID,
+		Offset:      offset,
+		Sig:         *sig,
+		Size:        int64(bytesRead),
+		IsNew:       true,
+		IsDuplicate: isDupe}
+
+	// not a dupe, upload it.
+	if !isDupe {
+		err = bs.blobHandler.StageBlock(ctx, containerName, blobName, blockID, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &newBlock, nil
+}
+
+// uploadBlob uploads all of the local data as a new blob.
+func (bs BlobSync) uploadBlob(ctx context.Context, data localData, opts signatures.SignatureOptions, containerName string, blobName string, verbose bool) error {
+
+	remainingBytes := signatures.RemainingBytes{BeginOffset: 0, EndOffset: data.size - 1}
+
+	tooManyBlocks := fmt.Errorf("file needs more than the limit of %d blocks. Increase the (maximum) block size", MaxBlockCount)
+	searchResults := signatures.SignatureSearchResults{ByteRangesToUpload: []signatures.RemainingBytes{remainingBytes}}
+	if minimumBlockCount(&searchResults, opts) > MaxBlockCount {
+		return tooManyBlocks
+	}
+
+	uploadBlockList, err := bs.uploadRemainingBytesAsBlocks(ctx, remainingBytes, data, opts, containerName, blobName, verbose)
+	if err != nil {
+		return err
+	}
+
+	if len(uploadBlockList) > MaxBlockCount {
+		return tooManyBlocks
+	}
+
+	sort.Slice(uploadBlockList, func(i int, j int) bool {
+		return uploadBlockList[i].Offset < uploadBlockList[j].Offset
+	})
+
+	return bs.blobHandler.PutBlockList(ctx, uploadBlockList, containerName, blobName)
+}
+
+// launchConcurrentUploader starts maxUploaders goroutines draining dataCh. The returned
+// WaitGroup completes once dataCh is closed and every goroutine has finished.
+func (bs BlobSync) launchConcurrentUploader(ctx context.Context, dataCh chan UploadMessage, uploadedBlockCh chan signatures.UploadedBlock,
+	errCh chan error, opts signatures.SignatureOptions, containerName string, blobName string) *sync.WaitGroup {
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < maxUploaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bs.writeBytesWithChannel(ctx, dataCh, uploadedBlockCh, opts, containerName, blobName)
+			if err != nil {
+				errCh <- err
+
+				// keep draining so the producer never blocks.
+				for range dataCh {
+				}
+			}
+		}()
+	}
+	return &wg
+}
+
+// uploadRemainingBytesAsBlocks. Using localData instead of a reader since we mmap the file if we can.
+// Upload remaining bytes as blocks. If need be, break remainingBytes into blocks as per opts (opts.BlockSize
+// in length, or content defined). Blocks are hashed (and named) with opts.StrongAlgorithm.
+func (bs BlobSync) uploadRemainingBytesAsBlocks(ctx context.Context, remainingBytes signatures.RemainingBytes, data localData,
+	opts signatures.SignatureOptions, containerName string, blobName string, verbose bool) ([]signatures.UploadedBlock, error) {
+
+	opts = opts.WithDefaults()
+	chunker := signatures.NewChunker(opts)
+	maxBlockSize := int64(chunker.MaxBlockSize())
+	window := localWindow{data: data}
+
+	uploadedBlockList := []signatures.UploadedBlock{}
+
+	// nothing to upload (eg. empty file).
+	if remainingBytes.EndOffset < remainingBytes.BeginOffset {
+		return uploadedBlockList, nil
+	}
+
+	// loop and write in blocks. Signatures dont come through here, see uploadSig.
+	offset := remainingBytes.BeginOffset
+
+	dataCh := make(chan UploadMessage, maxUploaders)
+	uploadedBlockCh := make(chan signatures.UploadedBlock, maxUploaders)
+	errCh := make(chan error, maxUploaders)
+	collected := make(chan []signatures.UploadedBlock)
+
+	wg := bs.launchConcurrentUploader(ctx, dataCh, uploadedBlockCh, errCh, opts, containerName, blobName)
+	go func() {
+		l := []signatures.UploadedBlock{}
+		for uploadedBlock := range uploadedBlockCh {
+			l = append(l, uploadedBlock)
+		}
+		collected <- l
+	}()
+
+	var readErr error
+	for offset <= remainingBytes.EndOffset {
+
+		// the chunker never looks past the largest block.
+		end := offset + maxBlockSize
+		if end > remainingBytes.EndOffset+1 {
+			end = remainingBytes.EndOffset + 1
+		}
+		view, err := window.view(offset, end)
+		if err != nil {
+			readErr = err
+			break
+		}
+		sizeToRead := int64(chunker.NextBlockSize(view))
+
+		buffer := view[:sizeToRead]
+		bytesRead := len(buffer)
+		if bytesRead == 0 {
+			break
+		}
+
+		select {
+		case dataCh <- UploadMessage{Data: buffer, Offset: offset, BytesRead: bytesRead}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		offset += sizeToRead
+	}
+	close(dataCh)
+
+	wg.Wait()
+	close(uploadedBlockCh)
+	uploadedBlockList = <-collected
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	// cancelled before anything failed, the block list is incomplete.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if verbose {
+		DisplayUploadedBytes(uploadedBlockList)
+	}
+	return uploadedBlockList, nil
+}
+
+// uploadFromReader uploads everything read from reader as the blob, staging opts.BlockSize blocks as they arrive.
+// Used for data we dont have as a file (eg. signatures), so blocks are staged sequentially.
+func (bs BlobSync) uploadFromReader(ctx context.Context, reader io.Reader, opts signatures.SignatureOptions, containerName string, blobName string) error {
+
+	opts = opts.WithDefaults()
+	uploadedBlockList := []signatures.UploadedBlock{}
+
+	// reused for every block, backends dont keep the data passed to StageBlock.
+	buffer := make([]byte, opts.BlockSize)
+	offset := int64(0)
+	for {
+		bytesRead, err := io.ReadFull(reader, buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		uploadedBlock, err := bs.writeBytes(ctx, offset, bytesRead, buffer[:bytesRead], opts, containerName, blobName, uploadedBlockList)
+		if err != nil {
+			return err
+		}
+		uploadedBlockList = append(uploadedBlockList, *uploadedBlock)
+		offset += int64(bytesRead)
+	}
+
+	return bs.blobHandler.PutBlockList(ctx, uploadedBlockList, containerName, blobName)
+}
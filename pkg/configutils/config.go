@@ -0,0 +1,309 @@
+package configutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type Config struct {
+	AccountName string `json:"AccountName"`
+	AccountKey string `json:"AccountKey"`
+
+	// Alternatives to the account key. ConnectionString is a standard Azure storage connection string.
+	// SASURL is a container (or blob) scoped SAS URL, if blob scoped SignatureSASURL is needed for the .sig blob.
+	// SASToken is used with AccountName and the endpoint settings below.
+	ConnectionString string `json:"ConnectionString"`
+	SASURL string `json:"SASURL"`
+	SignatureSASURL string `json:"SignatureSASURL"`
+	SASToken string `json:"SASToken"`
+
+	// OAuth token authentication. Service principal (TenantID, ClientID and ClientSecret) or
+	// managed identity (ClientID optional, selects a user assigned identity).
+	// AuthorityHost and IdentityEndpoint override the default token endpoints.
+	TenantID string `json:"TenantID"`
+	ClientID string `json:"ClientID"`
+	ClientSecret string `json:"ClientSecret"`
+	AuthorityHost string `json:"AuthorityHost"`
+	UseManagedIdentity bool `json:"UseManagedIdentity"`
+	IdentityEndpoint string `json:"IdentityEndpoint"`
+
+	// Blob service endpoint. All optional, defaults to https://<account>.blob.core.windows.net
+	EndpointScheme string `json:"EndpointScheme"`
+	EndpointHost string `json:"EndpointHost"`
+	EndpointSuffix string `json:"EndpointSuffix"`
+	EndpointPathStyle bool `json:"EndpointPathStyle"`
+
+	// S3Endpoint, if set, syncs against S3 (or an S3 compatible service) instead of Azure.
+	S3Endpoint string `json:"S3Endpoint"`
+	S3Region string `json:"S3Region"`
+	S3AccessKey string `json:"S3AccessKey"`
+	S3SecretKey string `json:"S3SecretKey"`
+	S3PathStyle bool `json:"S3PathStyle"`
+
+	// LocalRoot, if set, syncs against this directory instead of Azure.
+	LocalRoot string `json:"LocalRoot"`
+
+	// StrongHash is the strong hash for new signatures (md5, sha256, blake2b or xxh3). Default md5.
+	StrongHash string `json:"StrongHash"`
+
+	// RollingHash is the rolling checksum for new signatures (sum, adler32, rabinkarp or buzhash). Default sum.
+	RollingHash string `json:"RollingHash"`
+
+	// Chunking for new signatures, fixed (default) or cdc. BlockSize is the block size for fixed
+	// chunking, or the average for cdc. Zero sizes are the defaults.
+	Chunking string `json:"Chunking"`
+	BlockSize int `json:"BlockSize"`
+	MinBlockSize int `json:"MinBlockSize"`
+	MaxBlockSize int `json:"MaxBlockSize"`
+
+	// Range BlockSize is picked from (per file, scaled by its size) when not set.
+	AutoMinBlockSize int `json:"AutoMinBlockSize"`
+	AutoMaxBlockSize int `json:"AutoMaxBlockSize"`
+
+	// CompactionThreshold is the fragmentation (blocks compared to the fewest possible) past which
+	// uploads compact the blob. Zero is the default (1.5), negative disables it.
+	CompactionThreshold float64 `json:"CompactionThreshold"`
+
+	// SignatureWorkers is how many goroutines hash blocks for signatures. Zero is one per CPU.
+	SignatureWorkers int `json:"SignatureWorkers"`
+
+	// SearchWorkers is how many goroutines search local files for existing blocks. Zero is one per CPU.
+	SearchWorkers int `json:"SearchWorkers"`
+
+	// The search of a local file only bothers with blocks larger than MinMatchSize, in byte ranges larger
+	// than MinRangeSize. Zero is the default (100 and 1000), negative for no minimum.
+	// MaxSmallBlockMatches is the most blocks smaller than the block size the search reuses, zero for no limit.
+	// NoExactSizeMatches stops blocks at or below the minimums matching byte ranges exactly their size.
+	MinMatchSize int `json:"MinMatchSize"`
+	MinRangeSize int `json:"MinRangeSize"`
+	MaxSmallBlockMatches int `json:"MaxSmallBlockMatches"`
+	NoExactSizeMatches bool `json:"NoExactSizeMatches"`
+
+	// StaleSignature is what to do when a signature doesnt match its blob, full (transfer the
+	// whole blob, the default) or regenerate (also replace the signature after a download).
+	StaleSignature string `json:"StaleSignature"`
+}
+
+// configFile is the on disk format. The top level settings are the defaults,
+// a profile (if selected) overrides them. Profiles are kept undecoded so only the
+// settings a profile has override the defaults, even zero ones (eg. false).
+type configFile struct {
+	Config
+	DefaultProfile string                     `json:"DefaultProfile"`
+	Profiles       map[string]json.RawMessage `json:"Profiles"`
+}
+
+// environment variables start with this, eg. BLOBSYNC_ACCOUNT_NAME for AccountName.
+const envPrefix = "BLOBSYNC_"
+
+// credentialSettings together say how to authenticate, so they are layered as a group. A layer (profile,
+// environment or command line) setting any of them replaces all of them from the layers below, otherwise
+// eg. a ConnectionString in the file would win over the AccountKey a profile asks for.
+var credentialSettings = []string{"AccountKey", "ConnectionString", "SASURL", "SignatureSASURL", "SASToken",
+	"TenantID", "ClientID", "ClientSecret", "UseManagedIdentity", "S3AccessKey", "S3SecretKey"}
+
+// ClearCredentials clears every credential setting, for when a higher priority layer sets its own.
+func (c *Config) ClearCredentials() {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range credentialSettings {
+		f := v.FieldByName(name)
+		f.Set(reflect.Zero(f.Type()))
+	}
+}
+
+// isCredentialSetting is true if name is one of credentialSettings. Like the JSON decoding it ignores case.
+func isCredentialSetting(name string) bool {
+	for _, c := range credentialSettings {
+		if strings.EqualFold(name, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigSearchPaths returns the locations checked (in order) for a config file when one isn't
+// specified explicitly: ./config.json, $XDG_CONFIG_HOME/blobsync/config.json (~/.config if unset)
+// and finally the original ~/.blobsync/config.json
+func ConfigSearchPaths() []string {
+	paths := []string{"config.json"}
+
+	homeDir, _ := os.UserHomeDir()
+	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	if xdgConfigHome == "" && homeDir != "" {
+		xdgConfigHome = filepath.Join(homeDir, ".config")
+	}
+	if xdgConfigHome != "" {
+		paths = append(paths, filepath.Join(xdgConfigHome, "blobsync", "config.json"))
+	}
+	if homeDir != "" {
+		paths = append(paths, filepath.Join(homeDir, ".blobsync", "config.json"))
+	}
+	return paths
+}
+
+// LoadConfig builds the config from (lowest to highest priority) the config file, the selected profile
+// within it and BLOBSYNC_* environment variables. Credentials are taken from the highest of those that has any.
+// configPath (or BLOBSYNC_CONFIG) picks the file explicitly, otherwise the first of ConfigSearchPaths that
+// exists is used. Having no config file at all is fine, but a malformed one, unknown settings or an unknown
+// profile are all errors. profile (or BLOBSYNC_PROFILE, or DefaultProfile in the file) selects the profile.
+func LoadConfig(configPath string, profile string) (Config, error) {
+	if configPath == "" {
+		configPath = os.Getenv(envPrefix + "CONFIG")
+	}
+	if profile == "" {
+		profile = os.Getenv(envPrefix + "PROFILE")
+	}
+
+	cf := configFile{}
+	if configPath == "" {
+		for _, p := range ConfigSearchPaths() {
+			if _, err := os.Stat(p); err == nil {
+				configPath = p
+				break
+			}
+		}
+	}
+
+	if configPath != "" {
+		var err error
+		cf, err = readConfigFile(configPath)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	config := cf.Config
+	if profile == "" {
+		profile = cf.DefaultProfile
+	}
+	if profile != "" {
+		profileConfig, ok := cf.Profiles[profile]
+		if !ok {
+			return Config{}, fmt.Errorf("profile %s not found in config %s", profile, configPath)
+		}
+		err := decodeProfile(profileConfig, &config)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid profile %s in config %s: %s", profile, configPath, err.Error())
+		}
+	}
+
+	err := applyEnvironment(&config)
+	if err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+func readConfigFile(configPath string) (configFile, error) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return configFile{}, err
+	}
+	defer f.Close()
+
+	cf := configFile{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&cf)
+	if err != nil {
+		return configFile{}, fmt.Errorf("invalid config %s: %s", configPath, err.Error())
+	}
+	if decoder.More() {
+		return configFile{}, fmt.Errorf("invalid config %s: unexpected data after settings", configPath)
+	}
+
+	// profiles are only applied later, but any mistakes in them are still mistakes.
+	for name, profile := range cf.Profiles {
+		if err := decodeProfile(profile, &Config{}); err != nil {
+			return configFile{}, fmt.Errorf("invalid profile %s in config %s: %s", name, configPath, err.Error())
+		}
+	}
+	return cf, nil
+}
+
+// decodeProfile overrides config with every setting in profile, leaving the rest as is.
+// If profile has any credentials, they replace all of those in config.
+func decodeProfile(profile json.RawMessage, config *Config) error {
+	settings := map[string]json.RawMessage{}
+	if err := json.Unmarshal(profile, &settings); err != nil {
+		return err
+	}
+	for name := range settings {
+		if isCredentialSetting(name) {
+			config.ClearCredentials()
+			break
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(profile))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
+
+// envName converts a setting name to its environment variable, eg. S3AccessKey -> BLOBSYNC_S3_ACCESS_KEY
+// and SignatureSASURL -> BLOBSYNC_SIGNATURE_SASURL
+func envName(name string) string {
+	var sb strings.Builder
+	for i, c := range name {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := rune(name[i-1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) {
+				sb.WriteRune('_')
+			}
+		}
+		sb.WriteRune(unicode.ToUpper(c))
+	}
+	return envPrefix + sb.String()
+}
+
+// applyEnvironment overrides config with any BLOBSYNC_* environment variables that are set.
+// If any are credentials, they replace all of those in config.
+func applyEnvironment(config *Config) error {
+	for _, name := range credentialSettings {
+		if _, ok := os.LookupEnv(envName(name)); ok {
+			config.ClearCredentials()
+			break
+		}
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := envName(t.Field(i).Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		switch v.Field(i).Kind() {
+		case reflect.String:
+			v.Field(i).SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value %s for %s", value, name)
+			}
+			v.Field(i).SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid value %s for %s", value, name)
+			}
+			v.Field(i).SetInt(int64(n))
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value %s for %s", value, name)
+			}
+			v.Field(i).SetFloat(f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package configutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigProfileOverridesZeroValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"AccountName": "base",
+		"S3PathStyle": true,
+		"NoExactSizeMatches": true,
+		"BlockSize": 4096,
+		"MinMatchSize": 200,
+		"Profiles": {
+			"zeroed": {"S3PathStyle": false, "BlockSize": 0},
+			"bad": {"NoSuchSetting": 1}
+		}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(path, "zeroed")
+	if err == nil {
+		t.Fatal("unknown setting in a profile not rejected")
+	}
+
+	err = ioutil.WriteFile(path, []byte(`{
+		"AccountName": "base",
+		"S3PathStyle": true,
+		"NoExactSizeMatches": true,
+		"BlockSize": 4096,
+		"MinMatchSize": 200,
+		"Profiles": {
+			"zeroed": {"S3PathStyle": false, "BlockSize": 0}
+		}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path, "zeroed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// settings in the profile override, even to false or 0. The rest are left alone.
+	if config.S3PathStyle || config.BlockSize != 0 {
+		t.Errorf("profile didnt override: S3PathStyle %v BlockSize %d", config.S3PathStyle, config.BlockSize)
+	}
+	if config.AccountName != "base" || !config.NoExactSizeMatches || config.MinMatchSize != 200 {
+		t.Errorf("settings not in the profile changed: %+v", config)
+	}
+}
+
+func TestLoadConfigCredentialsLayered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"AccountName": "base",
+		"ConnectionString": "DefaultEndpointsProtocol=https;AccountName=base;AccountKey=a2V5",
+		"ClientID": "base-client",
+		"Profiles": {
+			"key": {"accountkey": "profile-key"},
+			"nocredentials": {"BlockSize": 4096}
+		}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a profile with credentials replaces all of those in the file, not just the ones it sets.
+	config, err := LoadConfig(path, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AccountKey != "profile-key" || config.ConnectionString != "" || config.ClientID != "" {
+		t.Errorf("file credentials not replaced by the profile: %+v", config)
+	}
+	if config.AccountName != "base" {
+		t.Errorf("account name changed to %s", config.AccountName)
+	}
+
+	config, err = LoadConfig(path, "nocredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ConnectionString == "" || config.ClientID != "base-client" || config.BlockSize != 4096 {
+		t.Errorf("profile without credentials changed them: %+v", config)
+	}
+
+	// and the environment replaces both.
+	os.Setenv("BLOBSYNC_USE_MANAGED_IDENTITY", "true")
+	defer os.Unsetenv("BLOBSYNC_USE_MANAGED_IDENTITY")
+	config, err = LoadConfig(path, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.UseManagedIdentity || config.AccountKey != "" || config.ConnectionString != "" || config.ClientID != "" {
+		t.Errorf("profile credentials not replaced by the environment: %+v", config)
+	}
+}
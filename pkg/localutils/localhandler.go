@@ -0,0 +1,341 @@
+package localutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+const (
+
+	// directory (within each container) holding staged blocks and block list manifests.
+	metaDirName = ".blobsync"
+
+	manifestFileName = "blocklist.json"
+	stagedDirName    = "staged"
+)
+
+// manifest is the block list of a blob, along with the size and modification time of the blob file it
+// describes. If the file no longer matches (written by something else, or a crash between writing
+// the two) the blocks are no use.
+type manifest struct {
+	Size    int64            `json:"Size"`
+	ModTime int64            `json:"ModTime"`
+	Blocks  []committedBlock `json:"Blocks"`
+}
+
+// committedBlock is a single entry in a blobs block list manifest.
+type committedBlock struct {
+	BlockID string `json:"BlockID"`
+	Offset  int64  `json:"Offset"`
+	Size    int64  `json:"Size"`
+}
+
+// LocalHandler emulates block blob storage on a local directory (or NAS mount).
+// Containers are directories under the root, committed blobs are plain files within them.
+// Staged blocks are individual files and the committed block list is a JSON manifest, both
+// kept under <container>/.blobsync/<sha256 of the blob name>/ so delta uploads can reuse blocks just like Azure.
+// Blob names under .blobsync/ are refused.
+type LocalHandler struct {
+	rootDir string
+
+	TotalBytesUploaded   int64
+	TotalBytesDownloaded int64
+}
+
+func NewLocalHandler(rootDir string) LocalHandler {
+	lh := LocalHandler{}
+	lh.rootDir = rootDir
+	return lh
+}
+
+// blobPath returns the path to the committed blob, making sure it stays within the container.
+func (lh LocalHandler) blobPath(containerName string, blobName string) (string, error) {
+	containerDir := filepath.Join(lh.rootDir, containerName)
+	p := filepath.Join(containerDir, filepath.FromSlash(blobName))
+	if !strings.HasPrefix(p, containerDir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid blob name %s", blobName)
+	}
+	if p == filepath.Join(containerDir, metaDirName) || strings.HasPrefix(p, filepath.Join(containerDir, metaDirName)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("blob name %s is reserved for block lists", blobName)
+	}
+	return p, nil
+}
+
+// metaDir is where the staged blocks and manifest of a blob go. Named after a hash of the blob name, so
+// no blob name can end up inside another blobs directory.
+func (lh LocalHandler) metaDir(containerName string, blobName string) string {
+	sum := sha256.Sum256([]byte(blobName))
+	return filepath.Join(lh.rootDir, containerName, metaDirName, hex.EncodeToString(sum[:]))
+}
+
+func (lh LocalHandler) stagedBlockPath(containerName string, blobName string, blockID string) string {
+	return filepath.Join(lh.metaDir(containerName, blobName), stagedDirName, hex.EncodeToString([]byte(blockID)))
+}
+
+// writeFileAtomically writes to a temp file in the same directory then renames it into place.
+func writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// readManifest returns the committed blocks of the blob at blobPath. None if there is no manifest, or the
+// blob file isnt the one the manifest was written for.
+func (lh LocalHandler) readManifest(containerName string, blobName string, blobPath string) ([]committedBlock, error) {
+	data, err := ioutil.ReadFile(filepath.Join(lh.metaDir(containerName, blobName), manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []committedBlock{}, nil
+		}
+		return nil, err
+	}
+
+	m := manifest{}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []committedBlock{}, nil
+		}
+		return nil, err
+	}
+	if info.Size() != m.Size || info.ModTime().UnixNano() != m.ModTime {
+		return []committedBlock{}, nil
+	}
+	return m.Blocks, nil
+}
+
+// StageBlock stores the block as its own file until the next PutBlockList.
+func (lh *LocalHandler) StageBlock(ctx context.Context, containerName string, blobName string, blockID string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := lh.blobPath(containerName, blobName); err != nil {
+		return err
+	}
+
+	err := writeFileAtomically(lh.stagedBlockPath(containerName, blobName, blockID), data)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&lh.TotalBytesUploaded, int64(len(data)))
+	return nil
+}
+
+// PutBlockList rebuilds the blob from staged blocks and blocks of the currently committed blob.
+// Same as Azure, any staged blocks not in the list are discarded.
+func (lh LocalHandler) PutBlockList(ctx context.Context, uploadedBlockList []signatures.UploadedBlock, containerName string, blobName string) error {
+	blobPath, err := lh.blobPath(containerName, blobName)
+	if err != nil {
+		return err
+	}
+
+	existingBlocks, err := lh.readManifest(containerName, blobName, blobPath)
+	if err != nil {
+		return err
+	}
+	existingLUT := make(map[string]committedBlock)
+	for _, b := range existingBlocks {
+		existingLUT[b.BlockID] = b
+	}
+
+	var existingBlob *os.File
+	if len(existingBlocks) > 0 {
+		existingBlob, err = os.Open(blobPath)
+		if err != nil {
+			return err
+		}
+		defer existingBlob.Close()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+	newBlob, err := ioutil.TempFile(filepath.Dir(blobPath), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(newBlob.Name())
+	defer newBlob.Close()
+
+	newBlocks := []committedBlock{}
+	offset := int64(0)
+	for _, ub := range uploadedBlockList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var data []byte
+		data, err = ioutil.ReadFile(lh.stagedBlockPath(containerName, blobName, ub.BlockID))
+		if os.IsNotExist(err) {
+			existing, ok := existingLUT[ub.BlockID]
+			if !ok {
+				// most likely the blob was written by something else since the signature was made.
+				return signatures.Errorf(signatures.ErrSignatureStale, "block %s is neither staged nor committed for blob %s", ub.BlockID, blobName)
+			}
+			data = make([]byte, existing.Size)
+			_, err = existingBlob.ReadAt(data, existing.Offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err = newBlob.Write(data); err != nil {
+			return err
+		}
+		newBlocks = append(newBlocks, committedBlock{BlockID: ub.BlockID, Offset: offset, Size: int64(len(data))})
+		offset += int64(len(data))
+	}
+
+	if err = newBlob.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(newBlob.Name(), blobPath); err != nil {
+		return err
+	}
+
+	// a crash before the manifest is written leaves the old one, which wont match the new blob.
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return err
+	}
+	m, err := json.Marshal(manifest{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Blocks: newBlocks})
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(filepath.Join(lh.metaDir(containerName, blobName), manifestFileName), m)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(lh.metaDir(containerName, blobName), stagedDirName))
+}
+
+// DownloadBlobRange reads a subsection of a blob.
+// endOffset is inclusive, a negative endOffset reads to the end of the blob.
+func (lh *LocalHandler) DownloadBlobRange(ctx context.Context, buffer *bytes.Buffer, containerName string, blobName string, beginOffset int64, endOffset int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	blobPath, err := lh.blobPath(containerName, blobName)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		return signatures.NewError(signatures.ErrBlobNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var reader io.Reader = io.NewSectionReader(f, beginOffset, 1<<62)
+	if endOffset >= 0 {
+		if endOffset < beginOffset {
+			return errors.New("end offset before begin offset")
+		}
+		reader = io.NewSectionReader(f, beginOffset, endOffset-beginOffset+1)
+	}
+
+	count, err := buffer.ReadFrom(reader)
+	atomic.AddInt64(&lh.TotalBytesDownloaded, count)
+	return err
+}
+
+// DownloadBlob copies the entire blob into file.
+func (lh *LocalHandler) DownloadBlob(ctx context.Context, file *os.File, containerName string, blobName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	blobPath, err := lh.blobPath(containerName, blobName)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		return signatures.NewError(signatures.ErrBlobNotFound, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count, err := io.Copy(file, f)
+	atomic.AddInt64(&lh.TotalBytesDownloaded, count)
+	return err
+}
+
+// GetBlobProperties returns the size of the blob, and an ETag made from its size and modification time.
+func (lh LocalHandler) GetBlobProperties(ctx context.Context, containerName string, blobName string) (*signatures.BlobProperties, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	blobPath, err := lh.blobPath(containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(blobPath)
+	if os.IsNotExist(err) {
+		return nil, signatures.NewError(signatures.ErrBlobNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	etag := fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+	return &signatures.BlobProperties{Size: info.Size(), ETag: etag, LastModified: info.ModTime()}, nil
+}
+
+func (lh LocalHandler) BlobExist(ctx context.Context, containerName string, blobName string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	blobPath, err := lh.blobPath(containerName, blobName)
+	if err != nil {
+		return false
+	}
+
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return false
+	}
+	return !info.IsDir()
+}
@@ -0,0 +1,176 @@
+package localutils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+func newTestLocalHandler(t *testing.T) (*LocalHandler, func()) {
+	dir, err := ioutil.TempDir("", "localhandler_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lh := NewLocalHandler(dir)
+	return &lh, func() { os.RemoveAll(dir) }
+}
+
+// put stages the blocks in staged (by block ID) and commits blockIDs.
+func put(t *testing.T, lh *LocalHandler, blobName string, staged map[string]string, blockIDs ...string) error {
+	ctx := context.Background()
+	for blockID, data := range staged {
+		if err := lh.StageBlock(ctx, "cont", blobName, blockID, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uploaded := []signatures.UploadedBlock{}
+	for _, blockID := range blockIDs {
+		uploaded = append(uploaded, signatures.UploadedBlock{BlockID: blockID})
+	}
+	return lh.PutBlockList(ctx, uploaded, "cont", blobName)
+}
+
+func checkBlob(t *testing.T, lh *LocalHandler, blobName string, want string) {
+	buffer := bytes.Buffer{}
+	if err := lh.DownloadBlobRange(context.Background(), &buffer, "cont", blobName, 0, -1); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != want {
+		t.Fatalf("blob %s is %q, want %q", blobName, buffer.String(), want)
+	}
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	lh, cleanup := newTestLocalHandler(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if lh.BlobExist(ctx, "cont", "dir/blob") {
+		t.Fatal("blob exists before upload")
+	}
+	if err := put(t, lh, "dir/blob", map[string]string{"a": "hello ", "b": "world"}, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, lh, "dir/blob", "hello world")
+	if !lh.BlobExist(ctx, "cont", "dir/blob") {
+		t.Fatal("blob doesnt exist after upload")
+	}
+
+	buffer := bytes.Buffer{}
+	if err := lh.DownloadBlobRange(ctx, &buffer, "cont", "dir/blob", 6, 8); err != nil || buffer.String() != "wor" {
+		t.Errorf("range is %q (%v)", buffer.String(), err)
+	}
+	props, err := lh.GetBlobProperties(ctx, "cont", "dir/blob")
+	if err != nil || props.Size != 11 || props.ETag == "" {
+		t.Errorf("wrong properties %+v (%v)", props, err)
+	}
+	if _, err := lh.GetBlobProperties(ctx, "cont", "missing"); !errors.Is(err, signatures.ErrBlobNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestLocalDeltaReuse(t *testing.T) {
+	lh, cleanup := newTestLocalHandler(t)
+	defer cleanup()
+
+	if err := put(t, lh, "blob", map[string]string{"a": "aaa", "b": "bbb", "c": "ccc"}, "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	// committed blocks reused in any order, alongside new ones.
+	if err := put(t, lh, "blob", map[string]string{"d": "dd"}, "c", "d", "a"); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, lh, "blob", "cccddaaa")
+	if err := put(t, lh, "blob", nil, "d", "d"); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, lh, "blob", "dddd")
+
+	// b was dropped by the second commit.
+	if err := put(t, lh, "blob", nil, "b"); err == nil {
+		t.Error("block no longer committed reused")
+	}
+	checkBlob(t, lh, "blob", "dddd")
+}
+
+func TestLocalDiscardsUnusedStagedBlocks(t *testing.T) {
+	lh, cleanup := newTestLocalHandler(t)
+	defer cleanup()
+
+	if err := put(t, lh, "blob", map[string]string{"a": "aaa", "unused": "xxx"}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, lh, "blob", "aaa")
+	if _, err := os.Stat(filepath.Join(lh.metaDir("cont", "blob"), stagedDirName)); !os.IsNotExist(err) {
+		t.Errorf("staged blocks left behind: %v", err)
+	}
+	if err := put(t, lh, "blob", nil, "unused"); err == nil {
+		t.Error("discarded staged block committed")
+	}
+}
+
+func TestLocalExternalOverwrite(t *testing.T) {
+	lh, cleanup := newTestLocalHandler(t)
+	defer cleanup()
+
+	if err := put(t, lh, "blob", map[string]string{"a": "aaa", "b": "bbb"}, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwritten by something else, same size but a different modification time.
+	blobPath, _ := lh.blobPath("cont", "blob")
+	if err := ioutil.WriteFile(blobPath, []byte("xxxyyy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(blobPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	err := put(t, lh, "blob", map[string]string{"c": "ccc"}, "a", "c")
+	if !errors.Is(err, signatures.ErrSignatureStale) {
+		t.Fatalf("expected a stale error, got %v", err)
+	}
+	checkBlob(t, lh, "blob", "xxxyyy")
+
+	// all new blocks are fine.
+	if err := put(t, lh, "blob", map[string]string{"c": "ccc"}, "c"); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, lh, "blob", "ccc")
+}
+
+func TestLocalBlobNames(t *testing.T) {
+	lh, cleanup := newTestLocalHandler(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, name := range []string{".blobsync", ".blobsync/x/blocklist.json", "../escape", "a/../../escape"} {
+		if err := lh.StageBlock(ctx, "cont", name, "a", []byte("x")); err == nil {
+			t.Errorf("blob name %s accepted", name)
+		}
+	}
+
+	// blobs whose names nest inside each other keep their blocks and manifests apart.
+	metaA, metaAStaged := lh.metaDir("cont", "a"), lh.metaDir("cont", "a/staged")
+	if filepath.Dir(metaA) != filepath.Dir(metaAStaged) || metaA == metaAStaged {
+		t.Errorf("metadata directories %s and %s overlap", metaA, metaAStaged)
+	}
+	if err := put(t, lh, "a/staged", map[string]string{"x": "from a/staged"}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lh.StageBlock(ctx, "cont", "a", "x", []byte("from a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(t, lh, "a/staged", nil, "x"); err != nil {
+		t.Fatal(err)
+	}
+	checkBlob(t, lh, "a/staged", "from a/staged")
+}
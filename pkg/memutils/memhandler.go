@@ -0,0 +1,346 @@
+package memutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// Operation names recorded in Call.Op
+const (
+	OpStageBlock        = "StageBlock"
+	OpPutBlockList      = "PutBlockList"
+	OpGetBlockList      = "GetBlockList"
+	OpDownloadBlobRange = "DownloadBlobRange"
+	OpDownloadBlob      = "DownloadBlob"
+	OpGetBlobProperties = "GetBlobProperties"
+	OpBlobExist         = "BlobExist"
+)
+
+// ErrBlobNotFound is signatures.ErrBlobNotFound, so callers can check either.
+var ErrBlobNotFound = signatures.ErrBlobNotFound
+
+// Call records a single operation made against the MemHandler.
+type Call struct {
+	Op            string
+	ContainerName string
+	BlobName      string
+	BlockID       string
+	BlockIDs      []string
+	BeginOffset   int64
+	EndOffset     int64
+	Size          int64
+}
+
+// BlockInfo describes a staged or committed block.
+type BlockInfo struct {
+	BlockID string
+	Size    int64
+}
+
+// BlobProperties is the subset of blob properties the fake keeps track of.
+type BlobProperties = signatures.BlobProperties
+
+type memBlob struct {
+	data            []byte
+	committedBlocks []BlockInfo
+	stagedBlocks    map[string][]byte
+	etag            string
+	lastModified    time.Time
+	committed       bool
+}
+
+// MemHandler is an in-memory block blob store. It implements the same operations BlobSync uses
+// from azureutils.BlobHandler so the sync logic can be exercised without a storage account.
+// Every operation is recorded in Calls, and OnCall (if set) can inject errors before an operation runs.
+type MemHandler struct {
+	lock sync.Mutex
+
+	// containerName -> blobName -> blob
+	containers map[string]map[string]*memBlob
+	etagCount  int64
+
+	// Calls made so far, in order.
+	Calls []Call
+
+	// OnCall is called before each operation. Returning an error fails the operation with that error.
+	// It is called with the handler locked so must not call back into the MemHandler.
+	OnCall func(call Call) error
+
+	TotalBytesUploaded   int64
+	TotalBytesDownloaded int64
+}
+
+func NewMemHandler() *MemHandler {
+	mh := MemHandler{}
+	mh.containers = make(map[string]map[string]*memBlob)
+	mh.Calls = []Call{}
+	return &mh
+}
+
+// record must be called with the lock held. Calls are recorded even if ctx is already cancelled,
+// so OnCall can cancel the context mid sync and see what happened next.
+func (mh *MemHandler) record(ctx context.Context, call Call) error {
+	mh.Calls = append(mh.Calls, call)
+	if mh.OnCall != nil {
+		if err := mh.OnCall(call); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// getBlob returns the blob, creating an empty uncommitted one if requested.
+func (mh *MemHandler) getBlob(containerName string, blobName string, create bool) *memBlob {
+	container, ok := mh.containers[containerName]
+	if !ok {
+		if !create {
+			return nil
+		}
+		container = make(map[string]*memBlob)
+		mh.containers[containerName] = container
+	}
+
+	blob, ok := container[blobName]
+	if !ok {
+		if !create {
+			return nil
+		}
+		blob = &memBlob{stagedBlocks: make(map[string][]byte)}
+		container[blobName] = blob
+	}
+	return blob
+}
+
+func (mh *MemHandler) getCommittedBlob(containerName string, blobName string) (*memBlob, error) {
+	blob := mh.getBlob(containerName, blobName, false)
+	if blob == nil || !blob.committed {
+		return nil, ErrBlobNotFound
+	}
+	return blob, nil
+}
+
+func (mh *MemHandler) nextETag() string {
+	mh.etagCount++
+	return fmt.Sprintf("\"0x%X\"", mh.etagCount)
+}
+
+// PutBlob sets the committed content of a blob directly, as a single block. Handy for seeding tests.
+func (mh *MemHandler) PutBlob(containerName string, blobName string, data []byte) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	blob := mh.getBlob(containerName, blobName, true)
+	blob.data = append([]byte{}, data...)
+	blob.committedBlocks = []BlockInfo{{BlockID: "seed", Size: int64(len(data))}}
+	blob.stagedBlocks = make(map[string][]byte)
+	blob.etag = mh.nextETag()
+	blob.lastModified = time.Now()
+	blob.committed = true
+}
+
+// Blob returns a copy of the committed content of a blob.
+func (mh *MemHandler) Blob(containerName string, blobName string) ([]byte, bool) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	blob, err := mh.getCommittedBlob(containerName, blobName)
+	if err != nil {
+		return nil, false
+	}
+	return append([]byte{}, blob.data...), true
+}
+
+// ResetCalls clears the recorded calls.
+func (mh *MemHandler) ResetCalls() {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	mh.Calls = []Call{}
+}
+
+// CallsFor returns the recorded calls for a given operation.
+func (mh *MemHandler) CallsFor(op string) []Call {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	l := []Call{}
+	for _, c := range mh.Calls {
+		if c.Op == op {
+			l = append(l, c)
+		}
+	}
+	return l
+}
+
+func (mh *MemHandler) StageBlock(ctx context.Context, containerName string, blobName string, blockID string, data []byte) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	err := mh.record(ctx, Call{Op: OpStageBlock, ContainerName: containerName, BlobName: blobName, BlockID: blockID, Size: int64(len(data))})
+	if err != nil {
+		return err
+	}
+
+	blob := mh.getBlob(containerName, blobName, true)
+	blob.stagedBlocks[blockID] = append([]byte{}, data...)
+	mh.TotalBytesUploaded += int64(len(data))
+	return nil
+}
+
+// PutBlockList commits the listed blocks, taking each from the staged blocks first and then
+// from the currently committed blocks. Unused staged blocks are discarded.
+func (mh *MemHandler) PutBlockList(ctx context.Context, uploadedBlockList []signatures.UploadedBlock, containerName string, blobName string) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	blockIDs := []string{}
+	for _, b := range uploadedBlockList {
+		blockIDs = append(blockIDs, b.BlockID)
+	}
+
+	err := mh.record(ctx, Call{Op: OpPutBlockList, ContainerName: containerName, BlobName: blobName, BlockIDs: blockIDs})
+	if err != nil {
+		return err
+	}
+
+	blob := mh.getBlob(containerName, blobName, true)
+
+	committedLUT := make(map[string][]byte)
+	offset := int64(0)
+	for _, b := range blob.committedBlocks {
+		committedLUT[b.BlockID] = blob.data[offset : offset+b.Size]
+		offset += b.Size
+	}
+
+	newData := []byte{}
+	newBlocks := []BlockInfo{}
+	for _, blockID := range blockIDs {
+		data, ok := blob.stagedBlocks[blockID]
+		if !ok {
+			data, ok = committedLUT[blockID]
+			if !ok {
+				return fmt.Errorf("invalid block list, block %s not found", blockID)
+			}
+		}
+		newData = append(newData, data...)
+		newBlocks = append(newBlocks, BlockInfo{BlockID: blockID, Size: int64(len(data))})
+	}
+
+	blob.data = newData
+	blob.committedBlocks = newBlocks
+	blob.stagedBlocks = make(map[string][]byte)
+	blob.etag = mh.nextETag()
+	blob.lastModified = time.Now()
+	blob.committed = true
+	return nil
+}
+
+// GetBlockList returns the committed and uncommitted (staged) blocks of a blob.
+func (mh *MemHandler) GetBlockList(ctx context.Context, containerName string, blobName string) ([]BlockInfo, []BlockInfo, error) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	err := mh.record(ctx, Call{Op: OpGetBlockList, ContainerName: containerName, BlobName: blobName})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blob := mh.getBlob(containerName, blobName, false)
+	if blob == nil {
+		return nil, nil, ErrBlobNotFound
+	}
+
+	committed := append([]BlockInfo{}, blob.committedBlocks...)
+	uncommitted := []BlockInfo{}
+	for blockID, data := range blob.stagedBlocks {
+		uncommitted = append(uncommitted, BlockInfo{BlockID: blockID, Size: int64(len(data))})
+	}
+	return committed, uncommitted, nil
+}
+
+// DownloadBlobRange appends a subsection of a blob to buffer.
+// endOffset is inclusive, a negative endOffset reads to the end of the blob.
+func (mh *MemHandler) DownloadBlobRange(ctx context.Context, buffer *bytes.Buffer, containerName string, blobName string, beginOffset int64, endOffset int64) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	err := mh.record(ctx, Call{Op: OpDownloadBlobRange, ContainerName: containerName, BlobName: blobName, BeginOffset: beginOffset, EndOffset: endOffset})
+	if err != nil {
+		return err
+	}
+
+	blob, err := mh.getCommittedBlob(containerName, blobName)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(blob.data))
+	if endOffset < 0 || endOffset >= size {
+		endOffset = size - 1
+	}
+	if beginOffset < 0 || (beginOffset > endOffset && size > 0) {
+		return fmt.Errorf("invalid range %d-%d for blob of size %d", beginOffset, endOffset, size)
+	}
+
+	if size > 0 {
+		buffer.Write(blob.data[beginOffset : endOffset+1])
+		mh.TotalBytesDownloaded += endOffset - beginOffset + 1
+	}
+	return nil
+}
+
+// DownloadBlob writes the entire blob to file.
+func (mh *MemHandler) DownloadBlob(ctx context.Context, file *os.File, containerName string, blobName string) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	err := mh.record(ctx, Call{Op: OpDownloadBlob, ContainerName: containerName, BlobName: blobName})
+	if err != nil {
+		return err
+	}
+
+	blob, err := mh.getCommittedBlob(containerName, blobName)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(blob.data)
+	mh.TotalBytesDownloaded += int64(len(blob.data))
+	return err
+}
+
+func (mh *MemHandler) GetBlobProperties(ctx context.Context, containerName string, blobName string) (*BlobProperties, error) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	err := mh.record(ctx, Call{Op: OpGetBlobProperties, ContainerName: containerName, BlobName: blobName})
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := mh.getCommittedBlob(containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobProperties{Size: int64(len(blob.data)), ETag: blob.etag, LastModified: blob.lastModified}, nil
+}
+
+func (mh *MemHandler) BlobExist(ctx context.Context, containerName string, blobName string) bool {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	// BlobExist has no way to return an error, so OnCall can only observe it.
+	_ = mh.record(ctx, Call{Op: OpBlobExist, ContainerName: containerName, BlobName: blobName})
+	if ctx.Err() != nil {
+		return false
+	}
+
+	_, err := mh.getCommittedBlob(containerName, blobName)
+	return err == nil
+}
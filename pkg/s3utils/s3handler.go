@@ -0,0 +1,805 @@
+package s3utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+const (
+
+	// S3 rejects parts smaller than this, except for the last one.
+	MinPartSize int64 = 5 * 1024 * 1024
+
+	// Size of parts built from new (or too small to copy) data, unless the object is so large
+	// that would take more than MaxPartCount parts.
+	PartSize int64 = 16 * 1024 * 1024
+
+	// Largest range a single UploadPartCopy can copy.
+	MaxCopyPartSize int64 = 5 * 1024 * 1024 * 1024
+
+	// Largest part S3 accepts, and the most parts an object can be made of.
+	MaxPartSize  int64 = 5 * 1024 * 1024 * 1024
+	MaxPartCount       = 10000
+
+	// the blocks making up each object are recorded in <blockListPrefix><key>. Blob names under
+	// the prefix are refused, so they cant clash with a real object.
+	blockListPrefix = ".blobsync/blocklists/"
+)
+
+// committedBlock is a single entry in the block list stored alongside each object.
+type committedBlock struct {
+	BlockID string `json:"BlockID"`
+	Offset  int64  `json:"Offset"`
+	Size    int64  `json:"Size"`
+}
+
+// blockList is stored alongside each object, the blocks it is made of and the ETag of the object they
+// describe. If the object has since been written by something else the blocks are no use.
+type blockList struct {
+	ETag   string           `json:"ETag"`
+	Blocks []committedBlock `json:"Blocks"`
+}
+
+// segment is a run of the new object, either staged (new) data or a byte range copied from the existing object.
+type segment struct {
+	stagedPath string
+
+	isCopy     bool
+	copyOffset int64
+	copyETag   string
+
+	size int64
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	ETag string `xml:"ETag"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type copyPartResult struct {
+	ETag string `xml:"ETag"`
+}
+
+type createBucketConfiguration struct {
+	XMLName            xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CreateBucketConfiguration"`
+	LocationConstraint string   `xml:"LocationConstraint"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// S3Handler stores blobs in S3 (or anything speaking the S3 API, eg. MinIO).
+// Containers map to buckets and blobs to object keys.
+// S3 has no staged blocks, so StageBlock spools blocks to a local temp directory and PutBlockList
+// builds the object with a multipart upload: new data goes up with UploadPart and blocks reused from
+// the previous version of the object are copied server side with UploadPartCopy.
+// The block list (block ID, offset and size) of each object is kept in .blobsync/blocklists/<key>, along
+// with the ETag of the object. Copies are made conditional on that ETag, so an object changed by something
+// else is never stitched together with blocks that no longer exist.
+type S3Handler struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+
+	httpClient *http.Client
+
+	lock           sync.Mutex
+	stagingDir     string
+	stagedBlocks   map[string]map[string]string // bucket/key -> blockID -> spooled file
+	createdBuckets map[string]bool
+
+	TotalBytesUploaded   int64
+	TotalBytesDownloaded int64
+}
+
+// NewS3Handler creates an S3Handler. endpoint is the base URL of the service, eg. https://s3.us-east-1.amazonaws.com
+// or http://127.0.0.1:9000. pathStyle puts the bucket in the path instead of the host (needed for most stand-ins).
+func NewS3Handler(endpoint string, region string, accessKey string, secretKey string, pathStyle bool) (*S3Handler, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported S3 endpoint %s", endpoint)
+	}
+
+	sh := S3Handler{}
+	sh.endpoint = u
+	sh.region = region
+	sh.accessKey = accessKey
+	sh.secretKey = secretKey
+	sh.pathStyle = pathStyle
+	sh.httpClient = &http.Client{}
+	sh.stagedBlocks = make(map[string]map[string]string)
+	sh.createdBuckets = make(map[string]bool)
+	return &sh, nil
+}
+
+func (sh *S3Handler) objectURL(bucket string, key string, query map[string]string) *url.URL {
+	u := *sh.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if sh.pathStyle {
+		path += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	if key != "" {
+		path += "/" + key
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	u.Path = path
+	u.RawPath = awsURIEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do signs and executes a request. Any non 2xx response is turned into an error.
+func (sh *S3Handler) do(ctx context.Context, method string, bucket string, key string, query map[string]string, headers map[string]string, body []byte) (*http.Response, error) {
+	u := sh.objectURL(bucket, key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// NewRequestWithContext re-parses the URL, make sure the exact encoding we sign is used.
+	req.URL = u
+	req.ContentLength = int64(len(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	signRequest(req, sha256Hex(body), sh.accessKey, sh.secretKey, sh.region, time.Now())
+
+	resp, err := sh.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, signatures.NewError(signatures.ErrTransient, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp, newResponseError(resp.StatusCode, respBody)
+	}
+	return resp, nil
+}
+
+// doAndRead is do, but reads (and closes) the response body.
+func (sh *S3Handler) doAndRead(ctx context.Context, method string, bucket string, key string, query map[string]string, headers map[string]string, body []byte) (*http.Response, []byte, error) {
+	resp, err := sh.do(ctx, method, bucket, key, query, headers, body)
+	if err != nil {
+		return resp, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+
+	// some operations (eg. CompleteMultipartUpload) can fail with a 200 status.
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return resp, nil, newResponseError(resp.StatusCode, respBody)
+	}
+	return resp, respBody, nil
+}
+
+// ResponseError is a non successful response from the S3 service.
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("s3 request failed with status %d: %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is maps the status onto the signatures.Err* kinds.
+func (e *ResponseError) Is(target error) bool {
+	switch target {
+	case signatures.ErrBlobNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case signatures.ErrPreconditionFailed:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case signatures.ErrTransient:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+func newResponseError(statusCode int, body []byte) error {
+	e := s3Error{}
+	_ = xml.Unmarshal(body, &e)
+	return &ResponseError{StatusCode: statusCode, Code: e.Code, Message: e.Message}
+}
+
+func isNotFound(err error) bool {
+	var respErr *ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+// ensureBucket creates the bucket the first time we write to it, if it doesnt exist. Same as the Azure
+// handler creating containers. Credentials that cant check the bucket (403) are assumed to be for
+// an existing one, the writes will fail soon enough if not.
+func (sh *S3Handler) ensureBucket(ctx context.Context, bucket string) error {
+	sh.lock.Lock()
+	created := sh.createdBuckets[bucket]
+	sh.lock.Unlock()
+	if created {
+		return nil
+	}
+
+	_, _, err := sh.doAndRead(ctx, http.MethodHead, bucket, "", nil, nil, nil)
+	var respErr *ResponseError
+	if isNotFound(err) {
+		err = sh.createBucket(ctx, bucket)
+	} else if errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sh.lock.Lock()
+	sh.createdBuckets[bucket] = true
+	sh.lock.Unlock()
+	return nil
+}
+
+// createBucket creates the bucket in the handlers region. us-east-1 (or no region) is the
+// default location, anywhere else has to be asked for.
+func (sh *S3Handler) createBucket(ctx context.Context, bucket string) error {
+	var body []byte
+	if sh.region != "" && sh.region != "us-east-1" {
+		var err error
+		body, err = xml.Marshal(createBucketConfiguration{LocationConstraint: sh.region})
+		if err != nil {
+			return err
+		}
+	}
+
+	// someone else may have just created it.
+	_, _, err := sh.doAndRead(ctx, http.MethodPut, bucket, "", nil, nil, body)
+	var respErr *ResponseError
+	if errors.As(err, &respErr) && (respErr.Code == "BucketAlreadyOwnedByYou" || respErr.Code == "BucketAlreadyExists") {
+		return nil
+	}
+	return err
+}
+
+// StageBlock spools the block to a temp file until PutBlockList is called.
+func (sh *S3Handler) StageBlock(ctx context.Context, containerName string, blobName string, blockID string, data []byte) error {
+	if err := checkBlobName(blobName); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stagingDir, err := sh.getStagingDir()
+	if err != nil {
+		return err
+	}
+
+	// only the map is shared, the blocks are written in parallel.
+	f, err := ioutil.TempFile(stagingDir, "block")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	objectKey := containerName + "/" + blobName
+	blocks, ok := sh.stagedBlocks[objectKey]
+	if !ok {
+		blocks = make(map[string]string)
+		sh.stagedBlocks[objectKey] = blocks
+	}
+	if existing, ok := blocks[blockID]; ok {
+		os.Remove(existing)
+	}
+	blocks[blockID] = f.Name()
+	return nil
+}
+
+// getStagingDir returns the directory blocks are spooled to, creating it the first time.
+func (sh *S3Handler) getStagingDir() (string, error) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	if sh.stagingDir == "" {
+		dir, err := ioutil.TempDir("", "blobsync-s3")
+		if err != nil {
+			return "", err
+		}
+		sh.stagingDir = dir
+	}
+	return sh.stagingDir, nil
+}
+
+// takeStagedBlocks removes (and returns) the staged blocks for an object.
+func (sh *S3Handler) takeStagedBlocks(containerName string, blobName string) map[string]string {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	objectKey := containerName + "/" + blobName
+	blocks, ok := sh.stagedBlocks[objectKey]
+	if !ok {
+		return make(map[string]string)
+	}
+	delete(sh.stagedBlocks, objectKey)
+	return blocks
+}
+
+// checkBlobName refuses blob names that would land amongst the block lists.
+func checkBlobName(blobName string) error {
+	if strings.HasPrefix(blobName, blockListPrefix) {
+		return fmt.Errorf("blob name %s is reserved for block lists", blobName)
+	}
+	return nil
+}
+
+// readBlockList returns the block list of the object. The list is empty if there is no object, or
+// the object isnt the one the list was written for.
+func (sh *S3Handler) readBlockList(ctx context.Context, bucket string, key string) (*blockList, error) {
+	_, body, err := sh.doAndRead(ctx, http.MethodGet, bucket, blockListPrefix+key, nil, nil, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return &blockList{}, nil
+		}
+		return nil, err
+	}
+
+	list := blockList{}
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	props, err := sh.GetBlobProperties(ctx, bucket, key)
+	if err != nil {
+		if isNotFound(err) {
+			return &blockList{}, nil
+		}
+		return nil, err
+	}
+	if list.ETag == "" || props.ETag != list.ETag {
+		return &blockList{}, nil
+	}
+	return &list, nil
+}
+
+// PutBlockList builds the new object from the staged blocks and byte ranges of the existing object.
+// Any staged blocks not in the list are discarded.
+func (sh *S3Handler) PutBlockList(ctx context.Context, uploadedBlockList []signatures.UploadedBlock, containerName string, blobName string) error {
+	if err := checkBlobName(blobName); err != nil {
+		return err
+	}
+
+	stagedBlocks := sh.takeStagedBlocks(containerName, blobName)
+	defer func() {
+		for _, path := range stagedBlocks {
+			os.Remove(path)
+		}
+	}()
+
+	if err := sh.ensureBucket(ctx, containerName); err != nil {
+		return err
+	}
+
+	committed, err := sh.readBlockList(ctx, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	existingLUT := make(map[string]committedBlock)
+	for _, b := range committed.Blocks {
+		existingLUT[b.BlockID] = b
+	}
+
+	segments := []segment{}
+	newBlocks := []committedBlock{}
+	totalSize := int64(0)
+	for _, ub := range uploadedBlockList {
+		var seg segment
+		if path, ok := stagedBlocks[ub.BlockID]; ok {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			seg = segment{stagedPath: path, size: info.Size()}
+		} else if existing, ok := existingLUT[ub.BlockID]; ok {
+			seg = segment{isCopy: true, copyOffset: existing.Offset, copyETag: committed.ETag, size: existing.Size}
+		} else {
+			// most likely the object was written by something else since the signature was made.
+			return signatures.Errorf(signatures.ErrSignatureStale, "block %s is neither staged nor committed for object %s", ub.BlockID, blobName)
+		}
+
+		// merge copies that are contiguous in the existing object, fewer and larger parts.
+		last := len(segments) - 1
+		if seg.isCopy && last >= 0 && segments[last].isCopy && segments[last].copyOffset+segments[last].size == seg.copyOffset {
+			segments[last].size += seg.size
+		} else {
+			segments = append(segments, seg)
+		}
+
+		newBlocks = append(newBlocks, committedBlock{BlockID: ub.BlockID, Offset: totalSize, Size: seg.size})
+		totalSize += seg.size
+	}
+
+	var etag string
+	if totalSize < MinPartSize {
+		etag, err = sh.putSmallObject(ctx, segments, containerName, blobName)
+	} else {
+		etag, err = sh.putMultipartObject(ctx, segments, totalSize, containerName, blobName)
+	}
+	if err != nil {
+		return err
+	}
+	if etag == "" {
+		props, err := sh.GetBlobProperties(ctx, containerName, blobName)
+		if err != nil {
+			return err
+		}
+		etag = props.ETag
+	}
+
+	list, err := json.Marshal(blockList{ETag: etag, Blocks: newBlocks})
+	if err != nil {
+		return err
+	}
+	_, _, err = sh.doAndRead(ctx, http.MethodPut, containerName, blockListPrefix+blobName, nil, nil, list)
+	return err
+}
+
+// readSegment returns the bytes of a segment, either from the spooled file or the existing object.
+func (sh *S3Handler) readSegment(ctx context.Context, seg segment, offset int64, size int64, bucket string, key string) ([]byte, error) {
+	if !seg.isCopy {
+		f, err := os.Open(seg.stagedPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		data := make([]byte, size)
+		_, err = f.ReadAt(data, offset)
+		return data, err
+	}
+
+	buffer := bytes.Buffer{}
+	err := sh.downloadRange(ctx, &buffer, bucket, key, seg.copyOffset+offset, seg.copyOffset+offset+size-1, seg.copyETag)
+	return buffer.Bytes(), err
+}
+
+// putSmallObject is used when the whole object is under MinPartSize, so cannot be a multipart upload
+// with copied parts. Just assemble it locally and PUT it. Returns the ETag of the new object.
+func (sh *S3Handler) putSmallObject(ctx context.Context, segments []segment, bucket string, key string) (string, error) {
+	data := []byte{}
+	for _, seg := range segments {
+		segData, err := sh.readSegment(ctx, seg, 0, seg.size, bucket, key)
+		if err != nil {
+			return "", err
+		}
+		data = append(data, segData...)
+	}
+
+	resp, _, err := sh.doAndRead(ctx, http.MethodPut, bucket, key, nil, nil, data)
+	if err != nil {
+		return "", err
+	}
+	atomic.AddInt64(&sh.TotalBytesUploaded, int64(len(data)))
+	return resp.Header.Get("ETag"), nil
+}
+
+// multipartUpload tracks the parts of an in progress multipart upload.
+type multipartUpload struct {
+	sh       *S3Handler
+	bucket   string
+	key      string
+	uploadID string
+	parts    []completedPart
+
+	// largest part built from new data, and largest range copied as a single part.
+	partSize    int64
+	maxCopySize int64
+
+	pending bytes.Buffer
+}
+
+// partSizeFor is the size of the parts built from new data for an object of totalSize bytes. PartSize unless
+// that takes more than MaxPartCount parts (over 156GiB), then as large as it needs to be.
+func partSizeFor(totalSize int64) (int64, error) {
+	partSize := PartSize
+	if minPartSize := (totalSize + MaxPartCount - 1) / MaxPartCount; minPartSize > partSize {
+		partSize = minPartSize
+	}
+	if partSize > MaxPartSize {
+		return 0, fmt.Errorf("object of %d bytes is too large for S3", totalSize)
+	}
+	return partSize, nil
+}
+
+// nextPartNumber is the number of the part about to be uploaded.
+func (mu *multipartUpload) nextPartNumber() (int, error) {
+	partNumber := len(mu.parts) + 1
+	if partNumber > MaxPartCount {
+		// only possible with lots of copied ranges, each has to be its own part.
+		return 0, fmt.Errorf("object %s needs more than %d parts, too fragmented to copy the reused blocks", mu.key, MaxPartCount)
+	}
+	return partNumber, nil
+}
+
+func (mu *multipartUpload) uploadPart(ctx context.Context) error {
+	partNumber, err := mu.nextPartNumber()
+	if err != nil {
+		return err
+	}
+	query := map[string]string{"partNumber": strconv.Itoa(partNumber), "uploadId": mu.uploadID}
+	resp, _, err := mu.sh.doAndRead(ctx, http.MethodPut, mu.bucket, mu.key, query, nil, mu.pending.Bytes())
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&mu.sh.TotalBytesUploaded, int64(mu.pending.Len()))
+	mu.parts = append(mu.parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	mu.pending.Reset()
+	return nil
+}
+
+// uploadPartCopy copies a range of the existing object, as long as its ETag is still etag.
+func (mu *multipartUpload) uploadPartCopy(ctx context.Context, beginOffset int64, endOffset int64, etag string) error {
+	partNumber, err := mu.nextPartNumber()
+	if err != nil {
+		return err
+	}
+	query := map[string]string{"partNumber": strconv.Itoa(partNumber), "uploadId": mu.uploadID}
+	headers := map[string]string{
+		"x-amz-copy-source":          awsURIEncode("/"+mu.bucket+"/"+mu.key, false),
+		"x-amz-copy-source-range":    fmt.Sprintf("bytes=%d-%d", beginOffset, endOffset),
+		"x-amz-copy-source-if-match": etag,
+	}
+	_, body, err := mu.sh.doAndRead(ctx, http.MethodPut, mu.bucket, mu.key, query, headers, nil)
+	if err != nil {
+		return err
+	}
+
+	result := copyPartResult{}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	mu.parts = append(mu.parts, completedPart{PartNumber: partNumber, ETag: result.ETag})
+	return nil
+}
+
+// putMultipartObject uploads the segments as parts. Copied ranges large enough to be their own part(s)
+// are copied server side, everything else is gathered into pending and uploaded. Returns the ETag of the
+// new object.
+func (sh *S3Handler) putMultipartObject(ctx context.Context, segments []segment, totalSize int64, bucket string, key string) (string, error) {
+	partSize, err := partSizeFor(totalSize)
+	if err != nil {
+		return "", err
+	}
+	mu := multipartUpload{sh: sh, bucket: bucket, key: key, partSize: partSize, maxCopySize: MaxCopyPartSize}
+	return mu.upload(ctx, segments)
+}
+
+// upload creates the object from segments with a multipart upload, aborting it if anything fails.
+// Returns the ETag of the new object.
+func (mu *multipartUpload) upload(ctx context.Context, segments []segment) (string, error) {
+	_, body, err := mu.sh.doAndRead(ctx, http.MethodPost, mu.bucket, mu.key, map[string]string{"uploads": ""}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	result := initiateMultipartUploadResult{}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	mu.uploadID = result.UploadID
+
+	err = mu.addSegments(ctx, segments)
+	if err == nil && mu.pending.Len() > 0 {
+		err = mu.uploadPart(ctx)
+	}
+	completed := completeMultipartUploadResult{}
+	if err == nil {
+		completeBody, _ := xml.Marshal(completeMultipartUpload{Parts: mu.parts})
+		_, body, err = mu.sh.doAndRead(ctx, http.MethodPost, mu.bucket, mu.key, map[string]string{"uploadId": mu.uploadID}, nil, completeBody)
+		if err == nil {
+			err = xml.Unmarshal(body, &completed)
+		}
+	}
+
+	if err != nil {
+		// abort with a fresh context, ctx may be why we are here.
+		_, _, _ = mu.sh.doAndRead(context.Background(), http.MethodDelete, mu.bucket, mu.key, map[string]string{"uploadId": mu.uploadID}, nil, nil)
+		return "", err
+	}
+	return completed.ETag, nil
+}
+
+func (mu *multipartUpload) addSegments(ctx context.Context, segments []segment) error {
+	for _, seg := range segments {
+		offset := int64(0)
+		for offset < seg.size {
+			remaining := seg.size - offset
+
+			// copy directly if we can. Pending data has to go first, so top it up to MinPartSize
+			// from the start of this range (if that leaves enough for a copied part).
+			if seg.isCopy && remaining >= MinPartSize {
+				if mu.pending.Len() > 0 {
+					fill := MinPartSize - int64(mu.pending.Len())
+					if fill > 0 && remaining-fill >= MinPartSize {
+						data, err := mu.sh.readSegment(ctx, seg, offset, fill, mu.bucket, mu.key)
+						if err != nil {
+							return err
+						}
+						mu.pending.Write(data)
+						offset += fill
+						remaining -= fill
+					}
+					if int64(mu.pending.Len()) >= MinPartSize {
+						if err := mu.uploadPart(ctx); err != nil {
+							return err
+						}
+					}
+				}
+
+				if mu.pending.Len() == 0 {
+					size := remaining
+					if size > mu.maxCopySize {
+						size = mu.maxCopySize
+					}
+					// dont leave a tail too small to be copied (unless it's the end of the object anyway).
+					if remaining-size > 0 && remaining-size < MinPartSize {
+						size = remaining - MinPartSize
+					}
+					if err := mu.uploadPartCopy(ctx, seg.copyOffset+offset, seg.copyOffset+offset+size-1, seg.copyETag); err != nil {
+						return err
+					}
+					offset += size
+					continue
+				}
+			}
+
+			// gather into pending, a part at a time.
+			size := remaining
+			if space := mu.partSize - int64(mu.pending.Len()); size > space {
+				size = space
+			}
+			data, err := mu.sh.readSegment(ctx, seg, offset, size, mu.bucket, mu.key)
+			if err != nil {
+				return err
+			}
+			mu.pending.Write(data)
+			offset += size
+
+			if int64(mu.pending.Len()) >= mu.partSize {
+				if err := mu.uploadPart(ctx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// DownloadBlobRange appends a subsection of the object to buffer.
+// endOffset is inclusive, a negative endOffset reads to the end of the object.
+func (sh *S3Handler) DownloadBlobRange(ctx context.Context, buffer *bytes.Buffer, containerName string, blobName string, beginOffset int64, endOffset int64) error {
+	return sh.downloadRange(ctx, buffer, containerName, blobName, beginOffset, endOffset, "")
+}
+
+// downloadRange is DownloadBlobRange, only if the ETag of the object is still etag (unless empty).
+func (sh *S3Handler) downloadRange(ctx context.Context, buffer *bytes.Buffer, containerName string, blobName string, beginOffset int64, endOffset int64, etag string) error {
+	headers := map[string]string{"Range": fmt.Sprintf("bytes=%d-", beginOffset)}
+	if endOffset >= 0 {
+		headers["Range"] = fmt.Sprintf("bytes=%d-%d", beginOffset, endOffset)
+	}
+	if etag != "" {
+		headers["If-Match"] = etag
+	}
+
+	resp, err := sh.do(ctx, http.MethodGet, containerName, blobName, nil, headers, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	count, err := buffer.ReadFrom(resp.Body)
+	atomic.AddInt64(&sh.TotalBytesDownloaded, count)
+	return err
+}
+
+// DownloadBlob streams the entire object into file.
+func (sh *S3Handler) DownloadBlob(ctx context.Context, file *os.File, containerName string, blobName string) error {
+	resp, err := sh.do(ctx, http.MethodGet, containerName, blobName, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	count, err := io.Copy(file, resp.Body)
+	atomic.AddInt64(&sh.TotalBytesDownloaded, count)
+	return err
+}
+
+// GetBlobProperties returns the size and ETag of the object.
+func (sh *S3Handler) GetBlobProperties(ctx context.Context, containerName string, blobName string) (*signatures.BlobProperties, error) {
+	resp, err := sh.do(ctx, http.MethodHead, containerName, blobName, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	props := signatures.BlobProperties{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	props.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &props, nil
+}
+
+func (sh *S3Handler) BlobExist(ctx context.Context, containerName string, blobName string) bool {
+	resp, err := sh.do(ctx, http.MethodHead, containerName, blobName, nil, nil, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// Close removes any spooled blocks that were never committed.
+func (sh *S3Handler) Close() error {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	sh.stagedBlocks = make(map[string]map[string]string)
+	if sh.stagingDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(sh.stagingDir)
+	sh.stagingDir = ""
+	return err
+}
@@ -0,0 +1,510 @@
+package s3utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// fakeRequest is a request made to the fakeS3.
+type fakeRequest struct {
+	method string
+	key    string
+	query  url.Values
+	header http.Header
+	size   int
+}
+
+// fakeS3 is a path style S3 stand-in, with just what S3Handler uses. Like S3 it refuses parts
+// (other than the last) under MinPartSize and honours If-Match and x-amz-copy-source-if-match.
+type fakeS3 struct {
+	lock       sync.Mutex
+	buckets    map[string]bool
+	objects    map[string][]byte
+	uploads    map[string]map[int][]byte
+	nextUpload int
+	requests   []fakeRequest
+
+	// onRequest (if set) is called before each request is handled.
+	onRequest func(fs *fakeS3, r *http.Request)
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+var fakeRangeRegexp = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// fakeRange returns the part of data in a Range header (if any).
+func fakeRange(data []byte, header string) []byte {
+	m := fakeRangeRegexp.FindStringSubmatch(header)
+	if m == nil {
+		return data
+	}
+	begin, _ := strconv.Atoi(m[1])
+	end := len(data) - 1
+	if m[2] != "" {
+		end, _ = strconv.Atoi(m[2])
+	}
+	return data[begin : end+1]
+}
+
+// setObject sets an object directly, as if written by something else.
+func (fs *fakeS3) setObject(bucket string, key string, data []byte) {
+	fs.objects[bucket+"/"+key] = data
+}
+
+func (fs *fakeS3) object(bucket string, key string) []byte {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.objects[bucket+"/"+key]
+}
+
+// requestsFor returns the requests with the given method and query parameter.
+func (fs *fakeS3) requestsFor(method string, param string) []fakeRequest {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	l := []fakeRequest{}
+	for _, r := range fs.requests {
+		if _, ok := r.query[param]; r.method == method && ok {
+			l = append(l, r)
+		}
+	}
+	return l
+}
+
+func (fs *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.onRequest != nil {
+		fs.onRequest(fs, r)
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		fakeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	query := r.URL.Query()
+	fs.requests = append(fs.requests, fakeRequest{method: r.Method, key: key, query: query, header: r.Header, size: len(body)})
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			if !fs.buckets[bucket] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			fs.buckets[bucket] = true
+		}
+		return
+	}
+	if !fs.buckets[bucket] {
+		fakeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	objectKey := bucket + "/" + key
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		fs.nextUpload++
+		uploadID = strconv.Itoa(fs.nextUpload)
+		fs.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+
+	case r.Method == http.MethodPut && uploadID != "":
+		upload, ok := fs.uploads[uploadID]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		copySource := r.Header.Get("x-amz-copy-source")
+		if copySource == "" {
+			upload[partNumber] = body
+			w.Header().Set("ETag", fakeETag(body))
+			return
+		}
+
+		source, _ := url.PathUnescape(copySource)
+		data, ok := fs.objects[strings.TrimPrefix(source, "/")]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if ifMatch := r.Header.Get("x-amz-copy-source-if-match"); ifMatch != "" && ifMatch != fakeETag(data) {
+			fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		part := fakeRange(data, r.Header.Get("x-amz-copy-source-range"))
+		upload[partNumber] = part
+		fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", fakeETag(part))
+
+	case r.Method == http.MethodPost && uploadID != "":
+		upload, ok := fs.uploads[uploadID]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		complete := completeMultipartUpload{}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			fakeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		data := []byte{}
+		for i, part := range complete.Parts {
+			partData, ok := upload[part.PartNumber]
+			if !ok || part.PartNumber != i+1 || part.ETag != fakeETag(partData) {
+				fakeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			if i < len(complete.Parts)-1 && int64(len(partData)) < MinPartSize {
+				fakeError(w, http.StatusBadRequest, "EntityTooSmall")
+				return
+			}
+			data = append(data, partData...)
+		}
+		delete(fs.uploads, uploadID)
+		fs.objects[objectKey] = data
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", fakeETag(data))
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(fs.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		fs.objects[objectKey] = body
+		w.Header().Set("ETag", fakeETag(body))
+
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		data, ok := fs.objects[objectKey]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != fakeETag(data) {
+			fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		w.Header().Set("ETag", fakeETag(data))
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			data = fakeRange(data, r.Header.Get("Range"))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(data)
+
+	default:
+		fakeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// newTestS3 returns an S3Handler talking to a fakeS3, and a func to shut them down.
+func newTestS3(t *testing.T) (*S3Handler, *fakeS3, func()) {
+	fs := &fakeS3{buckets: make(map[string]bool), objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	server := httptest.NewServer(fs)
+	sh, err := NewS3Handler(server.URL, "us-east-1", "access", "secret", true)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return sh, fs, func() {
+		sh.Close()
+		server.Close()
+	}
+}
+
+const testBlockSize = 1024 * 1024
+
+// testBlocks is count random blocks of testBlockSize.
+func testBlocks(seed int64, count int) [][]byte {
+	r := rand.New(rand.NewSource(seed))
+	blocks := [][]byte{}
+	for i := 0; i < count; i++ {
+		block := make([]byte, testBlockSize)
+		r.Read(block)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// putBlocks stages the blocks with new data (those in staged) and commits the lot, returns the content.
+func putBlocks(t *testing.T, sh *S3Handler, key string, blocks [][]byte, blockIDs []string, staged map[int]bool) ([]byte, error) {
+	ctx := context.Background()
+	uploaded := []signatures.UploadedBlock{}
+	data := []byte{}
+	for i, block := range blocks {
+		if staged[i] {
+			if err := sh.StageBlock(ctx, "bucket", key, blockIDs[i], block); err != nil {
+				t.Fatal(err)
+			}
+		}
+		uploaded = append(uploaded, signatures.UploadedBlock{BlockID: blockIDs[i], Size: int64(len(block))})
+		data = append(data, block...)
+	}
+	return data, sh.PutBlockList(ctx, uploaded, "bucket", key)
+}
+
+func blockIDs(prefix string, count int) []string {
+	ids := []string{}
+	for i := 0; i < count; i++ {
+		ids = append(ids, fmt.Sprintf("%s%02d", prefix, i))
+	}
+	return ids
+}
+
+func allStaged(count int) map[int]bool {
+	staged := make(map[int]bool)
+	for i := 0; i < count; i++ {
+		staged[i] = true
+	}
+	return staged
+}
+
+func TestS3SmallObject(t *testing.T) {
+	sh, fs, cleanup := newTestS3(t)
+	defer cleanup()
+
+	blocks := [][]byte{[]byte("hello "), []byte("world")}
+	ids := []string{"a", "b"}
+	data, err := putBlocks(t, sh, "small", blocks, ids, allStaged(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fs.object("bucket", "small"), data) {
+		t.Fatalf("object is %q, want %q", fs.object("bucket", "small"), data)
+	}
+	if fs.object("bucket", blockListPrefix+"small") == nil {
+		t.Fatal("no block list stored")
+	}
+
+	// reuse a committed block, read back (conditionally) and PUT again since it is under MinPartSize.
+	blocks = [][]byte{[]byte("hello "), []byte("there")}
+	ids = []string{"a", "c"}
+	data, err = putBlocks(t, sh, "small", blocks, ids, map[int]bool{1: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fs.object("bucket", "small"), data) {
+		t.Fatalf("object is %q, want %q", fs.object("bucket", "small"), data)
+	}
+	if len(fs.requestsFor(http.MethodPost, "uploads")) != 0 {
+		t.Error("small object uploaded with a multipart upload")
+	}
+
+	props, err := sh.GetBlobProperties(context.Background(), "bucket", "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props.Size != int64(len(data)) || props.ETag != fakeETag(data) {
+		t.Errorf("wrong properties %+v", props)
+	}
+	buffer := bytes.Buffer{}
+	if err := sh.DownloadBlobRange(context.Background(), &buffer, "bucket", "small", 6, -1); err != nil || buffer.String() != "there" {
+		t.Errorf("range is %q (%v)", buffer.String(), err)
+	}
+
+	if err := sh.StageBlock(context.Background(), "bucket", blockListPrefix+"small", "a", []byte("x")); err == nil {
+		t.Error("blob name under the block list prefix accepted")
+	}
+}
+
+func TestS3MultipartMixed(t *testing.T) {
+	sh, fs, cleanup := newTestS3(t)
+	defer cleanup()
+
+	blocks := testBlocks(1, 30)
+	ids := blockIDs("v1-", 30)
+	if _, err := putBlocks(t, sh, "big", blocks, ids, allStaged(30)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fs.requestsFor(http.MethodPut, "partNumber")); n != 2 {
+		t.Errorf("expected 2 parts of PartSize for 30MiB, got %d", n)
+	}
+	etag := fakeETag(fs.object("bucket", "big"))
+
+	// new blocks 10 and 25. The copy of 0-9 is a part on its own, block 10 is topped up from the start of
+	// 11-24 with the rest of that copied, and 25-29 are too small to copy so are read back and uploaded.
+	newBlocks := testBlocks(2, 2)
+	blocks[10], blocks[25] = newBlocks[0], newBlocks[1]
+	ids[10], ids[25] = "v2-10", "v2-25"
+	fs.requests = nil
+	data, err := putBlocks(t, sh, "big", blocks, ids, map[int]bool{10: true, 25: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fs.object("bucket", "big"), data) {
+		t.Fatal("object differs from the blocks")
+	}
+
+	copies := []string{}
+	uploads := []int{}
+	for _, r := range fs.requestsFor(http.MethodPut, "partNumber") {
+		if source := r.header.Get("x-amz-copy-source"); source != "" {
+			if r.header.Get("x-amz-copy-source-if-match") != etag {
+				t.Errorf("copy not conditional on the ETag of the object: %v", r.header)
+			}
+			copies = append(copies, r.header.Get("x-amz-copy-source-range"))
+		} else {
+			uploads = append(uploads, r.size)
+		}
+	}
+	wantCopies := []string{
+		fmt.Sprintf("bytes=0-%d", 10*testBlockSize-1),
+		fmt.Sprintf("bytes=%d-%d", 15*testBlockSize, 25*testBlockSize-1),
+	}
+	wantUploads := []int{int(MinPartSize), 5 * testBlockSize}
+	if fmt.Sprint(copies) != fmt.Sprint(wantCopies) || fmt.Sprint(uploads) != fmt.Sprint(wantUploads) {
+		t.Errorf("copied %v and uploaded %v, want %v and %v", copies, uploads, wantCopies, wantUploads)
+	}
+	for _, r := range fs.requestsFor(http.MethodGet, "") {
+		t.Errorf("unexpected GET %v", r)
+	}
+}
+
+func TestS3CopySplitsLargeRanges(t *testing.T) {
+	sh, fs, cleanup := newTestS3(t)
+	defer cleanup()
+
+	blocks := testBlocks(1, 13)
+	if _, err := putBlocks(t, sh, "big", blocks, blockIDs("v1-", 13), allStaged(13)); err != nil {
+		t.Fatal(err)
+	}
+	data := fs.object("bucket", "big")
+	fs.requests = nil
+
+	// copied in parts of at most 12MiB, without leaving a tail under MinPartSize.
+	mu := multipartUpload{sh: sh, bucket: "bucket", key: "big", partSize: PartSize, maxCopySize: 12 * testBlockSize}
+	segments := []segment{{isCopy: true, copyOffset: 0, copyETag: fakeETag(data), size: int64(len(data))}}
+	etag, err := mu.upload(context.Background(), segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != fakeETag(data) || !bytes.Equal(fs.object("bucket", "big"), data) {
+		t.Fatal("object changed")
+	}
+
+	copies := []string{}
+	for _, r := range fs.requestsFor(http.MethodPut, "partNumber") {
+		copies = append(copies, r.header.Get("x-amz-copy-source-range"))
+	}
+	wantCopies := []string{fmt.Sprintf("bytes=0-%d", 8*testBlockSize-1), fmt.Sprintf("bytes=%d-%d", 8*testBlockSize, 13*testBlockSize-1)}
+	if fmt.Sprint(copies) != fmt.Sprint(wantCopies) {
+		t.Errorf("copied %v, want %v", copies, wantCopies)
+	}
+}
+
+func TestS3ExternalOverwrite(t *testing.T) {
+	sh, fs, cleanup := newTestS3(t)
+	defer cleanup()
+
+	blocks := testBlocks(1, 12)
+	ids := blockIDs("v1-", 12)
+	if _, err := putBlocks(t, sh, "big", blocks, ids, allStaged(12)); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwritten once the upload has started, the copy must fail rather than copy the wrong bytes.
+	external := bytes.Repeat([]byte("x"), 12*testBlockSize)
+	fs.onRequest = func(fs *fakeS3, r *http.Request) {
+		if _, ok := r.URL.Query()["uploads"]; ok {
+			fs.setObject("bucket", "big", external)
+		}
+	}
+	newBlocks := testBlocks(2, 1)
+	blocks[11] = newBlocks[0]
+	ids[11] = "v2-11"
+	_, err := putBlocks(t, sh, "big", blocks, ids, map[int]bool{11: true})
+	if !errors.Is(err, signatures.ErrPreconditionFailed) {
+		t.Fatalf("expected a precondition failure, got %v", err)
+	}
+	if !bytes.Equal(fs.object("bucket", "big"), external) {
+		t.Error("object changed by the failed upload")
+	}
+	if len(fs.requestsFor(http.MethodDelete, "uploadId")) != 1 {
+		t.Error("failed upload not aborted")
+	}
+	if len(fs.uploads) != 0 {
+		t.Error("upload left behind")
+	}
+
+	// overwritten before the upload, the block list no longer describes the object so nothing can be reused.
+	fs.onRequest = nil
+	_, err = putBlocks(t, sh, "big", blocks, ids, map[int]bool{11: true})
+	if !errors.Is(err, signatures.ErrSignatureStale) {
+		t.Fatalf("expected a stale error, got %v", err)
+	}
+	if !bytes.Equal(fs.object("bucket", "big"), external) {
+		t.Error("object changed by the failed upload")
+	}
+
+	// all new blocks are fine.
+	data, err := putBlocks(t, sh, "big", blocks, ids, allStaged(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fs.object("bucket", "big"), data) {
+		t.Error("object differs from the blocks")
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	tests := []struct {
+		totalSize int64
+		want      int64
+	}{
+		{MinPartSize, PartSize},
+		{MaxPartCount * PartSize, PartSize},
+		{MaxPartCount*PartSize + 1, PartSize + 1},
+		{MaxPartCount * MaxPartSize, MaxPartSize},
+	}
+	for _, tt := range tests {
+		got, err := partSizeFor(tt.totalSize)
+		if err != nil || got != tt.want {
+			t.Errorf("partSizeFor(%d) = %d, %v, want %d", tt.totalSize, got, err, tt.want)
+		}
+		if parts := (tt.totalSize + got - 1) / got; parts > MaxPartCount {
+			t.Errorf("partSizeFor(%d) takes %d parts", tt.totalSize, parts)
+		}
+	}
+	if _, err := partSizeFor(MaxPartCount*MaxPartSize + 1); err == nil {
+		t.Error("object too large for S3 accepted")
+	}
+
+	mu := multipartUpload{key: "big", parts: make([]completedPart, MaxPartCount)}
+	if err := mu.uploadPart(context.Background()); err == nil {
+		t.Error("part past MaxPartCount accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package signatures
+
+import "time"
+
+// BlobProperties are the properties of a committed blob, as reported by a backend.
+type BlobProperties struct {
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// BlobInfo ties a signature to the blob it was made for, so a blob changed by something other
+// than BlobSync (leaving the signature stale) is spotted before the signature is trusted.
+type BlobInfo struct {
+	Length int64
+
+	// ETag of the blob once committed, empty if the backend doesnt have them.
+	ETag string
+
+	// ContentHash is the whole blob hashed with the signatures StrongAlgorithm.
+	ContentHash StrongHash
+
+	// Regenerated means the signature was made from the blob content rather than when the blob was
+	// uploaded, so its blocks arent the blobs blocks. Fine for downloads, no use for delta uploads.
+	Regenerated bool
+}
+
+// CheckBlob returns an ErrSignatureStale error if props arent those of the blob the signature was made for.
+// Signatures without a BlobInfo can only be checked against the length.
+func (s SizeBasedCompleteSignature) CheckBlob(props BlobProperties) error {
+	if s.Blob == nil {
+		end := int64(0)
+		for _, compSig := range s.Signatures {
+			for _, b := range compSig.SignatureList {
+				if blockEnd := b.Offset + int64(b.Size); blockEnd > end {
+					end = blockEnd
+				}
+			}
+		}
+		if end != props.Size {
+			return Errorf(ErrSignatureStale, "signature covers %d bytes but the blob is %d", end, props.Size)
+		}
+		return nil
+	}
+
+	if s.Blob.Length != props.Size {
+		return Errorf(ErrSignatureStale, "signature is for a %d byte blob but the blob is %d", s.Blob.Length, props.Size)
+	}
+	if s.Blob.ETag != "" && props.ETag != "" && s.Blob.ETag != props.ETag {
+		return Errorf(ErrSignatureStale, "signature is for blob ETag %s but the blob is %s", s.Blob.ETag, props.ETag)
+	}
+	return nil
+}
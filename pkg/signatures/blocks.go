@@ -13,7 +13,9 @@ type BlockSig struct {
 	Offset int64
 	Size int
 	RollingSig RollingSignature
-	MD5Signature [16]byte
+
+	// strong hash of the block, algorithm as per the signature. Named MD5Signature in legacy sigs.
+	StrongSig StrongHash `json:"MD5Signature"`
 	BlockNo int
 
 }
@@ -0,0 +1,135 @@
+package signatures
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Chunking identifies how a file is split into blocks.
+type Chunking uint8
+
+const (
+	// ChunkingFixed splits into BlockSize blocks, the original behaviour.
+	ChunkingFixed Chunking = 1
+
+	// ChunkingCDC picks block boundaries by content (FastCDC style gear hash), so an insert
+	// or delete only changes the blocks around it. BlockSize is the average block size,
+	// MinBlockSize and MaxBlockSize the limits.
+	ChunkingCDC Chunking = 2
+
+	DefaultChunking = ChunkingFixed
+)
+
+var chunkingNames = map[Chunking]string{
+	ChunkingFixed: "fixed",
+	ChunkingCDC:   "cdc",
+}
+
+func (c Chunking) String() string {
+	if name, ok := chunkingNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", c)
+}
+
+// ParseChunking converts a name (fixed or cdc) to a Chunking. An empty name is the default.
+func ParseChunking(name string) (Chunking, error) {
+	if name == "" {
+		return DefaultChunking, nil
+	}
+	for c, cName := range chunkingNames {
+		if strings.EqualFold(name, cName) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown chunking %s", name)
+}
+
+// Valid reports whether c is a known chunking mode.
+func (c Chunking) Valid() bool {
+	_, ok := chunkingNames[c]
+	return ok
+}
+
+// gearTable is the random value per byte for the gear hash. Fixed, since changing it
+// changes the block boundaries of every CDC signature.
+var gearTable = randomTable(0x3c6ef372fe94f82b)
+
+// Chunker finds block boundaries as per a signatures options.
+type Chunker struct {
+	opts SignatureOptions
+
+	// FastCDC normalised chunking: a harder mask before the average size and an
+	// easier one after, so block sizes cluster around the average.
+	maskSmall uint64
+	maskLarge uint64
+}
+
+// NewChunker returns the chunker for opts (after defaults are applied).
+func NewChunker(opts SignatureOptions) Chunker {
+	c := Chunker{opts: opts.WithDefaults()}
+	if c.opts.Chunking == ChunkingCDC {
+		avgBits := bits.Len(uint(c.opts.BlockSize)) - 1
+		c.maskSmall = topBitsMask(avgBits + 1)
+		c.maskLarge = topBitsMask(avgBits - 1)
+	}
+	return c
+}
+
+// topBitsMask has the top n bits set. The gear hash shifts left, so the top bits depend on
+// the most bytes (the last 64).
+func topBitsMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << uint(64-n)
+}
+
+// MaxBlockSize is the largest block NextBlockSize will return.
+func (c Chunker) MaxBlockSize() int {
+	if c.opts.Chunking == ChunkingCDC {
+		return c.opts.MaxBlockSize
+	}
+	return c.opts.BlockSize
+}
+
+// NextBlockSize returns the size of the block starting at data[0]. data should hold at least
+// MaxBlockSize bytes, unless it runs to the end of the file.
+func (c Chunker) NextBlockSize(data []byte) int {
+	if c.opts.Chunking != ChunkingCDC {
+		if len(data) < c.opts.BlockSize {
+			return len(data)
+		}
+		return c.opts.BlockSize
+	}
+
+	if len(data) <= c.opts.MinBlockSize {
+		return len(data)
+	}
+	end := len(data)
+	if end > c.opts.MaxBlockSize {
+		end = c.opts.MaxBlockSize
+	}
+	normal := c.opts.BlockSize
+	if normal > end {
+		normal = end
+	}
+
+	// nothing is cut before the minimum, so dont bother hashing it.
+	hash := uint64(0)
+	i := c.opts.MinBlockSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < end; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
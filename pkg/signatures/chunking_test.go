@@ -0,0 +1,123 @@
+package signatures
+
+import (
+	"bytes"
+	"testing"
+)
+
+// chunkEnds returns the offset each block ends at when data is chunked with c.
+func chunkEnds(c Chunker, data []byte) []int {
+	ends := []int{}
+	for offset := 0; offset < len(data); {
+		end := offset + c.MaxBlockSize()
+		if end > len(data) {
+			end = len(data)
+		}
+		offset += c.NextBlockSize(data[offset:end])
+		ends = append(ends, offset)
+	}
+	return ends
+}
+
+func TestCDCBlockSizeLimits(t *testing.T) {
+	random := testData(1 << 20)
+	// runs of the same byte never (or always) match the mask, so hit the limits.
+	runs := append(bytes.Repeat([]byte{0}, 100000), bytes.Repeat([]byte{0xff}, 100000)...)
+	runs = append(runs, random[:100000]...)
+
+	optsList := []SignatureOptions{
+		{BlockSize: 4096, Chunking: ChunkingCDC},
+		{BlockSize: 4096, MinBlockSize: 100, MaxBlockSize: 5000, Chunking: ChunkingCDC},
+		{BlockSize: 8192, MinBlockSize: 8000, MaxBlockSize: 8200, Chunking: ChunkingCDC},
+		{BlockSize: 1000, MinBlockSize: 1000, MaxBlockSize: 1000, Chunking: ChunkingCDC},
+	}
+	for _, opts := range optsList {
+		c := NewChunker(opts)
+		min, max := c.opts.MinBlockSize, c.opts.MaxBlockSize
+		for name, data := range map[string][]byte{"random": random, "runs": runs} {
+			ends := chunkEnds(c, data)
+			start := 0
+			for i, end := range ends {
+				size := end - start
+				if size > max || size <= 0 || (size < min && i != len(ends)-1) {
+					t.Fatalf("%+v %s: block %d is %d bytes, limits are %d to %d", opts, name, i, size, min, max)
+				}
+				start = end
+			}
+		}
+
+		// random data averages something near the block size.
+		if opts.MinBlockSize == 0 {
+			average := len(random) / len(chunkEnds(c, random))
+			if average < opts.BlockSize/2 || average > opts.BlockSize*2 {
+				t.Errorf("%+v: average block is %d bytes", opts, average)
+			}
+		}
+	}
+}
+
+func TestCDCBoundariesSurviveInsert(t *testing.T) {
+	data := testData(1 << 20)
+	c := NewChunker(SignatureOptions{BlockSize: 4096, Chunking: ChunkingCDC})
+
+	edits := []struct {
+		name   string
+		data   []byte
+		offset int
+		shift  int
+	}{
+		{"insert", append(append(append([]byte{}, data[:100]...), testData(13)...), data[100:]...), 100, 13},
+		{"insert at start", append(testData(5000), data...), 0, 5000},
+		{"delete", append(append([]byte{}, data[:3000]...), data[3050:]...), 3000, -50},
+	}
+	for _, e := range edits {
+		before := chunkEnds(c, data)
+		after := map[int]bool{}
+		for _, end := range chunkEnds(c, e.data) {
+			after[end] = true
+		}
+
+		// past the first couple of blocks after the edit, every boundary is just moved by it.
+		changed := 0
+		for _, end := range before {
+			if end <= e.offset {
+				if !after[end] {
+					t.Errorf("%s: boundary %d before the edit moved", e.name, end)
+				}
+				continue
+			}
+			if !after[end+e.shift] {
+				changed++
+				if end > e.offset+2*c.MaxBlockSize() {
+					t.Errorf("%s: boundary %d, well after the edit at %d, moved", e.name, end, e.offset)
+				}
+			}
+		}
+		if changed > 2 {
+			t.Errorf("%s: %d boundaries moved", e.name, changed)
+		}
+
+		// so the signatures only differ by a block or two.
+		sigBefore, err := CreateSignatureFromScratchWithOptions(bytes.NewReader(data), c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigAfter, err := CreateSignatureFromScratchWithOptions(bytes.NewReader(e.data), c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes := map[StrongHash]bool{}
+		for _, b := range ExpandSizeBasedCompleteSignature(*sigBefore) {
+			hashes[b.StrongSig] = true
+		}
+		newBlocks := 0
+		for _, b := range ExpandSizeBasedCompleteSignature(*sigAfter) {
+			if !hashes[b.StrongSig] {
+				newBlocks++
+			}
+		}
+		if newBlocks > 3 {
+			t.Errorf("%s: %d new blocks", e.name, newBlocks)
+		}
+	}
+}
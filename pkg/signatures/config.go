@@ -1,10 +0,0 @@
-package signatures
-
-
-
-type Config struct {
-	AccountName string `json:"AccountName"`
-	AccountKey string `json:"AccountKey"`
-}
-
-
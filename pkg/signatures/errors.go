@@ -0,0 +1,50 @@
+package signatures
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of failure callers may want to handle differently. Backends and BlobSync wrap the
+// underlying error so these can be checked with errors.Is, while errors.As still reaches
+// the original (eg. azblob.StorageError).
+var (
+	ErrSignatureNotFound  = errors.New("signature not found")
+	ErrSignatureCorrupt   = errors.New("signature corrupt")
+	ErrSignatureStale     = errors.New("signature stale")
+	ErrBlobNotFound       = errors.New("blob not found")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrTransient          = errors.New("transient transport error")
+)
+
+// Error is an error of a particular Kind (one of the Err* values above).
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// NewError wraps err as being of the given kind. A nil err stays nil.
+func NewError(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// Errorf is NewError with a formatted message, %w works as per fmt.Errorf.
+func Errorf(kind error, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports the kind, so errors.Is(err, ErrBlobNotFound) etc work.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
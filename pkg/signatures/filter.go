@@ -0,0 +1,46 @@
+package signatures
+
+import "math/bits"
+
+const (
+	// bits per signature in a RollingFilter, about 1 in this many non matching signatures get through.
+	rollingFilterBitsPerSig = 16
+
+	minRollingFilterBits = 1 << 16
+	maxRollingFilterBits = 1 << 27
+)
+
+// RollingFilter is a compact set of rolling signatures that can quickly say a signature isnt in it.
+// The search checks it at every offset and only does the (far slower) map lookup when it might match,
+// much like the tag table in rsync. It is a bitset indexed by a hash of the whole signature.
+type RollingFilter struct {
+	bits  []uint64
+	shift uint
+}
+
+// NewRollingFilter returns a filter holding the rolling signatures of blocks.
+func NewRollingFilter(blocks []BlockSig) RollingFilter {
+	size := minRollingFilterBits
+	for size < len(blocks)*rollingFilterBitsPerSig && size < maxRollingFilterBits {
+		size <<= 1
+	}
+
+	f := RollingFilter{bits: make([]uint64, size/64), shift: uint(64 - (bits.Len(uint(size)) - 1))}
+	for _, b := range blocks {
+		i := f.index(b.RollingSig)
+		f.bits[i>>6] |= 1 << (i & 63)
+	}
+	return f
+}
+
+// index is the top bits of a multiplicative hash of both halves of the signature.
+func (f RollingFilter) index(sig RollingSignature) uint64 {
+	h := (uint64(sig.Sig1)*0x9e3779b97f4a7c15 ^ uint64(sig.Sig2)) * 0xc2b2ae3d27d4eb4f
+	return h >> f.shift
+}
+
+// MayContain is false if sig definitely isnt in the filter, true if it might be.
+func (f RollingFilter) MayContain(sig RollingSignature) bool {
+	i := f.index(sig)
+	return f.bits[i>>6]&(1<<(i&63)) != 0
+}
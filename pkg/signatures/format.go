@@ -0,0 +1,311 @@
+package signatures
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// binary signatures start with this, legacy ones are JSON (so start with '{').
+	signatureMagic = "BSIG"
+
+	// SignatureFormatVersion is the latest version of the binary format. Version 2 adds the
+	// chunking, it is only written for CDC sigs so fixed block ones stay readable by older versions.
+	// Version 3 adds the BlobInfo, written when there is one.
+	SignatureFormatVersion = 3
+
+	// BlobInfo flags.
+	blobInfoRegenerated = 1
+)
+
+// Binary signature layout (all integers are varints unless noted):
+//
+//	magic "BSIG", version (byte)
+//	block size, rolling algorithm (byte), strong algorithm (byte)
+//	version 2 and up: chunking (byte), min block size, max block size
+//	version 3 and up: blob info flags (byte), blob length, ETag length, ETag,
+//	  content hash (StrongAlgorithm.Size() bytes)
+//	block count
+//	per block, ordered by offset:
+//	  offset (relative to the end of the previous block, so usually 0), size, block no,
+//	  rolling sig1, rolling sig2, strong hash (StrongAlgorithm.Size() bytes)
+//	crc32 (IEEE, little endian uint32) of everything before it.
+
+// MarshalBinary encodes the signature in the binary format.
+func (s SizeBasedCompleteSignature) MarshalBinary() ([]byte, error) {
+	buffer := bytes.Buffer{}
+	if err := writeBinarySignature(&buffer, s); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a signature in the binary format. Use ParseSignature if it could be a legacy one.
+func (s *SizeBasedCompleteSignature) UnmarshalBinary(data []byte) error {
+	sig, err := readBinarySignature(data)
+	if err != nil {
+		return err
+	}
+	*s = *sig
+	return nil
+}
+
+// ParseSignature decodes a signature in either the binary or legacy JSON format.
+func ParseSignature(data []byte) (*SizeBasedCompleteSignature, error) {
+	if bytes.HasPrefix(data, []byte(signatureMagic)) {
+		sig := SizeBasedCompleteSignature{}
+		if err := sig.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return &sig, nil
+	}
+
+	sig := SizeBasedCompleteSignature{}
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return nil, NewError(ErrSignatureCorrupt, err)
+	}
+	sig.SignatureOptions = sig.SignatureOptions.WithDefaults()
+	if sig.Signatures == nil {
+		sig.Signatures = make(map[int]CompleteSignature)
+	}
+	return &sig, nil
+}
+
+func strongHashSize(alg StrongAlgorithm) (int, error) {
+	if size := alg.Size(); size > 0 {
+		return size, nil
+	}
+	return 0, Errorf(ErrSignatureCorrupt, "unknown strong hash algorithm %d", alg)
+}
+
+// binaryWriter writes varints, remembering the first error so callers only check once.
+type binaryWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (bw *binaryWriter) write(data []byte) {
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(data)
+	}
+}
+
+func (bw *binaryWriter) uvarint(v uint64) {
+	bw.write(bw.buf[:binary.PutUvarint(bw.buf[:], v)])
+}
+
+func (bw *binaryWriter) varint(v int64) {
+	bw.write(bw.buf[:binary.PutVarint(bw.buf[:], v)])
+}
+
+func writeBinarySignature(w io.Writer, s SizeBasedCompleteSignature) error {
+	s.SignatureOptions = s.SignatureOptions.WithDefaults()
+	hashSize, err := strongHashSize(s.StrongAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	bw := binaryWriter{w: bufio.NewWriter(io.MultiWriter(w, crc))}
+
+	version := byte(1)
+	if s.Chunking != ChunkingFixed {
+		version = 2
+	}
+	if s.Blob != nil {
+		version = 3
+	}
+
+	bw.write([]byte(signatureMagic))
+	bw.write([]byte{version})
+	bw.uvarint(uint64(s.BlockSize))
+	bw.write([]byte{byte(s.RollingAlgorithm), byte(s.StrongAlgorithm)})
+	if version >= 2 {
+		bw.write([]byte{byte(s.Chunking)})
+		bw.uvarint(uint64(s.MinBlockSize))
+		bw.uvarint(uint64(s.MaxBlockSize))
+	}
+	if version >= 3 {
+		flags := byte(0)
+		if s.Blob.Regenerated {
+			flags |= blobInfoRegenerated
+		}
+		bw.write([]byte{flags})
+		bw.uvarint(uint64(s.Blob.Length))
+		bw.uvarint(uint64(len(s.Blob.ETag)))
+		bw.write([]byte(s.Blob.ETag))
+		bw.write(s.Blob.ContentHash[:hashSize])
+	}
+
+	blocks := ExpandSizeBasedCompleteSignature(s)
+	bw.uvarint(uint64(len(blocks)))
+
+	end := int64(0)
+	for _, b := range blocks {
+		bw.varint(b.Offset - end)
+		bw.uvarint(uint64(b.Size))
+		bw.uvarint(uint64(b.BlockNo))
+		bw.varint(b.RollingSig.Sig1)
+		bw.varint(b.RollingSig.Sig2)
+		bw.write(b.StrongSig[:hashSize])
+		end = b.Offset + int64(b.Size)
+	}
+
+	if bw.err != nil {
+		return bw.err
+	}
+	if err := bw.w.Flush(); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(trailer, crc.Sum32())
+	_, err = w.Write(trailer)
+	return err
+}
+
+// binaryReader decodes varints from data, remembering the first error so callers only check once.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (br *binaryReader) read(n int) []byte {
+	if br.err != nil {
+		return make([]byte, n)
+	}
+	if len(br.data) < n {
+		br.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	b := br.data[:n]
+	br.data = br.data[n:]
+	return b
+}
+
+func (br *binaryReader) byte() byte {
+	return br.read(1)[0]
+}
+
+func (br *binaryReader) uvarint() uint64 {
+	if br.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(br.data)
+	if n <= 0 {
+		br.err = errors.New("invalid varint")
+		return 0
+	}
+	br.data = br.data[n:]
+	return v
+}
+
+func (br *binaryReader) varint() int64 {
+	if br.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(br.data)
+	if n <= 0 {
+		br.err = errors.New("invalid varint")
+		return 0
+	}
+	br.data = br.data[n:]
+	return v
+}
+
+func readBinarySignature(data []byte) (*SizeBasedCompleteSignature, error) {
+	if len(data) < len(signatureMagic)+1+4 {
+		return nil, NewError(ErrSignatureCorrupt, io.ErrUnexpectedEOF)
+	}
+	if string(data[:len(signatureMagic)]) != signatureMagic {
+		return nil, Errorf(ErrSignatureCorrupt, "not a binary signature")
+	}
+	version := data[len(signatureMagic)]
+	if version < 1 || version > SignatureFormatVersion {
+		return nil, Errorf(ErrSignatureCorrupt, "unsupported signature format version %d", version)
+	}
+
+	// check the trailer first, so everything after can trust the data.
+	payload := data[:len(data)-4]
+	if binary.LittleEndian.Uint32(data[len(data)-4:]) != crc32.ChecksumIEEE(payload) {
+		return nil, NewError(ErrSignatureCorrupt, errors.New("checksum mismatch"))
+	}
+	br := binaryReader{data: payload[len(signatureMagic)+1:]}
+
+	sig := SizeBasedCompleteSignature{}
+	sig.BlockSize = int(br.uvarint())
+	sig.RollingAlgorithm = RollingAlgorithm(br.byte())
+	sig.StrongAlgorithm = StrongAlgorithm(br.byte())
+	sig.Chunking = ChunkingFixed
+	if version >= 2 {
+		sig.Chunking = Chunking(br.byte())
+		sig.MinBlockSize = int(br.uvarint())
+		sig.MaxBlockSize = int(br.uvarint())
+	}
+	if br.err != nil {
+		return nil, NewError(ErrSignatureCorrupt, br.err)
+	}
+	hashSize, err := strongHashSize(sig.StrongAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if version >= 3 {
+		flags := br.byte()
+		sig.Blob = &BlobInfo{Regenerated: flags&blobInfoRegenerated != 0}
+		sig.Blob.Length = int64(br.uvarint())
+		etagLength := br.uvarint()
+		if etagLength > uint64(len(br.data)) {
+			return nil, Errorf(ErrSignatureCorrupt, "ETag length %d too large for signature", etagLength)
+		}
+		sig.Blob.ETag = string(br.read(int(etagLength)))
+		copy(sig.Blob.ContentHash[:], br.read(hashSize))
+	}
+	count := br.uvarint()
+	if br.err != nil {
+		return nil, NewError(ErrSignatureCorrupt, br.err)
+	}
+	if !sig.RollingAlgorithm.Valid() {
+		return nil, Errorf(ErrSignatureCorrupt, "unknown rolling algorithm %d", sig.RollingAlgorithm)
+	}
+	if !sig.Chunking.Valid() {
+		return nil, Errorf(ErrSignatureCorrupt, "unknown chunking %d", sig.Chunking)
+	}
+
+	// every block takes at least 5 bytes plus the hash, anything more is a bad count.
+	if count > uint64(len(br.data)/(5+hashSize)) {
+		return nil, Errorf(ErrSignatureCorrupt, "block count %d too large for signature", count)
+	}
+
+	blocks := make([]BlockSig, count)
+	end := int64(0)
+	for i := range blocks {
+		b := &blocks[i]
+		b.Offset = end + br.varint()
+		b.Size = int(br.uvarint())
+		b.BlockNo = int(br.uvarint())
+		b.RollingSig.Sig1 = br.varint()
+		b.RollingSig.Sig2 = br.varint()
+		copy(b.StrongSig[:], br.read(hashSize))
+		end = b.Offset + int64(b.Size)
+	}
+	if br.err != nil {
+		return nil, NewError(ErrSignatureCorrupt, br.err)
+	}
+
+	// blocks were written in offset order, so each size list stays sorted.
+	sizeLUT := make(map[int][]BlockSig)
+	for _, b := range blocks {
+		sizeLUT[b.Size] = append(sizeLUT[b.Size], b)
+	}
+	sig.Signatures = make(map[int]CompleteSignature)
+	for size, l := range sizeLUT {
+		sig.Signatures[size] = CompleteSignature{SignatureList: l}
+	}
+	return &sig, nil
+}
@@ -0,0 +1,118 @@
+package signatures
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSignatureFormatRoundTrip(t *testing.T) {
+	data := testData(20000 + 123)
+	blob := &BlobInfo{Length: int64(len(data)), ETag: `"0x8D9"`, Regenerated: true}
+	copy(blob.ContentHash[:], "0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		name    string
+		opts    SignatureOptions
+		blob    *BlobInfo
+		version byte
+	}{
+		{"fixed", SignatureOptions{BlockSize: 1000}, nil, 1},
+		{"fixed buzhash sha256", SignatureOptions{BlockSize: 777, RollingAlgorithm: RollingBuzhash, StrongAlgorithm: StrongSHA256}, nil, 1},
+		{"cdc", SignatureOptions{BlockSize: 1024, Chunking: ChunkingCDC}, nil, 2},
+		{"fixed with blob", SignatureOptions{BlockSize: 1000}, blob, 3},
+		{"cdc with blob", SignatureOptions{BlockSize: 1024, Chunking: ChunkingCDC, StrongAlgorithm: StrongBLAKE2b}, blob, 3},
+		{"empty with blob", SignatureOptions{BlockSize: 1000, StrongAlgorithm: StrongXXH3}, &BlobInfo{}, 3},
+	}
+
+	for _, tt := range tests {
+		input := data
+		if tt.blob != nil && tt.blob.Length == 0 {
+			input = nil
+		}
+		sig, err := CreateSignatureFromScratchWithOptions(bytes.NewReader(input), tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig.Blob = tt.blob
+		if tt.blob != nil {
+			// only as much of the content hash as the algorithm produces is kept.
+			b := *tt.blob
+			b.ContentHash = StrongHash{}
+			copy(b.ContentHash[:sig.StrongAlgorithm.Size()], tt.blob.ContentHash[:])
+			sig.Blob = &b
+		}
+
+		encoded, err := sig.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if encoded[len(signatureMagic)] != tt.version {
+			t.Errorf("%s: written as version %d, want %d", tt.name, encoded[len(signatureMagic)], tt.version)
+		}
+		decoded, err := ParseSignature(encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(decoded, sig) {
+			t.Errorf("%s: signature changed by the round trip", tt.name)
+		}
+
+		// anything cut off, and any byte changed, is corrupt rather than a different signature.
+		for n := 0; n < len(encoded); n++ {
+			if _, err := ParseSignature(encoded[:n]); !errors.Is(err, ErrSignatureCorrupt) {
+				t.Fatalf("%s: truncated to %d bytes, expected a corrupt error, got %v", tt.name, n, err)
+			}
+		}
+		for i := 0; i < len(encoded); i++ {
+			flipped := append([]byte{}, encoded...)
+			flipped[i] ^= 0x01
+			if _, err := ParseSignature(flipped); !errors.Is(err, ErrSignatureCorrupt) {
+				t.Fatalf("%s: byte %d of %d flipped, expected a corrupt error, got %v", tt.name, i, len(encoded), err)
+			}
+		}
+	}
+}
+
+func TestParseLegacySignature(t *testing.T) {
+	// as written before the binary format, strong hashes are MD5Signature and there are no options.
+	legacy := `{"Signatures":{
+		"20000":{"SignatureList":[
+			{"Offset":0,"Size":20000,"RollingSig":{"Sig1":1,"Sig2":2},"MD5Signature":[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16],"BlockNo":0},
+			{"Offset":20000,"Size":20000,"RollingSig":{"Sig1":3,"Sig2":4},"MD5Signature":[16,15,14,13,12,11,10,9,8,7,6,5,4,3,2,1],"BlockNo":1}]},
+		"123":{"SignatureList":[
+			{"Offset":40000,"Size":123,"RollingSig":{"Sig1":5,"Sig2":6},"MD5Signature":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,255],"BlockNo":2}]}}}`
+
+	sig, err := ParseSignature([]byte(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.SignatureOptions != DefaultSignatureOptions() || sig.Blob != nil {
+		t.Errorf("legacy signature not given the defaults: %+v %+v", sig.SignatureOptions, sig.Blob)
+	}
+	blocks := ExpandSizeBasedCompleteSignature(*sig)
+	if len(blocks) != 3 || blocks[1].Offset != 20000 || blocks[1].RollingSig.Sig2 != 4 || blocks[2].Size != 123 ||
+		blocks[0].StrongSig[0] != 1 || blocks[1].StrongSig[15] != 1 || blocks[2].StrongSig[15] != 255 {
+		t.Errorf("legacy blocks not read: %+v", blocks)
+	}
+
+	// and it survives being written in the binary format.
+	encoded, err := sig.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ParseSignature(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, sig) {
+		t.Error("legacy signature changed by writing it in the binary format")
+	}
+
+	for _, bad := range []string{"", "{", `{"Signatures":[]}`, "BSI", "not a signature"} {
+		if _, err := ParseSignature([]byte(bad)); !errors.Is(err, ErrSignatureCorrupt) {
+			t.Errorf("%q: expected a corrupt error, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package signatures
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// DuplicateBlock is a strong hash that appears more than once in a signature.
+type DuplicateBlock struct {
+	StrongSig StrongHash
+	Offsets   []int64
+}
+
+// SignatureSummary describes the blocks of a signature, see Summarize.
+type SignatureSummary struct {
+	SignatureOptions
+	Blob *BlobInfo
+
+	BlockCount    int
+	BlocksPerSize map[int]int
+
+	// TotalBytes is the sum of the block sizes, End where the last block ends.
+	// For a good signature they are both the blob length.
+	TotalBytes int64
+	End        int64
+
+	// Gaps are byte ranges no block covers, Overlaps ranges more than one does.
+	Gaps     []RemainingBytes
+	Overlaps []RemainingBytes
+
+	Duplicates []DuplicateBlock
+}
+
+// Summarize works out the block counts, coverage and duplicates of a signature.
+func Summarize(sig SizeBasedCompleteSignature) SignatureSummary {
+	summary := SignatureSummary{SignatureOptions: sig.SignatureOptions, Blob: sig.Blob, BlocksPerSize: make(map[int]int)}
+
+	hashOffsets := make(map[StrongHash][]int64)
+	duplicated := []StrongHash{}
+	end := int64(0)
+	for _, b := range ExpandSizeBasedCompleteSignature(sig) {
+		summary.BlockCount++
+		summary.BlocksPerSize[b.Size]++
+		summary.TotalBytes += int64(b.Size)
+
+		if b.Offset > end {
+			summary.Gaps = append(summary.Gaps, RemainingBytes{BeginOffset: end, EndOffset: b.Offset - 1})
+		}
+		blockEnd := b.Offset + int64(b.Size)
+		if b.Offset < end {
+			overlapEnd := end
+			if blockEnd < overlapEnd {
+				overlapEnd = blockEnd
+			}
+			summary.Overlaps = append(summary.Overlaps, RemainingBytes{BeginOffset: b.Offset, EndOffset: overlapEnd - 1})
+		}
+		if blockEnd > end {
+			end = blockEnd
+		}
+
+		offsets := hashOffsets[b.StrongSig]
+		if len(offsets) == 1 {
+			duplicated = append(duplicated, b.StrongSig)
+		}
+		hashOffsets[b.StrongSig] = append(offsets, b.Offset)
+	}
+	summary.End = end
+
+	// in order of first appearance.
+	for _, h := range duplicated {
+		summary.Duplicates = append(summary.Duplicates, DuplicateBlock{StrongSig: h, Offsets: hashOffsets[h]})
+	}
+	return summary
+}
+
+// Validate checks the blocks are contiguous from 0 and cover the blob length recorded in the signature
+// (if any) and blobLength (if not negative). Returns an ErrSignatureCorrupt error describing the first problem.
+func (s SignatureSummary) Validate(blobLength int64) error {
+	if len(s.Gaps) > 0 {
+		return Errorf(ErrSignatureCorrupt, "no block covers bytes %d to %d", s.Gaps[0].BeginOffset, s.Gaps[0].EndOffset)
+	}
+	if len(s.Overlaps) > 0 {
+		return Errorf(ErrSignatureCorrupt, "blocks overlap at bytes %d to %d", s.Overlaps[0].BeginOffset, s.Overlaps[0].EndOffset)
+	}
+	if s.Blob != nil && s.End != s.Blob.Length {
+		return Errorf(ErrSignatureCorrupt, "blocks cover %d bytes but the signature is for a %d byte blob", s.End, s.Blob.Length)
+	}
+	if blobLength >= 0 && s.End != blobLength {
+		return Errorf(ErrSignatureCorrupt, "blocks cover %d bytes but the blob is %d", s.End, blobLength)
+	}
+	return nil
+}
+
+// blockRecord is a block as dumped by WriteBlocksJSON.
+type blockRecord struct {
+	BlockNo     int
+	Offset      int64
+	Size        int
+	RollingSig1 int64
+	RollingSig2 int64
+	StrongSig   string
+}
+
+func blockRecords(sig SizeBasedCompleteSignature) []blockRecord {
+	hashSize := sig.StrongAlgorithm.Size()
+	records := []blockRecord{}
+	for _, b := range ExpandSizeBasedCompleteSignature(sig) {
+		records = append(records, blockRecord{
+			BlockNo:     b.BlockNo,
+			Offset:      b.Offset,
+			Size:        b.Size,
+			RollingSig1: b.RollingSig.Sig1,
+			RollingSig2: b.RollingSig.Sig2,
+			StrongSig:   hex.EncodeToString(b.StrongSig[:hashSize]),
+		})
+	}
+	return records
+}
+
+// WriteBlocksJSON writes the blocks (in offset order) as a JSON array, strong hashes in hex.
+func WriteBlocksJSON(w io.Writer, sig SizeBasedCompleteSignature) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(blockRecords(sig))
+}
+
+// WriteBlocksCSV writes the blocks (in offset order) as CSV with a header line, strong hashes in hex.
+func WriteBlocksCSV(w io.Writer, sig SizeBasedCompleteSignature) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"BlockNo", "Offset", "Size", "RollingSig1", "RollingSig2", "StrongSig"})
+	for _, r := range blockRecords(sig) {
+		writer.Write([]string{
+			strconv.Itoa(r.BlockNo),
+			strconv.FormatInt(r.Offset, 10),
+			strconv.Itoa(r.Size),
+			strconv.FormatInt(r.RollingSig1, 10),
+			strconv.FormatInt(r.RollingSig2, 10),
+			r.StrongSig,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
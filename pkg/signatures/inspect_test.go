@@ -0,0 +1,96 @@
+package signatures
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// handSignature is a signature of blocks given as offset, size pairs. Each block gets its own
+// strong hash unless it is listed in sameHash, in which case they all share one.
+func handSignature(blob *BlobInfo, sameHash map[int]bool, blocks ...[2]int64) SizeBasedCompleteSignature {
+	sig := NewSizeBasedCompleteSignatureWithOptions(SignatureOptions{BlockSize: 1000})
+	sig.Blob = blob
+	for i, block := range blocks {
+		b := BlockSig{Offset: block[0], Size: int(block[1]), BlockNo: i}
+		b.StrongSig[0] = byte(i + 1)
+		if sameHash[i] {
+			b.StrongSig[0] = 0xff
+		}
+		compSig := sig.Signatures[b.Size]
+		compSig.SignatureList = append(compSig.SignatureList, b)
+		sig.Signatures[b.Size] = compSig
+	}
+	return sig
+}
+
+func TestSignatureSummaryValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		sig        SizeBasedCompleteSignature
+		blobLength int64
+		gaps       []RemainingBytes
+		overlaps   []RemainingBytes
+		end        int64
+		err        string
+	}{
+		{"contiguous", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{1000, 1000}, [2]int64{2000, 500}),
+			2500, nil, nil, 2500, ""},
+		{"any length", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{1000, 500}), -1, nil, nil, 1500, ""},
+		{"empty", handSignature(nil, nil), 0, nil, nil, 0, ""},
+		{"blob info", handSignature(&BlobInfo{Length: 1500}, nil, [2]int64{0, 1000}, [2]int64{1000, 500}),
+			-1, nil, nil, 1500, ""},
+
+		{"gap", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{1500, 1000}, [2]int64{2500, 1000}),
+			3500, []RemainingBytes{{BeginOffset: 1000, EndOffset: 1499}}, nil, 3500, "no block covers bytes 1000 to 1499"},
+		{"gap at start", handSignature(nil, nil, [2]int64{100, 1000}), 1100,
+			[]RemainingBytes{{BeginOffset: 0, EndOffset: 99}}, nil, 1100, "no block covers bytes 0 to 99"},
+		{"overlap", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{900, 1000}), 1900,
+			nil, []RemainingBytes{{BeginOffset: 900, EndOffset: 999}}, 1900, "blocks overlap at bytes 900 to 999"},
+		{"overlap inside", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{200, 100}, [2]int64{1000, 1000}), 2000,
+			nil, []RemainingBytes{{BeginOffset: 200, EndOffset: 299}}, 2000, "blocks overlap at bytes 200 to 299"},
+		{"gap before overlap", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{1100, 1000}, [2]int64{2000, 1000}), 3000,
+			[]RemainingBytes{{BeginOffset: 1000, EndOffset: 1099}}, []RemainingBytes{{BeginOffset: 2000, EndOffset: 2099}},
+			3000, "no block covers bytes 1000 to 1099"},
+
+		{"short of blob", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{1000, 500}), 2000,
+			nil, nil, 1500, "blocks cover 1500 bytes but the blob is 2000"},
+		{"past blob", handSignature(nil, nil, [2]int64{0, 1000}, [2]int64{1000, 500}), 1000,
+			nil, nil, 1500, "blocks cover 1500 bytes but the blob is 1000"},
+		{"short of blob info", handSignature(&BlobInfo{Length: 2000}, nil, [2]int64{0, 1000}, [2]int64{1000, 500}), -1,
+			nil, nil, 1500, "blocks cover 1500 bytes but the signature is for a 2000 byte blob"},
+	}
+
+	for _, tt := range tests {
+		summary := Summarize(tt.sig)
+		if !reflect.DeepEqual(summary.Gaps, tt.gaps) || !reflect.DeepEqual(summary.Overlaps, tt.overlaps) || summary.End != tt.end {
+			t.Errorf("%s: gaps %v overlaps %v end %d, want %v %v %d", tt.name, summary.Gaps, summary.Overlaps, summary.End,
+				tt.gaps, tt.overlaps, tt.end)
+		}
+
+		err := summary.Validate(tt.blobLength)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrSignatureCorrupt) || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected a corrupt error %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestSummarizeCounts(t *testing.T) {
+	sig := handSignature(nil, map[int]bool{0: true, 2: true, 3: true},
+		[2]int64{0, 1000}, [2]int64{1000, 1000}, [2]int64{2000, 1000}, [2]int64{3000, 300})
+	summary := Summarize(sig)
+
+	if summary.BlockCount != 4 || summary.TotalBytes != 3300 || !reflect.DeepEqual(summary.BlocksPerSize, map[int]int{1000: 3, 300: 1}) {
+		t.Errorf("wrong counts %d blocks, %d bytes, sizes %v", summary.BlockCount, summary.TotalBytes, summary.BlocksPerSize)
+	}
+	if len(summary.Duplicates) != 1 || !reflect.DeepEqual(summary.Duplicates[0].Offsets, []int64{0, 2000, 3000}) {
+		t.Errorf("wrong duplicates %+v", summary.Duplicates)
+	}
+}
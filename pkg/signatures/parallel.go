@@ -0,0 +1,213 @@
+package signatures
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+const (
+	// blocks handed to a worker at a time, so workers dont fight over the channel for tiny blocks.
+	parallelBatchSize = 64
+
+	// most bytes in a batch (unless a single block is larger), bounding the memory read ahead without mmap.
+	parallelBatchBytes = 4 * 1024 * 1024
+)
+
+// DefaultSignatureWorkers is the number of goroutines hashing blocks unless told otherwise.
+func DefaultSignatureWorkers() int {
+	return runtime.NumCPU()
+}
+
+// CreateSignatureFromScratchParallel is CreateSignatureFromScratchWithOptions with the blocks hashed by
+// workers goroutines. See CreateSignatureFromReaderAt.
+func CreateSignatureFromScratchParallel(localFile *os.File, opts SignatureOptions, workers int) (*SizeBasedCompleteSignature, error) {
+	stats, err := localFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return CreateSignatureFromReaderAt(localFile, stats.Size(), opts, workers)
+}
+
+// CreateSignatureFromReaderAt creates the signature of the first size bytes of r, with the blocks hashed by
+// workers goroutines. Block boundaries are found first (a sequential scan for CDC) then the blocks are hashed
+// in any order. The signature is identical to the sequential one.
+// Files are mmapped if possible, otherwise blocks are read with ReadAt. Without mmap CDC is done sequentially,
+// since the boundaries can only be found by reading the whole lot anyway.
+func CreateSignatureFromReaderAt(r io.ReaderAt, size int64, opts SignatureOptions, workers int) (*SizeBasedCompleteSignature, error) {
+	return createSignatureFromReaderAt(r, size, opts, workers, nil)
+}
+
+// CreateSignatureAndHashFromReaderAt is CreateSignatureFromReaderAt that also hashes the whole of the data with
+// the signatures strong algorithm (ie. the ContentHash of a BlobInfo), without reading it all again.
+func CreateSignatureAndHashFromReaderAt(r io.ReaderAt, size int64, opts SignatureOptions, workers int) (*SizeBasedCompleteSignature, StrongHash, error) {
+	hasher := opts.WithDefaults().StrongAlgorithm.NewHasher()
+	sig, err := createSignatureFromReaderAt(r, size, opts, workers, hasher)
+	if err != nil {
+		return nil, StrongHash{}, err
+	}
+	return sig, hasher.Sum(), nil
+}
+
+// sigBatch is consecutive blocks hashed by one worker.
+type sigBatch struct {
+	start int
+	end   int
+
+	// the bytes of the blocks, set once done is closed (unless reading them failed).
+	data []byte
+	done chan struct{}
+}
+
+// createSignatureFromReaderAt is CreateSignatureFromReaderAt, also writing all the data to hasher (in order) if not nil.
+func createSignatureFromReaderAt(r io.ReaderAt, size int64, opts SignatureOptions, workers int, hasher io.Writer) (*SizeBasedCompleteSignature, error) {
+	opts = opts.WithDefaults()
+	if size == 0 {
+		sig := NewSizeBasedCompleteSignatureWithOptions(opts)
+		return &sig, nil
+	}
+
+	var sequential io.Reader = io.NewSectionReader(r, 0, size)
+	if hasher != nil {
+		sequential = io.TeeReader(sequential, hasher)
+	}
+	if workers <= 1 {
+		return CreateSignatureFromScratchWithOptions(sequential, opts)
+	}
+	data, unmap, mapped := MapReaderAt(r, size)
+	if !mapped && opts.Chunking == ChunkingCDC {
+		return CreateSignatureFromScratchWithOptions(sequential, opts)
+	}
+	if mapped {
+		defer unmap()
+	}
+
+	// offsets and sizes first.
+	blocks := []BlockSig{}
+	chunker := NewChunker(opts)
+	for offset := int64(0); offset < size; {
+		var blockSize int
+		if mapped {
+			blockSize = chunker.NextBlockSize(data[offset:])
+		} else {
+			blockSize = opts.BlockSize
+			if remaining := size - offset; remaining < int64(blockSize) {
+				blockSize = int(remaining)
+			}
+		}
+		blocks = append(blocks, BlockSig{Offset: offset, Size: blockSize, BlockNo: len(blocks)})
+		offset += int64(blockSize)
+	}
+
+	batches := []*sigBatch{}
+	for start := 0; start < len(blocks); {
+		end := start + 1
+		batchSize := blocks[start].Size
+		for end < len(blocks) && end-start < parallelBatchSize && batchSize+blocks[end].Size <= parallelBatchBytes {
+			batchSize += blocks[end].Size
+			end++
+		}
+		batches = append(batches, &sigBatch{start: start, end: end, done: make(chan struct{})})
+		start = end
+	}
+
+	batchCh := make(chan *sigBatch, workers)
+	workerErrs := make([]error, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			var buffer []byte
+			for batch := range batchCh {
+				if workerErrs[worker] == nil {
+					workerErrs[worker] = hashBatch(r, data, mapped, &buffer, hasher != nil, blocks, batch, opts)
+				}
+				close(batch.done)
+			}
+		}(i)
+	}
+
+	// the hasher has to see the batches in order, the tokens stop the workers getting too far ahead of it.
+	var tokens chan struct{}
+	hashed := make(chan struct{})
+	if hasher != nil {
+		tokens = make(chan struct{}, 2*workers)
+		go func() {
+			defer close(hashed)
+			for _, batch := range batches {
+				<-batch.done
+				if batch.data != nil {
+					hasher.Write(batch.data)
+				}
+				batch.data = nil
+				<-tokens
+			}
+		}()
+	} else {
+		close(hashed)
+	}
+
+	for _, batch := range batches {
+		if tokens != nil {
+			tokens <- struct{}{}
+		}
+		batchCh <- batch
+	}
+	close(batchCh)
+	wg.Wait()
+	<-hashed
+
+	for _, err := range workerErrs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// blocks are in offset order, same as the sequential version builds each size list.
+	sig := NewSizeBasedCompleteSignatureWithOptions(opts)
+	for _, b := range blocks {
+		compSig := sig.Signatures[b.Size]
+		compSig.SignatureList = append(compSig.SignatureList, b)
+		sig.Signatures[b.Size] = compSig
+	}
+	return &sig, nil
+}
+
+// hashBatch fills in the sigs of the blocks of batch, from data if mapped otherwise read into buffer. The buffer
+// is reused unless keep is set, in which case batch.data keeps hold of it.
+func hashBatch(r io.ReaderAt, data []byte, mapped bool, buffer *[]byte, keep bool, blocks []BlockSig, batch *sigBatch, opts SignatureOptions) error {
+	first := blocks[batch.start]
+	last := blocks[batch.end-1]
+	begin := first.Offset
+	end := last.Offset + int64(last.Size)
+
+	var batchData []byte
+	if mapped {
+		batchData = data[begin:end]
+	} else {
+		if keep || int64(cap(*buffer)) < end-begin {
+			*buffer = make([]byte, end-begin)
+		}
+		batchData = (*buffer)[:end-begin]
+		if err := ReadFullAt(r, batchData, begin); err != nil {
+			return err
+		}
+	}
+
+	// each worker only touches its own blocks.
+	for j := batch.start; j < batch.end; j++ {
+		b := &blocks[j]
+		block := batchData[b.Offset-begin : b.Offset-begin+int64(b.Size)]
+		blockSig, err := GenerateBlockSigWithOptions(block, b.Offset, b.Size, b.BlockNo, opts)
+		if err != nil {
+			return err
+		}
+		*b = *blockSig
+	}
+	if keep {
+		batch.data = batchData
+	}
+	return nil
+}
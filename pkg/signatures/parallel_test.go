@@ -0,0 +1,151 @@
+package signatures
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testData is random, with some of it repeated so there are duplicate blocks. Not a multiple of any block size used.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data[size/2:], data[:size/4])
+	return data
+}
+
+type testReader struct {
+	name string
+	r    io.ReaderAt
+}
+
+// testReaders returns data as a file (mapped) and in memory (not), and a func to clean up the file.
+func testReaders(t *testing.T, data []byte) ([]testReader, func()) {
+	dir, err := ioutil.TempDir("", "parallel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		f.Close()
+		os.RemoveAll(dir)
+	}
+
+	if _, unmap, ok := MapReaderAt(f, int64(len(data))); ok {
+		unmap()
+	} else {
+		cleanup()
+		t.Fatal("file not mapped")
+	}
+	if _, _, ok := MapReaderAt(bytes.NewReader(data), int64(len(data))); ok {
+		cleanup()
+		t.Fatal("bytes.Reader mapped")
+	}
+	return []testReader{{"mapped", f}, {"unmapped", bytes.NewReader(data)}}, cleanup
+}
+
+var testOptions = []struct {
+	name string
+	opts SignatureOptions
+}{
+	{"default", SignatureOptions{}},
+	{"fixed", SignatureOptions{BlockSize: 1000}},
+	{"fixed buzhash sha256", SignatureOptions{BlockSize: 777, RollingAlgorithm: RollingBuzhash, StrongAlgorithm: StrongSHA256}},
+	{"fixed blake2b", SignatureOptions{BlockSize: 1000, StrongAlgorithm: StrongBLAKE2b}},
+	{"cdc", SignatureOptions{BlockSize: 4096, Chunking: ChunkingCDC}},
+	{"cdc xxh3", SignatureOptions{BlockSize: 4096, Chunking: ChunkingCDC, StrongAlgorithm: StrongXXH3}},
+}
+
+func TestCreateSignatureFromReaderAtMatchesSequential(t *testing.T) {
+	data := testData(1<<20 + 777)
+	readers, cleanup := testReaders(t, data)
+	defer cleanup()
+
+	for _, o := range testOptions {
+		want, err := CreateSignatureFromScratchWithOptions(bytes.NewReader(data), o.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.name == "default" {
+			scratch, err := CreateSignatureFromScratch(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(scratch, want) {
+				t.Fatal("default options differ from CreateSignatureFromScratch")
+			}
+		}
+
+		for _, r := range readers {
+			for _, workers := range []int{1, 2, 4, 16} {
+				got, err := CreateSignatureFromReaderAt(r.r, int64(len(data)), o.opts, workers)
+				if err != nil {
+					t.Fatalf("%s %s %d workers: %v", o.name, r.name, workers, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s %s %d workers: signature differs from the sequential one", o.name, r.name, workers)
+				}
+			}
+		}
+	}
+}
+
+func TestCreateSignatureFromReaderAtEmpty(t *testing.T) {
+	want, err := CreateSignatureFromScratchWithOptions(bytes.NewReader(nil), SignatureOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := CreateSignatureFromReaderAt(bytes.NewReader(nil), 0, SignatureOptions{}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("empty signature differs from the sequential one")
+	}
+}
+
+func TestCreateSignatureAndHashFromReaderAt(t *testing.T) {
+	data := testData(1<<20 + 777)
+	readers, cleanup := testReaders(t, data)
+	defer cleanup()
+
+	for _, o := range testOptions {
+		want, err := CreateSignatureFromScratchWithOptions(bytes.NewReader(data), o.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantHash, err := o.opts.WithDefaults().StrongAlgorithm.HashReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range readers {
+			for _, workers := range []int{1, 4} {
+				got, hash, err := CreateSignatureAndHashFromReaderAt(r.r, int64(len(data)), o.opts, workers)
+				if err != nil {
+					t.Fatalf("%s %s %d workers: %v", o.name, r.name, workers, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s %s %d workers: signature differs from the sequential one", o.name, r.name, workers)
+				}
+				if hash != wantHash {
+					t.Errorf("%s %s %d workers: wrong content hash", o.name, r.name, workers)
+				}
+			}
+		}
+	}
+}
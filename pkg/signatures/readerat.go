@@ -0,0 +1,33 @@
+package signatures
+
+import (
+	"io"
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// MapReaderAt mmaps the first size bytes of r, if r is a file that can be mmapped. ok is false for anything
+// else (in memory data, pipes, FUSE mounts without mmap support, an empty file...), which can still be
+// read with ReadAt. unmap releases the mapping.
+func MapReaderAt(r io.ReaderAt, size int64) (data []byte, unmap func() error, ok bool) {
+	f, isFile := r.(*os.File)
+	if !isFile || size <= 0 {
+		return nil, nil, false
+	}
+	mm, err := mmap.Map(f, mmap.RDONLY, 0)
+	if err != nil {
+		return nil, nil, false
+	}
+	if int64(len(mm)) < size {
+		mm.Unmap()
+		return nil, nil, false
+	}
+	return mm[:size], mm.Unmap, true
+}
+
+// ReadFullAt reads len(buf) bytes of r at offset, an error if there arent that many.
+func ReadFullAt(r io.ReaderAt, buf []byte, offset int64) error {
+	_, err := io.ReadFull(io.NewSectionReader(r, offset, int64(len(buf))), buf)
+	return err
+}
@@ -0,0 +1,226 @@
+package signatures
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// RollingAlgorithm identifies the rolling checksum used for a signature.
+type RollingAlgorithm uint8
+
+const (
+	// RollingSum is the original pair of (unbounded) sums, see CreateRollingSignature.
+	RollingSum RollingAlgorithm = 1
+
+	// RollingAdler32 is Adler-32 as used by rsync, Sig1 and Sig2 are the two modulo 65521 sums.
+	RollingAdler32 RollingAlgorithm = 2
+
+	// RollingRabinKarp is a polynomial hash modulo 2^61-1, in Sig1.
+	RollingRabinKarp RollingAlgorithm = 3
+
+	// RollingBuzhash is a cyclic polynomial (table based) hash, in Sig1.
+	RollingBuzhash RollingAlgorithm = 4
+
+	DefaultRollingAlgorithm = RollingSum
+)
+
+var rollingAlgorithmNames = map[RollingAlgorithm]string{
+	RollingSum:       "sum",
+	RollingAdler32:   "adler32",
+	RollingRabinKarp: "rabinkarp",
+	RollingBuzhash:   "buzhash",
+}
+
+func (alg RollingAlgorithm) String() string {
+	if name, ok := rollingAlgorithmNames[alg]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", alg)
+}
+
+// ParseRollingAlgorithm converts a name (sum, adler32, rabinkarp or buzhash) to a RollingAlgorithm.
+// An empty name is the default.
+func ParseRollingAlgorithm(name string) (RollingAlgorithm, error) {
+	if name == "" {
+		return DefaultRollingAlgorithm, nil
+	}
+	for alg, algName := range rollingAlgorithmNames {
+		if strings.EqualFold(name, algName) {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rolling algorithm %s", name)
+}
+
+// Valid reports whether alg is a known algorithm.
+func (alg RollingAlgorithm) Valid() bool {
+	_, ok := rollingAlgorithmNames[alg]
+	return ok
+}
+
+// RollingHash calculates rolling checksums over a fixed size window.
+// Sum hashes a whole block (of any size, for the last block of a file), Roll moves the
+// window one byte along given the byte leaving and the byte entering it.
+type RollingHash interface {
+	Sum(block []byte) RollingSignature
+	Roll(previousByte byte, nextByte byte, existingSignature RollingSignature) RollingSignature
+}
+
+// NewRollingHash returns the RollingHash for alg, rolling over windowSize bytes.
+// An unknown algorithm falls back to RollingSum, check Valid first.
+func NewRollingHash(alg RollingAlgorithm, windowSize int64) RollingHash {
+	switch alg {
+	case RollingAdler32:
+		return adler32Hash{windowSize: windowSize}
+	case RollingRabinKarp:
+		return newRabinKarpHash(windowSize)
+	case RollingBuzhash:
+		return buzhash{shift: uint(windowSize % 64)}
+	}
+	return sumHash{windowSize: windowSize}
+}
+
+// sumHash is the original rolling checksum.
+type sumHash struct {
+	windowSize int64
+}
+
+func (h sumHash) Sum(block []byte) RollingSignature {
+	return CreateRollingSignature(block, len(block))
+}
+
+func (h sumHash) Roll(previousByte byte, nextByte byte, existingSignature RollingSignature) RollingSignature {
+	return RollSignature(h.windowSize, previousByte, nextByte, existingSignature)
+}
+
+const adler32Mod = 65521
+
+// adler32Hash gives the same a and b as hash/adler32, but can roll.
+type adler32Hash struct {
+	windowSize int64
+}
+
+func (h adler32Hash) Sum(block []byte) RollingSignature {
+	a := uint64(1)
+	b := uint64(0)
+	for _, d := range block {
+		a += uint64(d)
+		b += a
+
+		// b grows fastest, keep well clear of overflow without a mod per byte.
+		if b >= 1<<62 {
+			a %= adler32Mod
+			b %= adler32Mod
+		}
+	}
+	return RollingSignature{Sig1: int64(a % adler32Mod), Sig2: int64(b % adler32Mod)}
+}
+
+func (h adler32Hash) Roll(previousByte byte, nextByte byte, existingSignature RollingSignature) RollingSignature {
+	n := h.windowSize % adler32Mod
+	a := (existingSignature.Sig1 - int64(previousByte) + int64(nextByte)) % adler32Mod
+	if a < 0 {
+		a += adler32Mod
+	}
+	b := (existingSignature.Sig2 - n*int64(previousByte) + a - 1) % adler32Mod
+	if b < 0 {
+		b += adler32Mod
+	}
+	return RollingSignature{Sig1: a, Sig2: b}
+}
+
+const (
+	rabinKarpMod  = 1<<61 - 1
+	rabinKarpBase = 0x100000001b3 // FNV-64 prime, anything coprime with the modulus would do.
+)
+
+// rabinKarpHash is sum(d[i] * base^(n-1-i)) mod 2^61-1.
+type rabinKarpHash struct {
+	// base^(windowSize-1), to remove the byte leaving the window.
+	outPower uint64
+}
+
+func newRabinKarpHash(windowSize int64) rabinKarpHash {
+	power := uint64(1)
+	base := uint64(rabinKarpBase)
+	for exp := windowSize - 1; exp > 0; exp >>= 1 {
+		if exp&1 == 1 {
+			power = mulMod61(power, base)
+		}
+		base = mulMod61(base, base)
+	}
+	return rabinKarpHash{outPower: power}
+}
+
+// mulMod61 returns a*b mod 2^61-1, for a and b below the modulus.
+func mulMod61(a uint64, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	r := (hi<<3 | lo>>61) + lo&rabinKarpMod
+	if r >= rabinKarpMod {
+		r -= rabinKarpMod
+	}
+	return r
+}
+
+func addMod61(a uint64, b uint64) uint64 {
+	r := a + b
+	if r >= rabinKarpMod {
+		r -= rabinKarpMod
+	}
+	return r
+}
+
+func (h rabinKarpHash) Sum(block []byte) RollingSignature {
+	sum := uint64(0)
+	for _, d := range block {
+		sum = addMod61(mulMod61(sum, rabinKarpBase), uint64(d))
+	}
+	return RollingSignature{Sig1: int64(sum)}
+}
+
+func (h rabinKarpHash) Roll(previousByte byte, nextByte byte, existingSignature RollingSignature) RollingSignature {
+	sum := uint64(existingSignature.Sig1)
+	sum = addMod61(sum, rabinKarpMod-mulMod61(uint64(previousByte), h.outPower))
+	sum = addMod61(mulMod61(sum, rabinKarpBase), uint64(nextByte))
+	return RollingSignature{Sig1: int64(sum)}
+}
+
+// buzhashTable maps each byte to a random value. Fixed (generated from a constant seed),
+// since it is effectively part of the signature format.
+var buzhashTable = randomTable(0x6a09e667f3bcc908)
+
+// randomTable generates a table of pseudo random values (splitmix64) from seed.
+func randomTable(seed uint64) [256]uint64 {
+	var table [256]uint64
+	state := seed
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// buzhash is xor(rotl(table[d[i]], n-1-i)).
+type buzhash struct {
+	// windowSize mod 64, rotation of the byte leaving the window.
+	shift uint
+}
+
+func (h buzhash) Sum(block []byte) RollingSignature {
+	sum := uint64(0)
+	for _, d := range block {
+		sum = bits.RotateLeft64(sum, 1) ^ buzhashTable[d]
+	}
+	return RollingSignature{Sig1: int64(sum)}
+}
+
+func (h buzhash) Roll(previousByte byte, nextByte byte, existingSignature RollingSignature) RollingSignature {
+	sum := bits.RotateLeft64(uint64(existingSignature.Sig1), 1) ^
+		bits.RotateLeft64(buzhashTable[previousByte], int(h.shift)) ^
+		buzhashTable[nextByte]
+	return RollingSignature{Sig1: int64(sum)}
+}
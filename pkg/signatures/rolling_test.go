@@ -0,0 +1,53 @@
+package signatures
+
+import (
+	"bytes"
+	"hash/adler32"
+	"testing"
+)
+
+func TestRollingMatchesSum(t *testing.T) {
+	random := testData(20000)
+	ones := bytes.Repeat([]byte{0xff}, 3000)
+	// a window past the adler32 modulus, so it has to be reduced when rolling.
+	long := testData(adler32Mod + 500)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		windowSize int
+	}{
+		{"random 1", random, 1},
+		{"random 2", random, 2},
+		{"random 63", random, 63},
+		{"random 64", random, 64},
+		{"random 65", random, 65},
+		{"random 1000", random, 1000},
+		{"0xff 64", ones, 64},
+		{"0xff 1000", ones, 1000},
+		{"long", long, adler32Mod + 9},
+	}
+
+	for alg := range rollingAlgorithmNames {
+		for _, tt := range tests {
+			rollingHash := NewRollingHash(alg, int64(tt.windowSize))
+			sig := rollingHash.Sum(tt.data[:tt.windowSize])
+			for offset := 1; offset+tt.windowSize <= len(tt.data); offset++ {
+				sig = rollingHash.Roll(tt.data[offset-1], tt.data[offset+tt.windowSize-1], sig)
+				if want := rollingHash.Sum(tt.data[offset : offset+tt.windowSize]); sig != want {
+					t.Fatalf("%s %s: rolled to offset %d got %+v, Sum is %+v", alg, tt.name, offset, sig, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRollingAdler32IsAdler32(t *testing.T) {
+	rollingHash := NewRollingHash(RollingAdler32, 0)
+	for _, data := range [][]byte{nil, []byte("Wikipedia"), bytes.Repeat([]byte{0xff}, 100000), testData(100000)} {
+		sig := rollingHash.Sum(data)
+		if got, want := uint32(sig.Sig2)<<16|uint32(sig.Sig1), adler32.Checksum(data); got != want {
+			t.Errorf("%d bytes: got %08x, hash/adler32 gives %08x", len(data), got, want)
+		}
+	}
+}
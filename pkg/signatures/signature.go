@@ -1,5 +1,12 @@
 package signatures
 
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
 
 type RollingSignature struct {
   Sig1 int64
@@ -19,24 +26,158 @@ type CompleteSignature struct {
 
 type SizeBasedCompleteSignature struct {
 	Signatures map[int]CompleteSignature
+
+	// how the signature was generated.
+	SignatureOptions
+
+	// the blob the signature was made for, nil for signatures from before this was recorded.
+	Blob *BlobInfo `json:",omitempty"`
 }
 
+// SignatureOptions controls how signatures are generated, and is recorded in each signature.
+// Legacy (JSON) sigs dont have these, zero means the defaults.
+type SignatureOptions struct {
+	BlockSize        int              `json:",omitempty"`
+	RollingAlgorithm RollingAlgorithm `json:",omitempty"`
+	StrongAlgorithm  StrongAlgorithm  `json:",omitempty"`
+
+	// Chunking is how block boundaries are picked. For ChunkingCDC BlockSize is the average,
+	// Min/MaxBlockSize default to a quarter and 4 times that.
+	Chunking     Chunking `json:",omitempty"`
+	MinBlockSize int      `json:",omitempty"`
+	MaxBlockSize int      `json:",omitempty"`
+}
+
+// DefaultSignatureOptions are the options used unless told otherwise (and assumed for legacy sigs).
+func DefaultSignatureOptions() SignatureOptions {
+	return SignatureOptions{BlockSize: SignatureSize, RollingAlgorithm: DefaultRollingAlgorithm, StrongAlgorithm: DefaultStrongAlgorithm, Chunking: DefaultChunking}
+}
+
+// WithDefaults returns the options with any zero values replaced by the defaults.
+func (o SignatureOptions) WithDefaults() SignatureOptions {
+	defaults := DefaultSignatureOptions()
+	if o.BlockSize == 0 {
+		o.BlockSize = defaults.BlockSize
+	}
+	if o.RollingAlgorithm == 0 {
+		o.RollingAlgorithm = defaults.RollingAlgorithm
+	}
+	if o.StrongAlgorithm == 0 {
+		o.StrongAlgorithm = defaults.StrongAlgorithm
+	}
+	if o.Chunking == 0 {
+		o.Chunking = defaults.Chunking
+	}
+	if o.Chunking == ChunkingCDC {
+		if o.MinBlockSize == 0 {
+			o.MinBlockSize = o.BlockSize / 4
+		}
+		if o.MaxBlockSize == 0 {
+			o.MaxBlockSize = o.BlockSize * 4
+		}
+	}
+	return o
+}
+
+// Validate checks the options only use supported algorithms.
+func (o SignatureOptions) Validate() error {
+	if o.BlockSize < 0 {
+		return fmt.Errorf("invalid block size %d", o.BlockSize)
+	}
+	if o.RollingAlgorithm != 0 && !o.RollingAlgorithm.Valid() {
+		return fmt.Errorf("unknown rolling algorithm %d", o.RollingAlgorithm)
+	}
+	if o.StrongAlgorithm != 0 && o.StrongAlgorithm.Size() == 0 {
+		return fmt.Errorf("unknown strong hash algorithm %d", o.StrongAlgorithm)
+	}
+	if o.Chunking != 0 && !o.Chunking.Valid() {
+		return fmt.Errorf("unknown chunking %d", o.Chunking)
+	}
+	if o.Chunking == ChunkingCDC {
+		o = o.WithDefaults()
+		if o.MinBlockSize <= 0 || o.MinBlockSize >= o.BlockSize || o.MaxBlockSize <= o.BlockSize {
+			return fmt.Errorf("invalid chunk sizes, need 0 < min %d < average %d < max %d", o.MinBlockSize, o.BlockSize, o.MaxBlockSize)
+		}
+	}
+	return nil
+}
+
+// BlockSizeForFile picks a block size so a file of fileSize bytes takes no more than targetBlocks
+// blocks. Never less than minBlockSize or more than maxBlockSize, so a huge file may still need more.
+func BlockSizeForFile(fileSize int64, targetBlocks int, minBlockSize int, maxBlockSize int) int {
+	blockSize := (fileSize + int64(targetBlocks) - 1) / int64(targetBlocks)
+	if blockSize < int64(minBlockSize) {
+		return minBlockSize
+	}
+	if blockSize > int64(maxBlockSize) {
+		return maxBlockSize
+	}
+	return int(blockSize)
+}
 
 func NewSizeBasedCompleteSignature() SizeBasedCompleteSignature {
+	return NewSizeBasedCompleteSignatureWithOptions(DefaultSignatureOptions())
+}
+
+func NewSizeBasedCompleteSignatureWithOptions(opts SignatureOptions) SizeBasedCompleteSignature {
 	s := SizeBasedCompleteSignature{}
 	s.Signatures = make(map[int]CompleteSignature)
+	s.SignatureOptions = opts.WithDefaults()
 	return s
 }
 
 // output to stdout.
 func (s SizeBasedCompleteSignature) Display() {
-
+	fmt.Printf("block size %d, rolling algorithm %s, strong algorithm %s, chunking %s\n", s.BlockSize, s.RollingAlgorithm, s.StrongAlgorithm, s.Chunking)
+	for _, b := range ExpandSizeBasedCompleteSignature(s) {
+		fmt.Printf("%d: offset %d size %d rolling %d/%d strong %x\n", b.BlockNo, b.Offset, b.Size, b.RollingSig.Sig1, b.RollingSig.Sig2, b.StrongSig[:s.StrongAlgorithm.Size()])
+	}
 }
 
-// SaveToFile, should probably change to a io.Writer
+// SaveToFile writes the signature (binary format) to fileName.
 func (s SizeBasedCompleteSignature) SaveToFile( fileName string) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
 
+	_, err = s.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-	return nil
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w     io.Writer
+	count int64
 }
 
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
+}
+
+// WriteTo streams the signature (binary format) to w.
+func (s SizeBasedCompleteSignature) WriteTo(w io.Writer) (int64, error) {
+	cw := countingWriter{w: w}
+	err := writeBinarySignature(&cw, s)
+	return cw.count, err
+}
+
+// ReadFrom reads a signature (binary or legacy JSON) from r, replacing s.
+func (s *SizeBasedCompleteSignature) ReadFrom(r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	sig, err := ParseSignature(data)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	*s = *sig
+	return int64(len(data)), nil
+}
@@ -0,0 +1,38 @@
+package signatures
+
+import "testing"
+
+func TestBlockSizeForFile(t *testing.T) {
+	const target = 50000
+	const min = 20000
+	const max = 100 * 1024 * 1024
+
+	tests := []struct {
+		fileSize int64
+		want     int
+	}{
+		{0, min},
+		{1, min},
+		{target*min - 1, min},
+		{target * min, min},
+		// one byte more no longer fits in target blocks of the minimum.
+		{target*min + 1, min + 1},
+		{target*(min+1) - 1, min + 1},
+		{target * (min + 1), min + 1},
+		{target*(min+1) + 1, min + 2},
+		{target*max - 1, max},
+		{target * max, max},
+		// past the maximum the block count has to give.
+		{target*max + 1, max},
+	}
+	for _, tt := range tests {
+		got := BlockSizeForFile(tt.fileSize, target, min, max)
+		if got != tt.want {
+			t.Errorf("%d byte file: block size %d, want %d", tt.fileSize, got, tt.want)
+		}
+		blocks := (tt.fileSize + int64(got) - 1) / int64(got)
+		if blocks > target && tt.fileSize <= target*max {
+			t.Errorf("%d byte file: %d blocks of %d, more than %d", tt.fileSize, blocks, got, target)
+		}
+	}
+}
@@ -2,9 +2,7 @@ package signatures
 
 import (
 	"crypto/md5"
-	"fmt"
 	"io"
-	"os"
 	"sort"
 )
 
@@ -48,13 +46,23 @@ func CreateMD5Signature(byteBlock []byte, length int) [md5.Size]byte {
 	return md5.Sum(byteBlock)
 }
 
+// CreateStrongSignature hashes byteBlock with the given strong hash algorithm.
+func CreateStrongSignature(byteBlock []byte, alg StrongAlgorithm) StrongHash {
+	return alg.Sum(byteBlock)
+}
+
 func GenerateBlockSig( buffer []byte, offset int64, blockSize int, id int ) (*BlockSig, error) {
+	return GenerateBlockSigWithOptions(buffer, offset, blockSize, id, DefaultSignatureOptions())
+}
+
+// GenerateBlockSigWithOptions is GenerateBlockSig using the algorithms from opts.
+func GenerateBlockSigWithOptions(buffer []byte, offset int64, blockSize int, id int, opts SignatureOptions) (*BlockSig, error) {
 	bs := BlockSig{}
-	rollingSig := CreateRollingSignature(buffer, blockSize)
-	md5Sig := CreateMD5Signature(buffer[:blockSize], blockSize)
+	rollingSig := NewRollingHash(opts.RollingAlgorithm, int64(blockSize)).Sum(buffer[:blockSize])
+	strongSig := CreateStrongSignature(buffer[:blockSize], opts.StrongAlgorithm)
 
 	bs.RollingSig = rollingSig
-	bs.MD5Signature = md5Sig
+	bs.StrongSig = strongSig
 	bs.Offset = offset
 	bs.BlockNo = id
 	bs.Size = blockSize
@@ -100,30 +108,43 @@ func CreateSignatureFromNewAndReusedBlocks(allBlocks []UploadedBlock) (*SizeBase
   return &sizedBasedSignature, nil
 }
 
-// CreateSignatureFromScratch reads a file, creates a signature.
-func CreateSignatureFromScratch( localFile *os.File ) (*SizeBasedCompleteSignature, error) {
+// CreateSignatureFromScratch reads a file (or anything else), creates a signature.
+func CreateSignatureFromScratch( localFile io.Reader ) (*SizeBasedCompleteSignature, error) {
+	return CreateSignatureFromScratchWithOptions(localFile, DefaultSignatureOptions())
+}
+
+// CreateSignatureFromScratchWithOptions is CreateSignatureFromScratch using the block size and algorithms from opts.
+func CreateSignatureFromScratchWithOptions(localFile io.Reader, opts SignatureOptions) (*SizeBasedCompleteSignature, error) {
 
+	opts = opts.WithDefaults()
+	chunker := NewChunker(opts)
 	offset := int64(0)
-	buffer := make([]byte, SignatureSize)
+	buffer := make([]byte, chunker.MaxBlockSize())
+	buffered := 0
+	eof := false
 	idCount := 0
 	//reader := bufio.NewReader(f)
 
 	sigSizeLUT := make(map[int][]BlockSig)
 	for {
-		n, err := localFile.Read(buffer)
-
-		if err != nil && err != io.EOF {
-			fmt.Printf("Cannot read file: %s\n", err.Error())
-			return nil, err
+		// keep the buffer full, the chunker needs to see up to the largest block.
+		if !eof {
+			bytesRead, err := io.ReadFull(localFile, buffer[buffered:])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+			buffered += bytesRead
 		}
 
-		if err == io.EOF {
+		if buffered == 0 {
 			break
 		}
+		n := chunker.NextBlockSize(buffer[:buffered])
 
-		blockSig,err := GenerateBlockSig( buffer, offset, n, idCount)
+		blockSig,err := GenerateBlockSigWithOptions( buffer, offset, n, idCount, opts)
 		if err != nil {
-			fmt.Printf("error generatingBlockSig %s\n", err.Error())
 			return nil, err
 		}
 		var blockSigArray []BlockSig
@@ -137,11 +158,13 @@ func CreateSignatureFromScratch( localFile *os.File ) (*SizeBasedCompleteSignatu
 		blockSigArray = append(blockSigArray, *blockSig)
 		sigSizeLUT[n] = blockSigArray
 
+		copy(buffer, buffer[n:buffered])
+		buffered -= n
 		offset += int64(n)
 		idCount++
 	}
 
-  sizedBaseSignature := NewSizeBasedCompleteSignature()
+  sizedBaseSignature := NewSizeBasedCompleteSignatureWithOptions(opts)
 
   for k,v := range sigSizeLUT {
   	compSig := CompleteSignature{}
@@ -0,0 +1,160 @@
+package signatures
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// StrongAlgorithm identifies the strong hash used for a signature (and block IDs).
+type StrongAlgorithm uint8
+
+const (
+	StrongMD5     StrongAlgorithm = 1
+	StrongSHA256  StrongAlgorithm = 2
+	StrongBLAKE2b StrongAlgorithm = 3 // BLAKE2b-256
+
+	// StrongXXH3 is the 128 bit xxh3 hash. Not cryptographic, only use it for trusted data.
+	StrongXXH3 StrongAlgorithm = 4
+
+	DefaultStrongAlgorithm = StrongMD5
+)
+
+// MaxStrongHashSize is the size of the largest strong hash (SHA-256/BLAKE2b-256).
+const MaxStrongHashSize = 32
+
+// StrongHash holds a strong hash of any supported algorithm. Shorter hashes (eg. MD5)
+// only use the start, the rest is zero. Kept as an array so BlockSig stays comparable.
+type StrongHash [MaxStrongHashSize]byte
+
+var strongAlgorithmNames = map[StrongAlgorithm]string{
+	StrongMD5:     "md5",
+	StrongSHA256:  "sha256",
+	StrongBLAKE2b: "blake2b",
+	StrongXXH3:    "xxh3",
+}
+
+func (alg StrongAlgorithm) String() string {
+	if name, ok := strongAlgorithmNames[alg]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", alg)
+}
+
+// ParseStrongAlgorithm converts a name (md5, sha256, blake2b or xxh3) to a StrongAlgorithm.
+// An empty name is the default.
+func ParseStrongAlgorithm(name string) (StrongAlgorithm, error) {
+	if name == "" {
+		return DefaultStrongAlgorithm, nil
+	}
+	for alg, algName := range strongAlgorithmNames {
+		if strings.EqualFold(name, algName) {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strong hash algorithm %s", name)
+}
+
+// Size returns the number of bytes of the hash actually used, 0 for an unknown algorithm.
+func (alg StrongAlgorithm) Size() int {
+	switch alg {
+	case StrongMD5:
+		return md5.Size
+	case StrongSHA256:
+		return sha256.Size
+	case StrongBLAKE2b:
+		return blake2b.Size256
+	case StrongXXH3:
+		return 16
+	}
+	return 0
+}
+
+// Sum hashes data. An unknown algorithm falls back to MD5, check Size first.
+func (alg StrongAlgorithm) Sum(data []byte) StrongHash {
+	var h StrongHash
+	switch alg {
+	case StrongSHA256:
+		sum := sha256.Sum256(data)
+		copy(h[:], sum[:])
+	case StrongBLAKE2b:
+		sum := blake2b.Sum256(data)
+		copy(h[:], sum[:])
+	case StrongXXH3:
+		sum := xxh3.Hash128(data)
+		binary.BigEndian.PutUint64(h[0:8], sum.Hi)
+		binary.BigEndian.PutUint64(h[8:16], sum.Lo)
+	default:
+		sum := md5.Sum(data)
+		copy(h[:], sum[:])
+	}
+	return h
+}
+
+// BlockID returns the block ID for a block with the given hash. All block IDs of a blob must be
+// the same length, so a blob has to be fully re-uploaded to change algorithm.
+func (alg StrongAlgorithm) BlockID(hash StrongHash) string {
+	size := alg.Size()
+	if size == 0 {
+		size = md5.Size
+	}
+	return base64.StdEncoding.EncodeToString(hash[:size])
+}
+
+// StrongHasher hashes data written to it a piece at a time, see NewHasher.
+type StrongHasher struct {
+	hasher hash.Hash
+	xxh3   *xxh3.Hasher
+}
+
+// NewHasher returns a hasher for everything written to it, however it is split up. The same as Sum would give
+// for all of it at once, except xxh3 past a few KB (the streaming xxh3 differs), so dont mix the two.
+func (alg StrongAlgorithm) NewHasher() *StrongHasher {
+	switch alg {
+	case StrongXXH3:
+		return &StrongHasher{xxh3: xxh3.New()}
+	case StrongSHA256:
+		return &StrongHasher{hasher: sha256.New()}
+	case StrongBLAKE2b:
+		hasher, _ := blake2b.New256(nil)
+		return &StrongHasher{hasher: hasher}
+	}
+	return &StrongHasher{hasher: md5.New()}
+}
+
+func (h *StrongHasher) Write(p []byte) (int, error) {
+	if h.xxh3 != nil {
+		return h.xxh3.Write(p)
+	}
+	return h.hasher.Write(p)
+}
+
+// Sum returns the hash of everything written so far.
+func (h *StrongHasher) Sum() StrongHash {
+	var sum StrongHash
+	if h.xxh3 != nil {
+		sum128 := h.xxh3.Sum128()
+		binary.BigEndian.PutUint64(sum[0:8], sum128.Hi)
+		binary.BigEndian.PutUint64(sum[8:16], sum128.Lo)
+		return sum
+	}
+	copy(sum[:], h.hasher.Sum(nil))
+	return sum
+}
+
+// HashReader hashes everything read from r with a StrongHasher.
+func (alg StrongAlgorithm) HashReader(r io.Reader) (StrongHash, error) {
+	hasher := alg.NewHasher()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return StrongHash{}, err
+	}
+	return hasher.Sum(), nil
+}
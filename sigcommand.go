@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/kpfaulkner/blobsyncgo/pkg/blobsync"
+	"github.com/kpfaulkner/blobsyncgo/pkg/signatures"
+)
+
+// how many duplicate blocks the summary lists, the rest are just counted.
+const maxDuplicatesShown = 10
+
+// sigCommand is "blobsyncgo sig ...", for looking at a signature without syncing anything.
+// Returns the exit code.
+func sigCommand(args []string) int {
+	fs := flag.NewFlagSet("sig", flag.ExitOnError)
+	sigFile := fs.String("sigfile", "", "local signature file to inspect")
+	blobName := fs.String("blob", "", "name of blob, to inspect its .sig")
+	containerName := fs.String("container", "", "name of container")
+	format := fs.String("format", "summary", "output: summary, json or csv")
+	validate := fs.Bool("validate", false, "check the blocks are contiguous (and cover the blob length, if known)")
+	length := fs.Int64("length", -1, "length of the blob the signature is for, for -validate (default the blobs length, for -blob)")
+	filePath := fs.String("file", "", "local copy of the blob, its size is used as -length")
+	storageFlags := addStorageFlags(fs)
+	fs.Parse(args)
+
+	if (*sigFile == "") == (*blobName == "" || *containerName == "") {
+		fmt.Printf("Need to specify either sigfile or blob and container\n")
+		return 2
+	}
+
+	var sig *signatures.SizeBasedCompleteSignature
+	var props *signatures.BlobProperties
+	var err error
+	if *sigFile != "" {
+		sig, err = readSignatureFile(*sigFile)
+	} else {
+		sig, props, err = downloadSignature(storageFlags, *containerName, *blobName)
+	}
+	if err != nil {
+		fmt.Printf("ERROR reading signature : %s\n", err.Error())
+		return 1
+	}
+
+	if props != nil && *length < 0 {
+		*length = props.Size
+	}
+
+	if *filePath != "" {
+		stats, err := os.Stat(*filePath)
+		if err != nil {
+			fmt.Printf("ERROR reading file : %s\n", err.Error())
+			return 1
+		}
+		*length = stats.Size()
+	}
+
+	switch *format {
+	case "summary":
+		printSummary(os.Stdout, signatures.Summarize(*sig))
+	case "json":
+		err = signatures.WriteBlocksJSON(os.Stdout, *sig)
+	case "csv":
+		err = signatures.WriteBlocksCSV(os.Stdout, *sig)
+	default:
+		fmt.Printf("Unknown format %s\n", *format)
+		return 2
+	}
+	if err != nil {
+		fmt.Printf("ERROR writing blocks : %s\n", err.Error())
+		return 1
+	}
+
+	if *validate {
+		if err := signatures.Summarize(*sig).Validate(*length); err != nil {
+			fmt.Fprintf(os.Stderr, "INVALID : %s\n", err.Error())
+			return 1
+		}
+		if props != nil {
+			if err := sig.CheckBlob(*props); err != nil {
+				fmt.Fprintf(os.Stderr, "INVALID : %s\n", err.Error())
+				return 1
+			}
+		}
+		fmt.Fprintf(os.Stderr, "valid\n")
+	}
+	return 0
+}
+
+func readSignatureFile(path string) (*signatures.SizeBasedCompleteSignature, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return signatures.ParseSignature(data)
+}
+
+// downloadSignature fetches <blob>.sig from wherever the storage flags/config point, along with
+// the properties of the blob itself.
+func downloadSignature(storageFlags storageFlags, containerName string, blobName string) (*signatures.SizeBasedCompleteSignature, *signatures.BlobProperties, error) {
+	config, err := storageFlags.loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	backend, err := createBackend(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if closer, ok := backend.(io.Closer); ok {
+		defer closer.Close()
+	}
+	bs := blobsync.NewBlobSyncWithBackend(backend)
+	sig, err := bs.DownloadSignatureForBlob(containerName, blobName)
+	if err != nil {
+		return nil, nil, err
+	}
+	props, err := backend.GetBlobProperties(context.Background(), containerName, blobName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, props, nil
+}
+
+func printSummary(w io.Writer, summary signatures.SignatureSummary) {
+	fmt.Fprintf(w, "strong hash:   %s\n", summary.StrongAlgorithm)
+	fmt.Fprintf(w, "rolling hash:  %s\n", summary.RollingAlgorithm)
+	fmt.Fprintf(w, "chunking:      %s\n", summary.Chunking)
+	if summary.Chunking == signatures.ChunkingCDC {
+		fmt.Fprintf(w, "block size:    %d (min %d, max %d)\n", summary.BlockSize, summary.MinBlockSize, summary.MaxBlockSize)
+	} else {
+		fmt.Fprintf(w, "block size:    %d\n", summary.BlockSize)
+	}
+	if summary.Blob != nil {
+		fmt.Fprintf(w, "blob length:   %d\n", summary.Blob.Length)
+		fmt.Fprintf(w, "blob ETag:     %s\n", summary.Blob.ETag)
+		fmt.Fprintf(w, "content hash:  %x\n", summary.Blob.ContentHash[:summary.StrongAlgorithm.Size()])
+		if summary.Blob.Regenerated {
+			fmt.Fprintf(w, "regenerated:   yes (blocks arent the blobs blocks)\n")
+		}
+	}
+	fmt.Fprintf(w, "blocks:        %d\n", summary.BlockCount)
+	fmt.Fprintf(w, "bytes covered: %d (last block ends at %d)\n", summary.TotalBytes, summary.End)
+
+	sizes := []int{}
+	for size := range summary.BlocksPerSize {
+		sizes = append(sizes, size)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	fmt.Fprintf(w, "blocks per size:\n")
+	for _, size := range sizes {
+		fmt.Fprintf(w, "  %10d : %d\n", size, summary.BlocksPerSize[size])
+	}
+
+	fmt.Fprintf(w, "gaps:          %d\n", len(summary.Gaps))
+	for _, gap := range summary.Gaps {
+		fmt.Fprintf(w, "  %d - %d\n", gap.BeginOffset, gap.EndOffset)
+	}
+	fmt.Fprintf(w, "overlaps:      %d\n", len(summary.Overlaps))
+	for _, overlap := range summary.Overlaps {
+		fmt.Fprintf(w, "  %d - %d\n", overlap.BeginOffset, overlap.EndOffset)
+	}
+
+	fmt.Fprintf(w, "duplicates:    %d\n", len(summary.Duplicates))
+	hashSize := summary.StrongAlgorithm.Size()
+	for i, dup := range summary.Duplicates {
+		if i == maxDuplicatesShown {
+			fmt.Fprintf(w, "  ... and %d more\n", len(summary.Duplicates)-maxDuplicatesShown)
+			break
+		}
+		fmt.Fprintf(w, "  %x at %v\n", dup.StrongSig[:hashSize], dup.Offsets)
+	}
+}